@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cytrusdownloader/store"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["cache"] = command{description: "Gère le dépôt local de chunks [stats|prune|verify]", run: cacheCommand}
+}
+
+// openStore ouvre le dépôt local de chunks et d'objets situé dans le dossier de cache
+func openStore(cacheDir string) (*store.Store, error) {
+	return store.Open(filepath.Join(cacheDir, "objects"))
+}
+
+func cacheCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Erreur, veuillez indiquer une action [stats|prune|verify]")
+	}
+	action := args[0]
+
+	var cacheDir string
+	var maxSize string
+	var maxAge time.Duration
+	var remove bool
+
+	flags := flag.NewFlagSet("cache "+action, flag.ExitOnError)
+	flags.StringVar(&cacheDir, "cache-dir", defaultCacheDir(), "Dossier de cache local contenant le dépôt")
+	switch action {
+	case "prune":
+		flags.StringVar(&maxSize, "max-size", "", "Taille maximale du dépôt, les objets les moins récemment utilisés sont supprimés (ex: 500M, 20G)")
+		flags.DurationVar(&maxAge, "max-age", 0, "Supprime les objets non utilisés depuis cette durée (ex: 720h)")
+	case "verify":
+		flags.BoolVar(&remove, "remove", false, "Supprime les objets corrompus")
+	case "stats":
+	default:
+		return errors.New("Erreur, l'action " + action + " n'existe pas [stats|prune|verify]")
+	}
+	flags.Parse(args[1:])
+
+	objectStore, err := openStore(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "stats":
+		stats, err := objectStore.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Dépôt local:", objectStore.Dir())
+		fmt.Println("Objets:", stats.Objects, " taille:", formatSize(stats.Size))
+		if stats.Objects > 0 {
+			fmt.Println("Utilisation la plus ancienne:", stats.Oldest.Format(time.DateTime), " la plus récente:", stats.Newest.Format(time.DateTime))
+		}
+	case "prune":
+		size, err := parseSize(maxSize)
+		if err != nil {
+			return err
+		}
+		if size == 0 && maxAge == 0 {
+			return errors.New("Erreur, veuillez indiquer -max-size ou -max-age")
+		}
+		result, err := objectStore.Prune(size, maxAge)
+		if err != nil {
+			return err
+		}
+		fmt.Println(result.Removed, "objets supprimés,", formatSize(result.Freed), "libérés")
+	case "verify":
+		corrupted, err := objectStore.Verify(remove)
+		if err != nil {
+			return err
+		}
+		for _, hash := range corrupted {
+			fmt.Println("Objet corrompu:", hash)
+		}
+		if len(corrupted) > 0 {
+			if remove {
+				fmt.Println(len(corrupted), "objets corrompus ont été supprimés")
+				return nil
+			}
+			return errors.New(strconv.Itoa(len(corrupted)) + " objets corrompus dans le dépôt local")
+		}
+		fmt.Println("Tous les objets du dépôt local sont valides")
+	}
+	return nil
+}
+
+// parseSize convertis une taille du type 500M ou 20G en octets
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}}
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSuffix(value, unit.suffix)
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("Erreur, la taille " + value + " est invalide")
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+func formatSize(size int64) string {
+	units := []string{"o", "Ko", "Mo", "Go", "To"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
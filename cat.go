@@ -0,0 +1,73 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	commands["cat"] = command{description: "Écris un seul fichier d'une version sur la sortie standard ou dans un fichier, sans télécharger le reste du jeu", run: catCommand}
+	commands["extract-file"] = command{description: "Alias de cat", run: catCommand}
+}
+
+func catCommand(args []string) error {
+	var output string
+
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	versionOpts := addVersionFlags(flags)
+	flags.StringVar(&output, "o", "", "Fichier dans lequel écrire le contenu, la sortie standard par défaut")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Erreur, veuillez indiquer le fichier à extraire: <fragment>/<chemin>")
+	}
+	options, entries, err := loadEntries(versionOpts)
+	if err != nil {
+		return err
+	}
+	entry, found := cytrus.FindEntry(entries, flags.Arg(0))
+	if !found {
+		return errors.New("Erreur, le fichier " + flags.Arg(0) + " ne fait pas partie de la version")
+	}
+	cytrusGeneration, err := generationOf(options.Version)
+	if err != nil {
+		return err
+	}
+	source := cytrusGeneration.source(options)
+
+	if output == "" {
+		// le contenu est envoyé au fil du téléchargement, une erreur de hash est signalée une fois le fichier écrit
+		return cytrus.WriteEntry(source, entry, os.Stdout)
+	}
+
+	// le fichier est écrit à côté de sa destination puis renommé une fois son hash vérifié
+	if err := os.MkdirAll(filepath.Dir(output), os.ModePerm); err != nil {
+		return errors.New("Erreur lors de la création du répertoire " + filepath.Dir(output))
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".tmp-*")
+	if err != nil {
+		return errors.New("Erreur lors de la création du fichier " + output + "\n[ERREUR]:" + err.Error())
+	}
+	errWrite := cytrus.WriteEntry(source, entry, tmpFile)
+	errClose := tmpFile.Close()
+	if errWrite == nil {
+		errWrite = errClose
+	}
+	if errWrite != nil {
+		os.Remove(tmpFile.Name())
+		return errWrite
+	}
+	mode := os.FileMode(0644)
+	if entry.Executable {
+		mode = 0755
+	}
+	os.Chmod(tmpFile.Name(), mode)
+	if err := os.Rename(tmpFile.Name(), output); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.New("Impossible de renommer le fichier " + tmpFile.Name() + "\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
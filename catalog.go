@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	commands["catalog"] = command{description: "Affiche la liste des jeux, plateformes, releases et versions du cdn", run: catalogCommand}
+}
+
+type catalogEntry struct {
+	Game   string `json:"game"`
+	GameId int64  `json:"gameId"`
+	Name   string `json:"name"`
+	Order  int64  `json:"order"`
+	// génération de cytrus du catalogue d'où provient le jeu
+	Generation int                          `json:"generation"`
+	Platforms  map[string]map[string]string `json:"platforms"`
+	Assets     map[string]string            `json:"assets"`
+}
+
+func catalogCommand(args []string) error {
+	var format string
+	var game string
+
+	flags := flag.NewFlagSet("catalog", flag.ExitOnError)
+	flags.StringVar(&format, "format", "table", "Format de sortie [table|json]")
+	flags.StringVar(&game, "game", "", "Affiche uniquement le jeu indiqué")
+	catalogOpts := addCatalogFlags(flags)
+	flags.Parse(args)
+
+	catalog, err := loadCatalog(catalogOpts)
+	if err != nil {
+		return err
+	}
+
+	// les jeux des catalogues de cytrus 6 et de cytrus 5 sont affichés ensemble, chaque version avec le préfixe de sa génération
+	entries := []catalogEntry{}
+	catalog.each(func(source catalogSource) bool {
+		for gameName, gameInfo := range source.cytrus.Games {
+			if game != "" && strings.ToLower(game) != gameName {
+				continue
+			}
+			platforms := gameInfo.Platforms.Releases()
+			for platform, releases := range platforms {
+				platforms[platform] = tagVersions(releases, source.generation)
+			}
+			entries = append(entries, catalogEntry{
+				Game:       gameName,
+				GameId:     gameInfo.GameId,
+				Name:       gameInfo.Name,
+				Order:      gameInfo.Order,
+				Generation: source.generation,
+				Platforms:  platforms,
+				Assets:     tagVersions(gameInfo.Assets.Metas.Releases(), source.generation),
+			})
+		}
+		return false
+	})
+	if game != "" && len(entries) == 0 {
+		return errors.New("Le nom du jeu saisi n'existe pas")
+	}
+	// les jeux sont triés dans l'ordre donné par le cdn
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Order != entries[j].Order {
+			return entries[i].Order < entries[j].Order
+		}
+		if entries[i].Game != entries[j].Game {
+			return entries[i].Game < entries[j].Game
+		}
+		return entries[i].Generation > entries[j].Generation
+	})
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "table":
+		printCatalogTable(entries)
+		return nil
+	default:
+		return errors.New("Erreur, le format " + format + " n'existe pas")
+	}
+}
+
+// tagVersions renvoie les versions des releases avec le préfixe de leur génération, les versions sans préfixe prennent celui du catalogue
+func tagVersions(releases map[string]string, catalogGeneration int) map[string]string {
+	tagged := make(map[string]string)
+	for release, version := range releases {
+		tagged[release], _ = taggedVersion(version, catalogGeneration)
+	}
+	return tagged
+}
+
+func printCatalogTable(entries []catalogEntry) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer writer.Flush()
+
+	fmt.Fprintln(writer, "JEU\tID\tNOM\tORDRE\tPLATEFORME\tRELEASE\tVERSION\tGÉNÉRATION")
+	printRow := func(entry catalogEntry, platform string, release string, version string) {
+		_, versionGeneration := taggedVersion(version, entry.Generation)
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%d\t%s\t%s\t%s\tcytrus %d\n", entry.Game, entry.GameId, entry.Name, entry.Order, platform, release, version, versionGeneration)
+	}
+	for _, entry := range entries {
+		for _, platform := range sortedKeys(entry.Platforms) {
+			for _, release := range sortedKeys(entry.Platforms[platform]) {
+				printRow(entry, platform, release, entry.Platforms[platform][release])
+			}
+		}
+		// les assets ne dépendent pas d'une plateforme, ils sont affichés sur la plateforme meta
+		for _, release := range sortedKeys(entry.Assets) {
+			printRow(entry, "meta", release, entry.Assets[release])
+		}
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
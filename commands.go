@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+// liste des sous commandes disponibles, chaque fichier enregistre ses commandes dans sa fonction init
+var commands = map[string]command{}
+
+func runCommand(name string, args []string) error {
+	cmd, exists := commands[name]
+	if !exists {
+		printCommands()
+		return errors.New("Erreur, la commande " + name + " n'existe pas")
+	}
+	return cmd.run(args)
+}
+
+func printCommands() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("Commandes disponibles:")
+	for _, name := range names {
+		fmt.Printf("  %-12s %s\n", name, commands[name].description)
+	}
+}
+
+// stringList est une option pouvant être répétée ou contenir plusieurs valeurs séparées par des virgules
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
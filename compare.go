@@ -0,0 +1,327 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	commands["compare"] = command{description: "Compare les fichiers de plusieurs plateformes, releases ou versions d'un jeu à partir de leurs manifests, sans télécharger de bundle", run: compareCommand}
+}
+
+// compareTarget est une version comparée, désignée par <plateforme>/<release>@<version>
+type compareTarget struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+	Release  string `json:"release"`
+	Version  string `json:"version"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+}
+
+// compareFile est un fichier présent dans au moins une des versions comparées
+type compareFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"`
+	// versions qui contiennent le fichier, pour les fichiers communs à une partie des versions
+	Targets []string `json:"targets,omitempty"`
+	// hash du fichier dans chaque version qui le contient, pour les fichiers différents
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+// compareReport est le résultat de la comparaison
+type compareReport struct {
+	Game    string          `json:"game"`
+	Targets []compareTarget `json:"targets"`
+	// fichiers identiques dans toutes les versions
+	Shared []compareFile `json:"shared"`
+	// fichiers identiques dans plusieurs versions mais pas dans toutes
+	Partial []compareFile `json:"partial"`
+	// fichiers présents dans une seule version, indexés par le nom de la version
+	Only map[string][]compareFile `json:"only"`
+	// fichiers de même nom dont le contenu diffère entre les versions
+	Different []compareFile `json:"different"`
+}
+
+func compareCommand(args []string) error {
+	var game string
+	var format string
+	var cdnURL string
+	var fragments stringList
+	var listShared bool
+
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	flags.StringVar(&game, "game", "", "Nom du jeu à comparer")
+	flags.StringVar(&format, "format", "table", "Format du rapport [table|json|html]")
+	flags.StringVar(&cdnURL, "cdn-url", "", "Adresse d'un autre cdn, url http ou dossier local ayant l'arborescence du cdn")
+	flags.Var(&fragments, "fragments", "Fragments à comparer séparés par des virgules, tous par défaut")
+	flags.BoolVar(&listShared, "shared", false, "Liste aussi les fichiers communs à toutes les versions dans le tableau")
+	catalogOpts := addCatalogFlags(flags)
+	flags.Parse(args)
+
+	if game == "" {
+		return errors.New("Erreur, veuillez indiquer le jeu à comparer")
+	}
+	if flags.NArg() < 2 {
+		return errors.New("Erreur, veuillez indiquer au moins deux versions à comparer: <plateforme>/<release>[@<version>], par exemple windows/main linux/main")
+	}
+	if format != "table" && format != "json" && format != "html" {
+		return errors.New("Erreur, le format " + format + " n'existe pas [table|json|html]")
+	}
+	catalogOpts.useCDN(cdnURL)
+	game = strings.ToLower(game)
+
+	targets, err := resolveCompareTargets(game, flags.Args(), catalogOpts)
+	if err != nil {
+		return err
+	}
+	entriesByTarget := make([][]cytrus.Entry, len(targets))
+	for i, target := range targets {
+		options := cytrus.Options{Game: game, Platform: target.Platform, Release: target.Release, Version: target.Version, Fragments: fragments, CDNURL: cdnURL, OnManifest: manifestRecorder(catalogOpts.cacheDir)}
+		cytrusGeneration, err := generationOf(options.Version)
+		if err != nil {
+			return err
+		}
+		manifestData, err := cytrusGeneration.loadManifest(options)
+		if err != nil {
+			return errors.New("Erreur lors du chargement du manifest de " + target.Name + "\n[ERREUR]:" + err.Error())
+		}
+		if entriesByTarget[i], err = cytrusGeneration.entries(manifestData, options); err != nil {
+			return err
+		}
+	}
+
+	report := compareEntries(game, targets, entriesByTarget)
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "html":
+		return compareHTML.Execute(os.Stdout, report)
+	}
+	printCompareTable(os.Stdout, report, listShared)
+	return nil
+}
+
+// resolveCompareTargets lis les versions demandées, la dernière version de la release est utilisée si aucune version n'est précisée
+func resolveCompareTargets(game string, specs []string, catalogOpts *catalogOptions) ([]compareTarget, error) {
+	var catalog *Catalog
+	targets := []compareTarget{}
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		target := compareTarget{Release: "main"}
+		platformRelease, version, _ := strings.Cut(strings.ToLower(spec), "@")
+		platform, release, hasRelease := strings.Cut(platformRelease, "/")
+		target.Platform = platform
+		if hasRelease {
+			target.Release = release
+		}
+		target.Version = version
+
+		if target.Version == "" || target.Version == "latest" {
+			if catalog == nil {
+				var err error
+				if catalog, err = loadCatalog(catalogOpts); err != nil {
+					return nil, errors.New("Erreur, lors de la récupération du catalogue des jeux\n[ERREUR]: " + err.Error())
+				}
+				if !catalog.IsGameAvalaible(game) {
+					return nil, errors.New("Le jeu " + game + " n'existe pas dans le catalogue")
+				}
+			}
+			var err error
+			if target.Version, err = catalog.LastVersionOfGame(game, target.Platform, target.Release); err != nil {
+				return nil, errors.New("Impossible de trouver la version de " + spec + "\n[ERREUR]: " + err.Error())
+			}
+		}
+		target.Name = target.Platform + "/" + target.Release + "@" + target.Version
+		if seen[target.Name] {
+			return nil, errors.New("Erreur, la version " + target.Name + " est indiquée plusieurs fois")
+		}
+		seen[target.Name] = true
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// compareEntries classe chaque fichier selon sa présence et son hash dans les versions comparées
+func compareEntries(game string, targets []compareTarget, entriesByTarget [][]cytrus.Entry) compareReport {
+	report := compareReport{Game: game, Targets: targets, Shared: []compareFile{}, Partial: []compareFile{}, Only: map[string][]compareFile{}, Different: []compareFile{}}
+
+	// hash et taille de chaque fichier dans chaque version, indexés par chemin
+	type presence struct {
+		target int
+		entry  cytrus.Entry
+	}
+	byPath := map[string][]presence{}
+	for i, entries := range entriesByTarget {
+		for _, entry := range entries {
+			byPath[entry.Path()] = append(byPath[entry.Path()], presence{target: i, entry: entry})
+			report.Targets[i].Files++
+			report.Targets[i].Size += entry.Size
+		}
+	}
+
+	for _, filePath := range sortedKeys(byPath) {
+		presences := byPath[filePath]
+		first := presences[0]
+		sameHash := true
+		for _, other := range presences[1:] {
+			if other.entry.Hash != first.entry.Hash {
+				sameHash = false
+			}
+		}
+
+		switch {
+		case len(presences) == 1:
+			name := targets[first.target].Name
+			report.Only[name] = append(report.Only[name], compareFile{Path: filePath, Size: first.entry.Size, Hash: first.entry.Hash})
+		case !sameHash:
+			file := compareFile{Path: filePath, Size: first.entry.Size, Hashes: map[string]string{}}
+			for _, other := range presences {
+				file.Hashes[targets[other.target].Name] = other.entry.Hash
+			}
+			report.Different = append(report.Different, file)
+		case len(presences) == len(targets):
+			report.Shared = append(report.Shared, compareFile{Path: filePath, Size: first.entry.Size, Hash: first.entry.Hash})
+		default:
+			file := compareFile{Path: filePath, Size: first.entry.Size, Hash: first.entry.Hash}
+			for _, other := range presences {
+				file.Targets = append(file.Targets, targets[other.target].Name)
+			}
+			report.Partial = append(report.Partial, file)
+		}
+	}
+	return report
+}
+
+func filesSize(files []compareFile) int64 {
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	return size
+}
+
+func printCompareTable(output io.Writer, report compareReport, listShared bool) {
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tFICHIERS\tTAILLE\tUNIQUES")
+	for _, target := range report.Targets {
+		only := report.Only[target.Name]
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%d (%s)\n", target.Name, target.Files, formatSize(target.Size), len(only), formatSize(filesSize(only)))
+	}
+	writer.Flush()
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "Fichiers communs à toutes les versions:", len(report.Shared), "("+formatSize(filesSize(report.Shared))+")")
+	if len(report.Targets) > 2 {
+		fmt.Fprintln(output, "Fichiers communs à une partie des versions:", len(report.Partial), "("+formatSize(filesSize(report.Partial))+")")
+	}
+	fmt.Fprintln(output, "Fichiers différents:", len(report.Different))
+
+	for _, target := range report.Targets {
+		if len(report.Only[target.Name]) == 0 {
+			continue
+		}
+		fmt.Fprintln(output, "\nUniquement dans", target.Name+":")
+		for _, file := range report.Only[target.Name] {
+			fmt.Fprintf(output, "  %s (%s)\n", file.Path, formatSize(file.Size))
+		}
+	}
+	if len(report.Partial) > 0 {
+		fmt.Fprintln(output, "\nCommuns à une partie des versions:")
+		for _, file := range report.Partial {
+			fmt.Fprintf(output, "  %s (%s) %s\n", file.Path, formatSize(file.Size), strings.Join(file.Targets, ", "))
+		}
+	}
+	if len(report.Different) > 0 {
+		fmt.Fprintln(output, "\nDifférents:")
+		writer = tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+		for _, file := range report.Different {
+			for _, target := range report.Targets {
+				if hash, exists := file.Hashes[target.Name]; exists {
+					fmt.Fprintf(writer, "  %s\t%s\t%s\n", file.Path, target.Name, hash)
+				}
+			}
+		}
+		writer.Flush()
+	}
+	if listShared && len(report.Shared) > 0 {
+		fmt.Fprintln(output, "\nCommuns à toutes les versions:")
+		for _, file := range report.Shared {
+			fmt.Fprintf(output, "  %s (%s)\n", file.Path, formatSize(file.Size))
+		}
+	}
+}
+
+var compareHTML = template.Must(template.New("compare").Funcs(template.FuncMap{
+	"size":      formatSize,
+	"filesSize": filesSize,
+}).Parse(`<!DOCTYPE html>
+<html lang="fr">
+<head>
+<meta charset="utf-8">
+<title>Comparaison de {{.Game}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+td.hash { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>Comparaison de {{.Game}}</h1>
+<table>
+<tr><th>Version</th><th>Fichiers</th><th>Taille</th><th>Uniques</th></tr>
+{{- range .Targets}}
+<tr><td>{{.Name}}</td><td>{{.Files}}</td><td>{{size .Size}}</td><td>{{len (index $.Only .Name)}}</td></tr>
+{{- end}}
+</table>
+<h2>Fichiers différents ({{len .Different}})</h2>
+<table>
+<tr><th>Fichier</th>{{range .Targets}}<th>{{.Name}}</th>{{end}}</tr>
+{{- range $file := .Different}}
+<tr><td>{{$file.Path}}</td>{{range $.Targets}}<td class="hash">{{index $file.Hashes .Name}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- range $target := .Targets}}
+{{- with index $.Only $target.Name}}
+<details open>
+<summary>Uniquement dans {{$target.Name}} ({{len .}} fichiers, {{size (filesSize .)}})</summary>
+<table>
+{{- range .}}
+<tr><td>{{.Path}}</td><td>{{size .Size}}</td></tr>
+{{- end}}
+</table>
+</details>
+{{- end}}
+{{- end}}
+{{- if .Partial}}
+<details>
+<summary>Communs à une partie des versions ({{len .Partial}} fichiers, {{size (filesSize .Partial)}})</summary>
+<table>
+{{- range .Partial}}
+<tr><td>{{.Path}}</td><td>{{size .Size}}</td><td>{{range $i, $name := .Targets}}{{if $i}}, {{end}}{{$name}}{{end}}</td></tr>
+{{- end}}
+</table>
+</details>
+{{- end}}
+<details>
+<summary>Communs à toutes les versions ({{len .Shared}} fichiers, {{size (filesSize .Shared)}})</summary>
+<table>
+{{- range .Shared}}
+<tr><td>{{.Path}}</td><td>{{size .Size}}</td></tr>
+{{- end}}
+</table>
+</details>
+</body>
+</html>
+`))
@@ -0,0 +1,70 @@
+package cytrus
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Entry décrit un fichier d'une version tel qu'il apparait dans le manifest et l'emplacement de ses données sur le cdn
+type Entry struct {
+	Fragment   string `json:"fragment"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Hash       string `json:"hash"`
+	Executable bool   `json:"executable,omitempty"`
+	Symlink    string `json:"symlink,omitempty"`
+	// cytrus 6: parties du fichier et leur emplacement dans les bundles
+	Chunks []EntryChunk `json:"chunks,omitempty"`
+	// cytrus 5: pack qui contient le fichier, vide si le fichier est distribué seul
+	Pack string `json:"pack,omitempty"`
+	// cytrus 5: chemin sur le cdn du pack ou du fichier
+	Object string `json:"object,omitempty"`
+}
+
+// EntryChunk est une partie d'un fichier, stockée dans un bundle
+type EntryChunk struct {
+	Hash         string `json:"hash"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+	Bundle       string `json:"bundle"`
+	BundlePath   string `json:"bundlePath"`
+	BundleOffset int64  `json:"bundleOffset"`
+}
+
+// Path renvoie le chemin du fichier depuis la racine de la version: <fragment>/<fichier>
+func (e Entry) Path() string {
+	return e.Fragment + "/" + e.Name
+}
+
+// Containers renvoie les bundles ou le pack qui contiennent les données du fichier
+func (e Entry) Containers() []string {
+	if e.Pack != "" {
+		return []string{e.Pack}
+	}
+	containers := []string{}
+	seen := map[string]bool{}
+	for _, chunk := range e.Chunks {
+		if !seen[chunk.Bundle] {
+			seen[chunk.Bundle] = true
+			containers = append(containers, chunk.Bundle)
+		}
+	}
+	return containers
+}
+
+// SortEntries trie les fichiers par chemin
+func SortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path() < entries[j].Path() })
+}
+
+// FindEntry cherche un fichier à partir de son chemin <fragment>/<fichier>
+func FindEntry(entries []Entry, name string) (Entry, bool) {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	for _, entry := range entries {
+		if entry.Path() == name {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
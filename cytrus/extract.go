@@ -0,0 +1,114 @@
+package cytrus
+
+import (
+	"archive/tar"
+	"cytrusdownloader/store"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// errEntryFound interrompt le téléchargement d'un pack une fois le fichier recherché lu
+var errEntryFound = errors.New("Le fichier a été trouvé dans le pack")
+
+// WriteEntry écris le contenu d'un seul fichier de la version dans w
+// seules les parties des bundles qui contiennent ses chunks sont téléchargées, ou l'objet cytrus 5 qui le contient
+// le hash du fichier est vérifié une fois tout le contenu écrit
+func WriteEntry(source Source, entry Entry, w io.Writer) error {
+	if entry.Symlink != "" {
+		return errors.New("Erreur, le fichier " + entry.Path() + " est un lien symbolique vers " + entry.Symlink)
+	}
+	hasher := store.NewHasher(entry.Hash)
+	destination := io.MultiWriter(w, hasher)
+
+	var err error
+	switch {
+	case entry.Size == 0:
+	case entry.Pack != "":
+		err = writePackEntry(source, entry, destination)
+	case len(entry.Chunks) == 0:
+		err = source.Fetch(entry.Object, destination)
+	default:
+		err = writeEntryChunks(source, entry, destination)
+	}
+	if err != nil {
+		return errors.New("Erreur lors de la lecture du fichier " + entry.Path() + "\n[ERREUR]:" + err.Error())
+	}
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != entry.Hash {
+		return errors.New("Erreur, le contenu du fichier " + entry.Path() + " ne correspond pas à son hash " + entry.Hash + " (" + hash + ")")
+	}
+	return nil
+}
+
+// writeEntryChunks télécharge les chunks dans l'ordre du fichier, les chunks qui se suivent dans un bundle sont lus en une seule requête
+// les chunks sont triés par position dans le fichier, ils doivent le couvrir entièrement sans trou ni chevauchement
+func writeEntryChunks(source Source, entry Entry, w io.Writer) error {
+	chunks := slices.Clone(entry.Chunks)
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Offset < chunks[j].Offset })
+	position := int64(0)
+	for _, chunk := range chunks {
+		if chunk.Offset != position {
+			return errors.New("Le chunk " + chunk.Hash + " commence à l'octet " + strconv.FormatInt(chunk.Offset, 10) + " du fichier au lieu de " + strconv.FormatInt(position, 10))
+		}
+		position += chunk.Size
+	}
+	if position != entry.Size {
+		return errors.New("Les chunks couvrent " + strconv.FormatInt(position, 10) + " octets du fichier au lieu de " + strconv.FormatInt(entry.Size, 10))
+	}
+
+	for i := 0; i < len(chunks); {
+		chunk := chunks[i]
+		if chunk.BundlePath == "" {
+			return errors.New("Le chunk " + chunk.Hash + " ne fait partie d'aucun bundle")
+		}
+		size := chunk.Size
+		i++
+		for i < len(chunks) && chunks[i].BundlePath == chunk.BundlePath && chunks[i].BundleOffset == chunk.BundleOffset+size {
+			size += chunks[i].Size
+			i++
+		}
+		if err := source.FetchRange(chunk.BundlePath, chunk.BundleOffset, size, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePackEntry lit le pack au fil de son téléchargement et s'arrête dès que le fichier a été extrait
+func writePackEntry(source Source, entry Entry, w io.Writer) error {
+	packReader, packWriter := io.Pipe()
+	fetchDone := make(chan error, 1)
+	go func() {
+		err := source.Fetch(entry.Object, packWriter)
+		packWriter.CloseWithError(err)
+		fetchDone <- err
+	}()
+
+	tarReader := tar.NewReader(packReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			packReader.CloseWithError(err)
+			if errFetch := <-fetchDone; errFetch != nil {
+				return errFetch
+			}
+			return errors.New("Erreur lors de la lecture du pack " + entry.Pack + "\n[ERREUR]:" + err.Error())
+		}
+		if header.Typeflag != tar.TypeReg || header.Name != entry.Hash {
+			continue
+		}
+		_, err = io.Copy(w, tarReader)
+		packReader.CloseWithError(errEntryFound)
+		<-fetchDone
+		return err
+	}
+	if errFetch := <-fetchDone; errFetch != nil {
+		return errFetch
+	}
+	return errors.New("Le fichier " + entry.Hash + " est absent du pack " + entry.Pack)
+}
@@ -0,0 +1,87 @@
+package cytrus
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// memorySource sert des fichiers gardés en mémoire et compte les lectures partielles
+type memorySource struct {
+	files  map[string][]byte
+	ranges int
+}
+
+func (s *memorySource) Fetch(path string, destination io.Writer) error {
+	content, found := s.files[path]
+	if !found {
+		return errors.New("fichier " + path + " absent")
+	}
+	_, err := destination.Write(content)
+	return err
+}
+
+func (s *memorySource) FetchRange(path string, offset int64, size int64, destination io.Writer) error {
+	content, found := s.files[path]
+	if !found || offset+size > int64(len(content)) {
+		return errors.New("plage de " + path + " absente")
+	}
+	s.ranges++
+	_, err := destination.Write(content[offset : offset+size])
+	return err
+}
+
+func (s *memorySource) URL(path string) string {
+	return path
+}
+
+// chunkedEntry découpe le contenu en trois chunks rangés dans l'ordre dans un seul bundle
+func chunkedEntry(content string) (Entry, *memorySource) {
+	hash := sha1.Sum([]byte(content))
+	entry := Entry{Fragment: "main", Name: "data.bin", Size: int64(len(content)), Hash: hex.EncodeToString(hash[:])}
+	for _, part := range [][2]int64{{0, 4}, {4, 3}, {7, int64(len(content)) - 7}} {
+		entry.Chunks = append(entry.Chunks, EntryChunk{Hash: content[part[0] : part[0]+part[1]], Offset: part[0], Size: part[1], Bundle: "bundle", BundlePath: "bundles/bundle", BundleOffset: part[0]})
+	}
+	return entry, &memorySource{files: map[string][]byte{"bundles/bundle": []byte(content)}}
+}
+
+func TestWriteEntryOrdersChunksByOffset(t *testing.T) {
+	entry, source := chunkedEntry("chunks dans le désordre")
+	entry.Chunks[0], entry.Chunks[1], entry.Chunks[2] = entry.Chunks[2], entry.Chunks[0], entry.Chunks[1]
+
+	var output bytes.Buffer
+	if err := WriteEntry(source, entry, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "chunks dans le désordre" {
+		t.Errorf("contenu: %q", output.String())
+	}
+	// une fois triés, les chunks se suivent dans le bundle et sont lus en une seule requête
+	if source.ranges != 1 {
+		t.Errorf("%d lectures du bundle, 1 attendue", source.ranges)
+	}
+}
+
+func TestWriteEntryRejectsChunkGaps(t *testing.T) {
+	for name, change := range map[string]func(entry *Entry){
+		"trou":          func(entry *Entry) { entry.Chunks = append(entry.Chunks[:1], entry.Chunks[2:]...) },
+		"chevauchement": func(entry *Entry) { entry.Chunks[1].Offset = 2 },
+		"doublon":       func(entry *Entry) { entry.Chunks = append(entry.Chunks, entry.Chunks[2]) },
+		"fin manquante": func(entry *Entry) { entry.Chunks = entry.Chunks[:2] },
+	} {
+		entry, source := chunkedEntry("chunks incomplets")
+		change(&entry)
+		var output bytes.Buffer
+		err := WriteEntry(source, entry, &output)
+		if err == nil || !strings.Contains(err.Error(), "octet") {
+			t.Errorf("%s: erreur %v", name, err)
+		}
+		if source.ranges != 0 {
+			t.Errorf("%s: le bundle a été lu avant la vérification des chunks", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package cytrus
+
+import (
+	"cytrusdownloader/dedupe"
+	"cytrusdownloader/seed"
+	"cytrusdownloader/sink"
+	"cytrusdownloader/store"
+	"fmt"
+	"strings"
+)
+
+const (
+	// une seule version par dossier: <outdir><jeu>/<version>/<plateforme>
+	LayoutFlat = "flat"
+	// toutes les versions dans <outdir><jeu>/<plateforme>/versions/<version>, la version utilisée est désignée par le lien current
+	LayoutVersioned = "versioned"
+)
+
+// Options regroupe les paramètres d'un téléchargement, communs à cytrus 5 et cytrus 6
+type Options struct {
+	ManifestFile string
+	Game         string
+	Release      string
+	Platform     string
+	Version      string
+	OutputDir    string
+	// dépôt local des chunks et objets, nil s'il n'est pas utilisé
+	Store *store.Store
+	// copies partagées des fichiers identiques entre les installations, nil si la déduplication est désactivée
+	Pool *dedupe.Pool
+	// contenu d'autres installations réutilisé à la place du cdn, nil s'il n'y en a pas
+	Seed *seed.Index
+	// origine des fichiers du cdn, le cdn d'ankama est utilisé si elle n'est pas précisée
+	Source Source
+	// adresse d'un autre cdn, url http ou dossier local, utilisée si Source n'est pas précisée
+	CDNURL string
+	// fragments à télécharger, tous les fragments si la liste est vide
+	Fragments []string
+	// vérifie le hash de chaque chunk et de chaque fichier extrait
+	Verify bool
+	// appelée avec chaque manifest téléchargé depuis le cdn, nil si aucun traitement n'est nécessaire
+	OnManifest func(options Options, manifestData []byte)
+	// sortie des fichiers extraits, le dossier de la version si elle n'est pas précisée
+	Sink sink.Sink
+	// supprime les fichiers qui ne font plus partie du manifest, nil pour les conserver
+	Prune *PruneOptions
+	// organisation des dossiers d'installation [flat|versioned], flat si elle n'est pas précisée
+	Layout string
+}
+
+// VersionNumber renvoie la version sans le préfixe de la version de cytrus (6.0_, 5.0_)
+func (o Options) VersionNumber() string {
+	if version, err := ParseVersion(o.Version); err == nil {
+		return version.Number
+	}
+	if _, number, found := strings.Cut(o.Version, "_"); found {
+		return number
+	}
+	return o.Version
+}
+
+// VersionDirName renvoie le nom du dossier de la version dans une installation versionnée, avec le préfixe de sa génération:
+// les versions de même numéro publiées par cytrus 5 et cytrus 6 ne partagent pas le même dossier
+func (o Options) VersionDirName() string {
+	if version, err := ParseVersion(o.Version); err == nil {
+		return version.String()
+	}
+	return o.Version
+}
+
+// ContentDestination renvoie le dossier d'extraction de la version: <outdir><jeu>/<version>/<plateforme>
+// ou <outdir><jeu>/<plateforme>/versions/<génération>.0_<version> pour une installation versionnée
+func (o Options) ContentDestination() string {
+	if o.Layout == LayoutVersioned {
+		return fmt.Sprintf("%s/versions/%s", o.InstallRoot(), o.VersionDirName())
+	}
+	return fmt.Sprintf("%s%s/%s/%s", o.OutputDir, o.Game, o.VersionNumber(), o.Platform)
+}
+
+// InstallRoot renvoie le dossier d'une installation versionnée: <outdir><jeu>/<plateforme>
+func (o Options) InstallRoot() string {
+	return fmt.Sprintf("%s%s/%s", o.OutputDir, o.Game, o.Platform)
+}
+
+// Output renvoie la sortie des fichiers extraits
+func (o Options) Output() sink.Sink {
+	if o.Sink != nil {
+		return o.Sink
+	}
+	return sink.NewDir(o.ContentDestination())
+}
+
+// IsFragmentSelected indique si le fragment fait partie des fragments demandés
+func (o Options) IsFragmentSelected(fragmentName string) bool {
+	if len(o.Fragments) == 0 {
+		return true
+	}
+	for _, selected := range o.Fragments {
+		if selected == fragmentName {
+			return true
+		}
+	}
+	return false
+}
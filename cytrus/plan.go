@@ -0,0 +1,379 @@
+package cytrus
+
+import (
+	"crypto/sha1"
+	"cytrusdownloader/store"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+
+	SourceCDN   = "cdn"
+	SourceStore = "store"
+	SourceSeed  = "seed"
+	SourceMixed = "mixed"
+)
+
+// Plan décrit toutes les opérations d'un téléchargement, calculées avant toute écriture
+// il peut être enregistré en json puis exécuté tel quel, seuls les objets qu'il liste sont téléchargés
+type Plan struct {
+	Game         string   `json:"game"`
+	Release      string   `json:"release"`
+	Platform     string   `json:"platform"`
+	Version      string   `json:"version"`
+	ManifestFile string   `json:"manifestFile,omitempty"`
+	Fragments    []string `json:"fragments,omitempty"`
+	OutputDir    string   `json:"outputDir"`
+	Layout       string   `json:"layout,omitempty"`
+	// hash du manifest utilisé pour le plan, il ne doit pas avoir changé lors de l'exécution
+	ManifestHash string `json:"manifestHash"`
+	// dépôt local, dossiers d'amorçage et déduplication à utiliser lors de l'exécution
+	StoreDir string   `json:"storeDir,omitempty"`
+	SeedDirs []string `json:"seedDirs,omitempty"`
+	Link     string   `json:"link,omitempty"`
+	CDNURL   string   `json:"cdnUrl,omitempty"`
+
+	Fetches   []Fetch       `json:"fetches"`
+	Files     []PlannedFile `json:"files"`
+	Unchanged int           `json:"unchanged"`
+	// fichiers qui ne font plus partie du manifest, seulement avec l'option prune
+	Deleted []string `json:"deleted"`
+	// dossiers vides une fois les fichiers supprimés, y compris ceux des fragments retirés du manifest
+	DeletedDirs []string `json:"deletedDirs,omitempty"`
+	Quarantine  string   `json:"quarantine,omitempty"`
+	// octets téléchargés depuis le cdn
+	DownloadSize int64 `json:"downloadSize"`
+	// espace disque nécessaire: fichiers écrits et plus gros fichier temporaire
+	DiskSize  int64     `json:"diskSize"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Fetch est un objet du cdn (bundle, pack ou fichier) à télécharger, en entier ou seulement certaines parties
+type Fetch struct {
+	Path   string  `json:"path"`
+	Hash   string  `json:"hash"`
+	Size   int64   `json:"size"`
+	Ranges []Range `json:"ranges,omitempty"`
+}
+
+type Range struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// PlannedFile est un fichier écrit par le plan, son nom est relatif à la racine de la version: <fragment>/<fichier>
+type PlannedFile struct {
+	Name   string `json:"name"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	Source string `json:"source,omitempty"`
+}
+
+// NewPlan crée un plan vide pour les options et le manifest indiqués
+func NewPlan(options Options, manifestData []byte) Plan {
+	return Plan{
+		Game:         options.Game,
+		Release:      options.Release,
+		Platform:     options.Platform,
+		Version:      options.Version,
+		ManifestFile: options.ManifestFile,
+		Fragments:    options.Fragments,
+		OutputDir:    options.OutputDir,
+		Layout:       options.Layout,
+		CDNURL:       options.CDNURL,
+		ManifestHash: ManifestHash(manifestData),
+		Fetches:      []Fetch{},
+		Files:        []PlannedFile{},
+		Deleted:      []string{},
+		CreatedAt:    time.Now(),
+	}
+}
+
+// ManifestHash renvoie le hash sha1 du contenu d'un manifest
+func ManifestHash(manifestData []byte) string {
+	hash := sha1.Sum(manifestData)
+	return hex.EncodeToString(hash[:])
+}
+
+// CheckManifest vérifie que le manifest n'a pas changé depuis le calcul du plan
+func (p Plan) CheckManifest(manifestData []byte) error {
+	if ManifestHash(manifestData) != p.ManifestHash {
+		return errors.New("Erreur, le manifest de la version a changé depuis le calcul du plan, veuillez calculer un nouveau plan")
+	}
+	return nil
+}
+
+// Validate vérifie qu'un plan lu depuis un fichier ne désigne que des fichiers de la version et des objets du cdn:
+// les fichiers écrits et supprimés restent dans le dossier de la version, à l'intérieur de OutputDir
+// OutputDir, Quarantine, StoreDir et SeedDirs ne sont pas vérifiés, ils sont utilisés tels quels comme les options de la ligne de commande
+func (p Plan) Validate() error {
+	for _, value := range []string{p.Game, p.Release, p.Platform, p.Version} {
+		if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+			return errors.New("Erreur, le plan est invalide: " + strconv.Quote(value) + " n'est pas un nom de jeu, de release, de plateforme ou de version")
+		}
+	}
+	for _, fetch := range p.Fetches {
+		if !isLocalPath(fetch.Path) {
+			return errors.New("Erreur, le plan est invalide: le chemin " + fetch.Path + " ne fait pas partie du cdn")
+		}
+	}
+	for _, file := range p.Files {
+		if !isLocalPath(file.Name) {
+			return errors.New("Erreur, le plan est invalide: le fichier " + file.Name + " est en dehors du dossier de la version")
+		}
+	}
+	for _, name := range p.Deleted {
+		if !isLocalPath(name) {
+			return errors.New("Erreur, le plan est invalide: le fichier supprimé " + name + " est en dehors du dossier de la version")
+		}
+	}
+	for _, dir := range p.DeletedDirs {
+		if !isLocalPath(dir) || path.Clean(dir) == "." {
+			return errors.New("Erreur, le plan est invalide: le dossier supprimé " + dir + " est en dehors du dossier de la version")
+		}
+	}
+	return nil
+}
+
+// isLocalPath indique qu'un chemin relatif reste dans son dossier racine
+func isLocalPath(name string) bool {
+	cleaned := path.Clean(name)
+	return name != "" && !path.IsAbs(cleaned) && cleaned != ".." && !strings.HasPrefix(cleaned, "../") && !strings.Contains(name, "\\") && !filepath.IsAbs(filepath.FromSlash(name))
+}
+
+// Matches vérifie que le plan recalculé avec l'état actuel fait les mêmes opérations que le plan enregistré
+// les dossiers d'amorçage, le dépôt local et les fichiers installés ne doivent pas avoir changé depuis le calcul du plan
+func (p Plan) Matches(current Plan) error {
+	if current.ManifestHash != p.ManifestHash {
+		return errors.New("Erreur, le manifest de la version a changé depuis le calcul du plan, veuillez calculer un nouveau plan")
+	}
+	recordedFiles := make(map[string]PlannedFile, len(p.Files))
+	for _, file := range p.Files {
+		recordedFiles[file.Name] = file
+	}
+	for _, file := range current.Files {
+		recorded, exists := recordedFiles[file.Name]
+		if !exists {
+			return errors.New("Erreur, le fichier " + file.Name + " n'est plus à jour depuis le calcul du plan, veuillez calculer un nouveau plan")
+		}
+		if recorded.Source != file.Source {
+			return errors.New("Erreur, le fichier " + file.Name + " ne peut plus être écrit depuis " + recorded.Source + " comme prévu par le plan (" + file.Source + " actuellement), veuillez calculer un nouveau plan")
+		}
+		if recorded != file {
+			return errors.New("Erreur, le fichier local " + file.Name + " a changé depuis le calcul du plan, veuillez calculer un nouveau plan")
+		}
+		delete(recordedFiles, file.Name)
+	}
+	for name := range recordedFiles {
+		return errors.New("Erreur, le fichier " + name + " est déjà à jour depuis le calcul du plan, veuillez calculer un nouveau plan")
+	}
+
+	recordedFetches := make(map[string]Fetch, len(p.Fetches))
+	for _, fetch := range p.Fetches {
+		recordedFetches[fetch.Path] = fetch
+	}
+	for _, fetch := range current.Fetches {
+		recorded, exists := recordedFetches[fetch.Path]
+		if !exists || !sameRanges(recorded.Ranges, fetch.Ranges) {
+			return errors.New("Erreur, les données de " + fetch.Path + " à télécharger ont changé depuis le calcul du plan, veuillez calculer un nouveau plan")
+		}
+		delete(recordedFetches, fetch.Path)
+	}
+	for fetchPath := range recordedFetches {
+		return errors.New("Erreur, " + fetchPath + " n'est plus à télécharger depuis le calcul du plan, veuillez calculer un nouveau plan")
+	}
+	return nil
+}
+
+func sameRanges(a []Range, b []Range) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AddFetch ajoute un objet à télécharger, les parties qui se suivent sont regroupées
+// et l'objet est téléchargé en entier si elles le couvrent complètement
+func (p *Plan) AddFetch(path string, hash string, objectSize int64, ranges []Range) {
+	ranges = mergeRanges(ranges)
+	fetch := Fetch{Path: path, Hash: hash, Size: objectSize}
+	if len(ranges) > 1 || (len(ranges) == 1 && (ranges[0].Offset != 0 || ranges[0].Size != objectSize)) {
+		fetch.Ranges = ranges
+		fetch.Size = 0
+		for _, r := range ranges {
+			fetch.Size += r.Size
+		}
+	}
+	p.Fetches = append(p.Fetches, fetch)
+	p.DownloadSize += fetch.Size
+}
+
+// Finish calcule l'espace disque nécessaire une fois tous les fichiers et objets ajoutés
+func (p *Plan) Finish() {
+	sort.Slice(p.Files, func(i, j int) bool { return p.Files[i].Name < p.Files[j].Name })
+	sort.Slice(p.Fetches, func(i, j int) bool { return p.Fetches[i].Path < p.Fetches[j].Path })
+	sort.Strings(p.Deleted)
+	p.DiskSize = 0
+	largestFetch := int64(0)
+	for _, file := range p.Files {
+		p.DiskSize += file.Size
+	}
+	for _, fetch := range p.Fetches {
+		if fetch.Size > largestFetch {
+			largestFetch = fetch.Size
+		}
+	}
+	p.DiskSize += largestFetch
+}
+
+// FileNames renvoie les noms des fichiers écrits par le plan
+func (p Plan) FileNames() map[string]bool {
+	names := make(map[string]bool, len(p.Files))
+	for _, file := range p.Files {
+		names[file.Name] = true
+	}
+	return names
+}
+
+// FetchOf renvoie l'objet à télécharger pour un chemin du cdn, s'il fait partie du plan
+func (p Plan) FetchOf(path string) (Fetch, bool) {
+	for _, fetch := range p.Fetches {
+		if fetch.Path == path {
+			return fetch, true
+		}
+	}
+	return Fetch{}, false
+}
+
+// Covers indique si la partie de l'objet fait partie des données téléchargées
+func (f Fetch) Covers(offset int64, size int64) bool {
+	if len(f.Ranges) == 0 {
+		return true
+	}
+	for _, r := range f.Ranges {
+		if offset >= r.Offset && offset+size <= r.Offset+r.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// Download télécharge l'objet dans un fichier temporaire, les parties sont écrites à leur position dans l'objet
+func (f Fetch) Download(source Source) (string, error) {
+	tmpFile, err := os.CreateTemp("", "cytrus-fetch-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	if len(f.Ranges) == 0 {
+		err = source.Fetch(f.Path, tmpFile)
+	}
+	for _, r := range f.Ranges {
+		if err = source.FetchRange(f.Path, r.Offset, r.Size, io.NewOffsetWriter(tmpFile, r.Offset)); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// CompareLocal compare les fichiers du manifest avec le dossier de destination et renvoie les fichiers à écrire
+// si prune est indiqué, les fichiers des fragments qui ne font plus partie du manifest sont ajoutés aux fichiers supprimés
+// si destination est vide, tous les fichiers sont à créer
+func (p *Plan) CompareLocal(destination string, listing Listing, prune *PruneOptions) ([]PlannedFile, error) {
+	toWrite := []PlannedFile{}
+	for _, file := range listing.Files {
+		if destination == "" {
+			file.Action = ActionCreate
+			toWrite = append(toWrite, file)
+			continue
+		}
+		filePath := filepath.Join(destination, filepath.FromSlash(file.Name))
+		info, err := os.Stat(filePath)
+		if err != nil {
+			file.Action = ActionCreate
+			toWrite = append(toWrite, file)
+			continue
+		}
+		if info.Size() == file.Size {
+			hash, err := store.HashFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			if hash == file.Hash {
+				p.Unchanged++
+				continue
+			}
+		}
+		file.Action = ActionUpdate
+		toWrite = append(toWrite, file)
+	}
+
+	if destination != "" && prune != nil {
+		orphans, err := Orphans(destination, listing, *prune)
+		if err != nil {
+			return nil, err
+		}
+		p.Deleted = orphans
+		p.DeletedDirs = EmptyDirs(destination, listing, orphans, *prune)
+		p.Quarantine = prune.Quarantine
+	}
+	return toWrite, nil
+}
+
+// ApplyDeletions supprime, ou déplace en quarantaine, les fichiers du plan qui ne font plus partie de la version
+func (p Plan) ApplyDeletions(destination string) error {
+	return Prune(destination, p.Deleted, p.DeletedDirs, p.Quarantine)
+}
+
+// SourceOf résume l'origine des parties d'un fichier
+func SourceOf(sources map[string]bool) string {
+	if len(sources) != 1 {
+		return SourceMixed
+	}
+	for source := range sources {
+		return source
+	}
+	return SourceMixed
+}
+
+func mergeRanges(ranges []Range) []Range {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sorted := append([]Range{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	merged := []Range{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.Offset <= last.Offset+last.Size {
+			if end := r.Offset + r.Size; end > last.Offset+last.Size {
+				last.Size = end - last.Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
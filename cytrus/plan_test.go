@@ -0,0 +1,60 @@
+package cytrus
+
+import "testing"
+
+func validTestPlan() Plan {
+	return Plan{
+		Game:     "dofus",
+		Release:  "main",
+		Platform: "windows",
+		Version:  "6.0_3.0.1",
+		Fetches:  []Fetch{{Path: "dofus/bundles/ab/abcd", Hash: "abcd", Size: 10, Ranges: []Range{{Offset: 0, Size: 4}}}},
+		Files:    []PlannedFile{{Name: "main/data/a.bin", Hash: "01", Size: 4, Action: ActionCreate, Source: SourceCDN}},
+		Deleted:  []string{"main/old.bin"},
+	}
+}
+
+func TestPlanValidateRejectsPathsOutsideTheVersion(t *testing.T) {
+	if err := validTestPlan().Validate(); err != nil {
+		t.Fatalf("plan valide refusé: %v", err)
+	}
+	invalid := map[string]func(p *Plan){
+		"fichier supprimé parent":   func(p *Plan) { p.Deleted = []string{"../../x"} },
+		"fichier supprimé imbriqué": func(p *Plan) { p.Deleted = []string{"main/../../x"} },
+		"fichier supprimé absolu":   func(p *Plan) { p.Deleted = []string{"/etc/passwd"} },
+		"fichier écrit parent":      func(p *Plan) { p.Files[0].Name = "../x" },
+		"fichier windows":           func(p *Plan) { p.Files[0].Name = `..\x` },
+		"objet du cdn":              func(p *Plan) { p.Fetches[0].Path = "../../secret" },
+		"version":                   func(p *Plan) { p.Version = ".." },
+		"plateforme":                func(p *Plan) { p.Platform = "windows/../.." },
+		"jeu vide":                  func(p *Plan) { p.Game = "" },
+	}
+	for name, change := range invalid {
+		plan := validTestPlan()
+		change(&plan)
+		if err := plan.Validate(); err == nil {
+			t.Errorf("%s: le plan doit être refusé", name)
+		}
+	}
+}
+
+func TestPlanMatches(t *testing.T) {
+	if err := validTestPlan().Matches(validTestPlan()); err != nil {
+		t.Fatalf("un plan identique doit correspondre: %v", err)
+	}
+	different := map[string]func(p *Plan){
+		"source":   func(p *Plan) { p.Files[0].Source = SourceSeed },
+		"action":   func(p *Plan) { p.Files[0].Action = ActionUpdate },
+		"inchangé": func(p *Plan) { p.Files = nil },
+		"parties":  func(p *Plan) { p.Fetches[0].Ranges = []Range{{Offset: 0, Size: 10}} },
+		"objet":    func(p *Plan) { p.Fetches = nil },
+		"manifest": func(p *Plan) { p.ManifestHash = "autre" },
+	}
+	for name, change := range different {
+		current := validTestPlan()
+		change(&current)
+		if err := validTestPlan().Matches(current); err == nil {
+			t.Errorf("%s: la différence doit être signalée", name)
+		}
+	}
+}
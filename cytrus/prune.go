@@ -0,0 +1,195 @@
+package cytrus
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Listing regroupe les fichiers des fragments sélectionnés d'un manifest
+type Listing struct {
+	// fragments sélectionnés
+	Fragments []string
+	// tous les fragments du manifest, sélectionnés ou non
+	ManifestFragments map[string]bool
+	// fichiers à écrire lors d'une installation
+	Files []PlannedFile
+	// tous les noms du manifest, <fragment>/<fichier>, y compris ceux qui ne sont pas écrits comme les liens symboliques
+	Names map[string]bool
+}
+
+// PruneOptions configure la suppression des fichiers qui ne font plus partie du manifest
+type PruneOptions struct {
+	// dossier dans lequel les fichiers sont déplacés au lieu d'être supprimés, vide pour les supprimer
+	Quarantine string
+	// motifs des fichiers utilisateur à conserver (configurations, logs), comparés au chemin <fragment>/<fichier> et au nom du fichier
+	// un motif terminé par / conserve tout un dossier
+	Keep []string
+}
+
+// Keeps indique si le fichier fait partie des fichiers utilisateur à conserver
+func (p PruneOptions) Keeps(name string) bool {
+	for _, pattern := range p.Keep {
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(name, pattern) || strings.Contains(name, "/"+pattern) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// prunedRoots renvoie les dossiers de la destination à analyser: les fragments sélectionnés
+// et les dossiers qui ne sont pas des fragments du manifest, comme ceux des fragments retirés de la version
+// les fragments du manifest qui ne sont pas sélectionnés ne sont pas modifiés
+func prunedRoots(destination string, listing Listing) ([]string, error) {
+	entries, err := os.ReadDir(destination)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.New("Erreur lors de l'analyse du dossier " + destination + "\n[ERREUR]:" + err.Error())
+	}
+	selected := make(map[string]bool, len(listing.Fragments))
+	for _, fragment := range listing.Fragments {
+		selected[fragment] = true
+	}
+	roots := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if listing.ManifestFragments[entry.Name()] && !selected[entry.Name()] {
+			continue
+		}
+		roots = append(roots, entry.Name())
+	}
+	return roots, nil
+}
+
+// Orphans renvoie les fichiers des dossiers des fragments qui ne font pas partie du manifest
+// tous les fichiers d'un fragment retiré du manifest sont orphelins, sauf ceux conservés par options.Keep
+func Orphans(destination string, listing Listing, options PruneOptions) ([]string, error) {
+	roots, err := prunedRoots(destination, listing)
+	if err != nil {
+		return nil, err
+	}
+	orphans := []string{}
+	for _, root := range roots {
+		rootDir := filepath.Join(destination, root)
+		err := filepath.WalkDir(rootDir, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			relativePath, err := filepath.Rel(destination, filePath)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(relativePath)
+			if !listing.Names[name] && !options.Keeps(name) {
+				orphans = append(orphans, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.New("Erreur lors de l'analyse du dossier " + rootDir + "\n[ERREUR]:" + err.Error())
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// EmptyDirs renvoie les dossiers qui seront vides une fois les fichiers removed supprimés, les plus profonds en premier
+// les dossiers déjà vides sont aussi renvoyés, les dossiers des fragments du manifest et ceux conservés par options.Keep sont conservés
+func EmptyDirs(destination string, listing Listing, removed []string, options PruneOptions) []string {
+	removedNames := make(map[string]bool, len(removed))
+	for _, name := range removed {
+		removedNames[name] = true
+	}
+	roots, _ := prunedRoots(destination, listing)
+	dirs := []string{}
+	for _, root := range roots {
+		filepath.WalkDir(filepath.Join(destination, root), func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+			if relativePath, err := filepath.Rel(destination, filePath); err == nil {
+				dirs = append(dirs, filepath.ToSlash(relativePath))
+			}
+			return nil
+		})
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if depthI, depthJ := strings.Count(dirs[i], "/"), strings.Count(dirs[j], "/"); depthI != depthJ {
+			return depthI > depthJ
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	emptyDirs := []string{}
+	for _, dir := range dirs {
+		if listing.ManifestFragments[dir] || options.Keeps(dir+"/") {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(destination, filepath.FromSlash(dir)))
+		if err != nil {
+			continue
+		}
+		empty := true
+		for _, entry := range entries {
+			if !removedNames[dir+"/"+entry.Name()] {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			// le dossier vide compte comme supprimé pour son dossier parent
+			removedNames[dir] = true
+			emptyDirs = append(emptyDirs, dir)
+		}
+	}
+	return emptyDirs
+}
+
+// Prune supprime les fichiers, ou les déplace dans le dossier de quarantaine, puis supprime les dossiers devenus vides
+func Prune(destination string, names []string, emptyDirs []string, quarantine string) error {
+	errs := []error{}
+	for _, name := range names {
+		filePath := filepath.Join(destination, filepath.FromSlash(name))
+		if quarantine == "" {
+			if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, errors.New("Impossible de supprimer le fichier "+name+"\n[ERREUR]:"+err.Error()))
+			}
+			continue
+		}
+		quarantineFile := filepath.Join(quarantine, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(quarantineFile), os.ModePerm); err != nil {
+			errs = append(errs, errors.New("Erreur lors de la création du répertoire "+filepath.Dir(quarantineFile)))
+			continue
+		}
+		if err := os.Rename(filePath, quarantineFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, errors.New("Impossible de déplacer le fichier "+name+" en quarantaine\n[ERREUR]:"+err.Error()))
+		}
+	}
+	for _, dir := range emptyDirs {
+		os.Remove(filepath.Join(destination, filepath.FromSlash(dir)))
+	}
+	return errors.Join(errs...)
+}
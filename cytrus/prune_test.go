@@ -0,0 +1,92 @@
+package cytrus
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writePruneTree crée les fichiers indiqués dans la destination, un nom terminé par / crée un dossier vide
+func writePruneTree(t *testing.T, destination string, names []string) {
+	t.Helper()
+	for _, name := range names {
+		filePath := filepath.Join(destination, filepath.FromSlash(name))
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pruneTestListing() Listing {
+	// le manifest contient main et config, seul main est sélectionné
+	return Listing{
+		Fragments:         []string{"main"},
+		ManifestFragments: map[string]bool{"main": true, "config": true},
+		Names:             map[string]bool{"main/game.exe": true, "main/data/a.bin": true, "config/settings.ini": true},
+	}
+}
+
+func TestOrphansIncludesDroppedFragments(t *testing.T) {
+	destination := t.TempDir()
+	writePruneTree(t, destination, []string{
+		"main/game.exe", "main/data/a.bin", "main/data/old.bin", "main/logs/today.log",
+		"config/settings.ini", "config/user.ini",
+		"old/asset.bin", "old/sub/b.bin", "old/user.log",
+	})
+	options := PruneOptions{Keep: []string{"*.log"}}
+
+	orphans, err := Orphans(destination, pruneTestListing(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// config n'est pas sélectionné, ses fichiers ne sont pas modifiés
+	expected := []string{"main/data/old.bin", "old/asset.bin", "old/sub/b.bin"}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("orphelins: %v, attendus %v", orphans, expected)
+	}
+}
+
+func TestPruneRemovesEmptyDirs(t *testing.T) {
+	destination := t.TempDir()
+	writePruneTree(t, destination, []string{
+		"main/game.exe", "main/data/a.bin", "main/empty/", "main/logs/",
+		"dropped/sub/a.bin", "dropped/b.bin",
+		"kept/user.log",
+		"config/",
+	})
+	listing := pruneTestListing()
+	options := PruneOptions{Keep: []string{"*.log", "logs/"}}
+
+	orphans, err := Orphans(destination, listing, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyDirs := EmptyDirs(destination, listing, orphans, options)
+	expectedDirs := []string{"dropped/sub", "main/empty", "dropped"}
+	if !reflect.DeepEqual(emptyDirs, expectedDirs) {
+		t.Fatalf("dossiers vides: %v, attendus %v", emptyDirs, expectedDirs)
+	}
+	if err := Prune(destination, orphans, emptyDirs, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dropped", "main/empty"} {
+		if _, err := os.Stat(filepath.Join(destination, name)); !os.IsNotExist(err) {
+			t.Errorf("%s doit être supprimé", name)
+		}
+	}
+	for _, name := range []string{"main/game.exe", "main/logs", "kept/user.log", "config"} {
+		if _, err := os.Stat(filepath.Join(destination, name)); err != nil {
+			t.Errorf("%s doit être conservé: %v", name, err)
+		}
+	}
+}
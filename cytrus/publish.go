@@ -0,0 +1,34 @@
+package cytrus
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PublishedFragments renvoie le dossier de chaque fragment d'un dossier à publier, triés par nom
+// chaque sous-dossier est un fragment, sauf si fragment est indiqué: tout le dossier est alors placé dans ce fragment
+func PublishedFragments(inputDir string, fragment string) ([]string, map[string]string, error) {
+	if fragment != "" {
+		return []string{fragment}, map[string]string{fragment: inputDir}, nil
+	}
+	dirEntries, err := os.ReadDir(inputDir)
+	if err != nil {
+		return nil, nil, errors.New("Impossible de lire le dossier " + inputDir + "\n[ERREUR]:" + err.Error())
+	}
+	names := []string{}
+	fragmentDirs := map[string]string{}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			return nil, nil, errors.New("Erreur, " + dirEntry.Name() + " n'est pas dans un dossier de fragment, placez les fichiers dans des sous-dossiers (main, config...) ou indiquez un fragment unique")
+		}
+		names = append(names, dirEntry.Name())
+		fragmentDirs[dirEntry.Name()] = filepath.Join(inputDir, dirEntry.Name())
+	}
+	if len(names) == 0 {
+		return nil, nil, errors.New("Erreur, le dossier " + inputDir + " est vide")
+	}
+	sort.Strings(names)
+	return names, fragmentDirs, nil
+}
@@ -0,0 +1,128 @@
+package cytrus
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Source fournit les fichiers du cdn (manifests, bundles, hashes) à partir de leur chemin relatif, par exemple dofus/bundles/ab/abcdef
+type Source interface {
+	Fetch(path string, destination io.Writer) error
+	// FetchRange écris size octets du fichier à partir de offset
+	FetchRange(path string, offset int64, size int64, destination io.Writer) error
+	URL(path string) string
+}
+
+// HTTPSource télécharge les fichiers depuis un cdn
+type HTTPSource struct {
+	BaseURL string
+}
+
+func (s HTTPSource) URL(path string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + path
+}
+
+func (s HTTPSource) Fetch(path string, destination io.Writer) error {
+	res, err := http.Get(s.URL(path))
+	if err != nil {
+		return errors.New("Erreur de lien de telechargement d'un fichier, url: " + s.URL(path) + "\n[ERREUR]: " + err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("Erreur lors du téléchargement de " + s.URL(path) + ", erreur: " + strconv.FormatInt(int64(res.StatusCode), 10))
+	}
+
+	if _, err := io.Copy(destination, res.Body); err != nil {
+		return errors.New("Erreur lors de la copie du contenu vers le fichier" + err.Error())
+	}
+	return nil
+}
+
+func (s HTTPSource) FetchRange(path string, offset int64, size int64, destination io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, s.URL(path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+size-1, 10))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.New("Erreur de lien de telechargement d'un fichier, url: " + s.URL(path) + "\n[ERREUR]: " + err.Error())
+	}
+	defer res.Body.Close()
+
+	body := io.Reader(res.Body)
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// le serveur ne supporte pas les requêtes partielles, le début du fichier est ignoré
+		if _, err := io.CopyN(io.Discard, res.Body, offset); err != nil {
+			return errors.New("Erreur lors du téléchargement de " + s.URL(path) + "\n[ERREUR]: " + err.Error())
+		}
+	default:
+		return errors.New("Erreur lors du téléchargement de " + s.URL(path) + ", erreur: " + strconv.FormatInt(int64(res.StatusCode), 10))
+	}
+	if _, err := io.CopyN(destination, body, size); err != nil {
+		return errors.New("Erreur lors de la copie du contenu vers le fichier" + err.Error())
+	}
+	return nil
+}
+
+// DirSource lis les fichiers depuis un dossier ayant la même arborescence que le cdn
+type DirSource struct {
+	Dir string
+}
+
+func (s DirSource) URL(path string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(path))
+}
+
+func (s DirSource) Fetch(path string, destination io.Writer) error {
+	file, err := os.Open(s.URL(path))
+	if err != nil {
+		return errors.New("Le fichier " + path + " n'est pas disponible localement\n[ERREUR]: " + err.Error())
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(destination, file); err != nil {
+		return errors.New("Erreur lors de la copie du contenu vers le fichier" + err.Error())
+	}
+	return nil
+}
+
+func (s DirSource) FetchRange(path string, offset int64, size int64, destination io.Writer) error {
+	file, err := os.Open(s.URL(path))
+	if err != nil {
+		return errors.New("Le fichier " + path + " n'est pas disponible localement\n[ERREUR]: " + err.Error())
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(destination, io.NewSectionReader(file, offset, size)); err != nil {
+		return errors.New("Erreur lors de la copie du contenu vers le fichier" + err.Error())
+	}
+	return nil
+}
+
+// NewSource renvoie la source correspondant à une url http(s) ou à un dossier local ayant l'arborescence du cdn
+func NewSource(location string) Source {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return HTTPSource{BaseURL: location}
+	}
+	return DirSource{Dir: location}
+}
+
+// FetchFile écris un fichier de la source dans destinationFile
+func FetchFile(source Source, path string, destinationFile string) error {
+	// le fichier existant est supprimé plutôt que tronqué, il peut s'agir d'un lien vers une copie partagée
+	os.Remove(destinationFile)
+	file, errOpenFile := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
+	if errOpenFile != nil {
+		return errors.New("Erreur lors de l'ouverture du fichier " + destinationFile + "\n[ERREUR]: " + errOpenFile.Error())
+	}
+	defer file.Close()
+	return source.Fetch(path, file)
+}
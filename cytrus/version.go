@@ -0,0 +1,100 @@
+package cytrus
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Version est une version publiée sur le cdn: <génération>.0_<version du jeu>, par exemple 6.0_3.0.12.5
+type Version struct {
+	// version de cytrus qui a publié la version, 5 ou 6
+	Generation int
+	// version du jeu, sans le préfixe de la génération
+	Number string
+	// parties numériques de la version du jeu, utilisées pour ordonner les versions
+	parts []int
+}
+
+// ParseVersion lis une version avec le préfixe de sa génération
+func ParseVersion(value string) (Version, error) {
+	prefix, number, found := strings.Cut(value, "_")
+	if !found {
+		return Version{}, errors.New("Erreur, la version " + value + " n'a pas de préfixe de génération, par exemple 6.0_" + value + " ou 5.0_" + value)
+	}
+	major, minor, found := strings.Cut(prefix, ".")
+	generation, err := strconv.Atoi(major)
+	if !found || minor != "0" || err != nil || generation <= 0 {
+		return Version{}, errors.New("Erreur, le préfixe " + prefix + " de la version " + value + " est invalide, il doit être de la forme <génération>.0_ comme 6.0_")
+	}
+	version, err := ParseVersionNumber(number)
+	if err != nil {
+		return Version{}, errors.New("Erreur, la version " + value + " est invalide\n[ERREUR]:" + err.Error())
+	}
+	version.Generation = generation
+	return version, nil
+}
+
+// ParseVersionNumber lis la version du jeu sans préfixe, elle est composée de nombres séparés par des points
+func ParseVersionNumber(number string) (Version, error) {
+	if number == "" {
+		return Version{}, errors.New("Erreur, la version du jeu est vide")
+	}
+	version := Version{Number: number}
+	for _, part := range strings.Split(number, ".") {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return Version{}, errors.New("Erreur, la partie " + strconv.Quote(part) + " de la version " + number + " n'est pas un nombre")
+		}
+		version.parts = append(version.parts, value)
+	}
+	return version, nil
+}
+
+// NewVersion construit la version publiée par une génération de cytrus
+func NewVersion(generation int, number string) (Version, error) {
+	version, err := ParseVersionNumber(number)
+	version.Generation = generation
+	return version, err
+}
+
+// Prefix renvoie le préfixe de la génération: 6.0_
+func (v Version) Prefix() string {
+	return strconv.Itoa(v.Generation) + ".0_"
+}
+
+func (v Version) String() string {
+	return v.Prefix() + v.Number
+}
+
+// Compare ordonne les versions par génération puis par version du jeu, -1 si v est plus ancienne que other, 1 si elle est plus récente
+func (v Version) Compare(other Version) int {
+	if v.Generation != other.Generation {
+		if v.Generation < other.Generation {
+			return -1
+		}
+		return 1
+	}
+	for i := 0; i < len(v.parts) || i < len(other.parts); i++ {
+		// une partie absente vaut 0: 3.0 et 3.0.0 sont la même version
+		var a, b int
+		if i < len(v.parts) {
+			a = v.parts[i]
+		}
+		if i < len(other.parts) {
+			b = other.parts[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Less indique si v est plus ancienne que other
+func (v Version) Less(other Version) bool {
+	return v.Compare(other) < 0
+}
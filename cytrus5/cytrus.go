@@ -2,13 +2,18 @@ package cytrus5
 
 import (
 	"archive/tar"
+	"bytes"
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/dedupe"
+	"cytrusdownloader/seed"
+	"cytrusdownloader/sink"
+	"cytrusdownloader/store"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,145 +36,480 @@ type Fragment struct { // = contenu de "windows" "main", "configuration" "linux"
 }
 
 // les dernières versions dispo sur cette version de cytrus sont accessibles via l'url https://launcher.cdn.ankama.com/cytrus.json
+const (
+	CDN_URL = "https://launcher.cdn.ankama.com"
+	// numéro de génération, préfixe 5.0_ des versions publiées par cette version de cytrus
+	Generation = 5
+)
 
-func Cytrus5Downloader(manifestFile string, game string, release string, platform string, version string, outputDir string) error {
-	jsonData := []byte{}
-	if len(manifestFile) > 5 && strings.HasSuffix(manifestFile, ".json") {
+// LoadManifestData lis le fichier manifest json indiqué dans les options ou le télécharge
+func LoadManifestData(options cytrus.Options) ([]byte, error) {
+	if len(options.ManifestFile) > 5 && strings.HasSuffix(options.ManifestFile, ".json") {
 		// si le fichier se termine par .manifest on essaye de l'ouvrir
-		file, err := os.ReadFile(manifestFile)
+		file, err := os.ReadFile(options.ManifestFile)
 		if err != nil {
-			return errors.New("Erreur lors de l'ouverture du fichier manifest")
+			return []byte{}, errors.New("Erreur lors de l'ouverture du fichier manifest")
 		}
-		jsonData = file
+		return file, nil
 
-	} else if len(manifestFile) > 1 && !strings.HasSuffix(manifestFile, ".json") {
-		return errors.New("Le fichier Manifest n'a pas la bonne extension")
-	} else {
-		// si le fichier n'est pas indiqué, on télécharge le fichier
-		data, errDownloadJson := downloadJsonManifest(game, release, platform, version)
-		if errDownloadJson != nil {
-			return errors.New("Erreur lors du téléchargement du fichier manifest json " + errDownloadJson.Error())
-		}
-		jsonData = data
+	} else if len(options.ManifestFile) > 1 && !strings.HasSuffix(options.ManifestFile, ".json") {
+		return []byte{}, errors.New("Le fichier Manifest n'a pas la bonne extension")
+	}
+	// si le fichier n'est pas indiqué, on télécharge le fichier
+	data, errDownloadJson := downloadJsonManifest(options)
+	if errDownloadJson != nil {
+		return []byte{}, errors.New("Erreur lors du téléchargement du fichier manifest json " + errDownloadJson.Error())
 	}
+	if options.OnManifest != nil {
+		options.OnManifest(options, data)
+	}
+	return data, nil
+}
 
-	// charge les informations du json
+// ParseManifest charge les informations du json
+func ParseManifest(jsonData []byte) (map[string]Fragment, error) {
 	jsonUnmarshal := map[string]Fragment{}
-	json.Unmarshal(jsonData, &jsonUnmarshal)
+	if err := json.Unmarshal(jsonData, &jsonUnmarshal); err != nil {
+		return jsonUnmarshal, errors.New("Erreur lors de la lecture du manifest json\n[ERREUR]: " + err.Error())
+	}
+	return jsonUnmarshal, nil
+}
+
+// RequiredObjects renvoie le chemin sur le cdn des packs et fichiers nécessaires aux fragments sélectionnés
+func RequiredObjects(jsonData []byte, options cytrus.Options) ([]string, error) {
+	jsonUnmarshal, err := ParseManifest(jsonData)
+	if err != nil {
+		return []string{}, err
+	}
+	objects := []string{}
+	alreadyAdded := map[string]bool{}
+	addObject := func(hash string) {
+		if !alreadyAdded[hash] {
+			alreadyAdded[hash] = true
+			objects = append(objects, HashPath(options.Game, hash))
+		}
+	}
+	for k, fragment := range jsonUnmarshal {
+		if !options.IsFragmentSelected(k) {
+			continue
+		}
+		for packName := range fragment.Packs {
+			addObject(packName)
+		}
+		for _, file := range fragment.Files {
+			if !isFileInPack(file, fragment.Packs) {
+				addObject(file.Hash)
+			}
+		}
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+func Cytrus5Downloader(options cytrus.Options) error {
+	jsonData, err := LoadManifestData(options)
+	if err != nil {
+		return err
+	}
+	plan, err := planDownload(options, jsonData)
+	if err != nil {
+		return err
+	}
+	fmt.Println(len(plan.Files), "fichiers à écrire,", len(plan.Fetches), "packs et fichiers à télécharger,", plan.Unchanged, "fichiers inchangés")
+	return applyPlan(plan, options, jsonData)
+}
+
+// Plan calcule les fichiers à écrire et les packs et fichiers à télécharger sans rien modifier
+func Plan(options cytrus.Options) (cytrus.Plan, error) {
+	jsonData, err := LoadManifestData(options)
+	if err != nil {
+		return cytrus.Plan{}, err
+	}
+	return planDownload(options, jsonData)
+}
+
+// Apply exécute un plan, seuls les packs et fichiers qu'il liste sont téléchargés
+func Apply(plan cytrus.Plan, options cytrus.Options) error {
+	jsonData, err := LoadManifestData(options)
+	if err != nil {
+		return err
+	}
+	return applyPlan(plan, options, jsonData)
+}
+
+// Entries renvoie les fichiers des fragments sélectionnés avec le pack ou l'objet du cdn qui contient leurs données
+func Entries(jsonData []byte, options cytrus.Options) ([]cytrus.Entry, error) {
+	jsonUnmarshal, err := ParseManifest(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	entries := []cytrus.Entry{}
+	for k, fragment := range jsonUnmarshal {
+		if !options.IsFragmentSelected(k) {
+			continue
+		}
+		for fileName, file := range fragment.Files {
+			entry := cytrus.Entry{Fragment: k, Name: fileName, Size: file.Size, Hash: file.Hash, Executable: file.Executable, Object: HashPath(options.Game, file.Hash)}
+			if packName, inPack := packOf(file, fragment.Packs); inPack {
+				entry.Pack = packName
+				entry.Object = HashPath(options.Game, packName)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	cytrus.SortEntries(entries)
+	return entries, nil
+}
+
+// Listing renvoie les fichiers des fragments sélectionnés du manifest
+func Listing(jsonData []byte, options cytrus.Options) (cytrus.Listing, error) {
+	jsonUnmarshal, err := ParseManifest(jsonData)
+	if err != nil {
+		return cytrus.Listing{}, err
+	}
+	return listManifest(jsonUnmarshal, options), nil
+}
 
-	contentDestination := fmt.Sprintf("%s%s/%s/%s", outputDir, game, strings.TrimPrefix(version, "5.0_"), platform)
+func listManifest(jsonUnmarshal map[string]Fragment, options cytrus.Options) cytrus.Listing {
+	listing := cytrus.Listing{Names: make(map[string]bool), ManifestFragments: make(map[string]bool)}
+	for k, fragment := range jsonUnmarshal {
+		listing.ManifestFragments[k] = true
+		if !options.IsFragmentSelected(k) {
+			continue
+		}
+		listing.Fragments = append(listing.Fragments, k)
+		for fileName, file := range fragment.Files {
+			listing.Names[k+"/"+fileName] = true
+			listing.Files = append(listing.Files, cytrus.PlannedFile{Name: k + "/" + fileName, Hash: file.Hash, Size: file.Size})
+		}
+	}
+	return listing
+}
+
+func planDownload(options cytrus.Options, jsonData []byte) (cytrus.Plan, error) {
+	jsonUnmarshal, err := ParseManifest(jsonData)
+	if err != nil {
+		return cytrus.Plan{}, err
+	}
+	plan := cytrus.NewPlan(options, jsonData)
+
+	// l'état local n'est connu que si la sortie est un dossier
+	destination, _ := sink.Dir(options.Output())
+	toWrite, err := plan.CompareLocal(destination, listManifest(jsonUnmarshal, options), options.Prune)
+	if err != nil {
+		return plan, err
+	}
+
+	plannedPaths := map[string]bool{}
+	addFetch := func(hash string, size int64) {
+		path := HashPath(options.Game, hash)
+		if !plannedPaths[path] {
+			plannedPaths[path] = true
+			plan.AddFetch(path, hash, size, nil)
+		}
+	}
+	for i, planned := range toWrite {
+		fragmentName, fileName, _ := strings.Cut(planned.Name, "/")
+		fragment := jsonUnmarshal[fragmentName]
+		file := fragment.Files[fileName]
+		if options.Seed != nil {
+			if _, found := options.Seed.Lookup(file.Hash); found {
+				toWrite[i].Source = cytrus.SourceSeed
+				continue
+			}
+		}
+		if options.Store != nil && options.Store.Has(file.Hash) {
+			toWrite[i].Source = cytrus.SourceStore
+			continue
+		}
+		toWrite[i].Source = cytrus.SourceCDN
+		if packName, inPack := packOf(file, fragment.Packs); inPack {
+			addFetch(packName, fragment.Packs[packName].Size)
+		} else {
+			addFetch(file.Hash, file.Size)
+		}
+	}
+	plan.Files = toWrite
+	plan.Finish()
+	return plan, nil
+}
+
+func applyPlan(plan cytrus.Plan, options cytrus.Options, jsonData []byte) error {
+	if err := plan.CheckManifest(jsonData); err != nil {
+		return err
+	}
+	jsonUnmarshal, err := ParseManifest(jsonData)
+	if err != nil {
+		return err
+	}
+
+	// les fichiers sont écris dans la sortie, par défaut le dossier de la version
+	output := options.Output()
+	contentDestination, isDir := sink.Dir(output)
+	if isDir {
+		if err := plan.ApplyDeletions(contentDestination); err != nil {
+			return err
+		}
+	}
+	plannedFiles := plan.FileNames()
+	cdnSource := Source(options)
+	// erreurs de vérification des fichiers, le téléchargement est en échec s'il y en a
+	var verifyErrors []error
+	var missingErrors []error
+	var errorsMutex sync.Mutex
 	var wg sync.WaitGroup
 
 	for k, fragment := range jsonUnmarshal {
-		downloadDestination := fmt.Sprintf("%s/%s/", contentDestination, k)
-		if errCreateDir := os.MkdirAll(downloadDestination, os.ModePerm); errCreateDir != nil {
-			fmt.Println("Impossible de crée le dossier de destination, emplacement:" + downloadDestination + "\n[ERREUR]:" + errCreateDir.Error())
-			return errCreateDir
+		if !options.IsFragmentSelected(k) {
+			continue
 		}
 		wg.Add(1)
-		go func(downloadDestination string) {
+		go func(k string, fragment Fragment) {
 			defer wg.Done()
-
-			if errCreateDir := os.MkdirAll(downloadDestination, os.ModePerm); errCreateDir != nil {
-				fmt.Println("Impossible de crée le dossier de destination, emplacement:" + downloadDestination + "\n[ERREUR]:" + errCreateDir.Error())
-				return
+			fragmentOutput := fragmentSink{output: output, name: k}
+			// seuls les fichiers du plan sont écrits, les autres sont inchangés
+			files := map[string]File{}
+			for fileName, file := range fragment.Files {
+				if plannedFiles[k+"/"+fileName] {
+					files[fileName] = file
+				}
 			}
 
-			if len(fragment.Packs) > 0 {
-				// le fragment contient des Packs, on les télécharges et on les extrait
-				for packName := range fragment.Packs {
-					// on télécharge le pack
-					packFilePath := fmt.Sprintf("%s%s", downloadDestination, packName)
-					downloadUrl := fmt.Sprintf("https://launcher.cdn.ankama.com/%s/hashes/%s/%s", game, packName[0:2], packName)
-					if err := downloadFile(downloadUrl, packFilePath); err != nil {
-						fmt.Println("Erreur lors du téléchargement du pack" + packName + "\n[ERREUR]:" + err.Error())
-						break
-					}
-					fmt.Println("Téléchargement du fichier Pack", packName, "Url:", downloadUrl)
-					if err := unpackPackFile(fragment.Files, downloadDestination, packName); err != nil {
-						fmt.Println(err)
-					}
-					// on supprime le fichier, il ne sera plus utiliser
-					os.Remove(packFilePath)
-				}
+			// les fichiers présents dans les dossiers d'amorçage ne sont pas téléchargés
+			seededFiles := map[string]bool{}
+			if options.Seed != nil {
+				seededFiles = seedFragmentFiles(options.Seed, fragmentOutput, Fragment{Files: files})
 			}
 
-			// si le fragment ne contient pas de Packs, on téléchargement les fichiers de manière directe
-			for fileName, file := range fragment.Files {
-				isFileInPackFile := false
-				for _, pack := range fragment.Packs {
+			// les packs du plan sont téléchargés et extraits
+			extractedHashes := map[string]bool{}
+			for packName, pack := range fragment.Packs {
+				fetch, planned := plan.FetchOf(HashPath(options.Game, packName))
+				if !planned {
+					continue
+				}
+				fmt.Println("Téléchargement du fichier Pack", packName, "Url:", cdnSource.URL(fetch.Path))
+				packFilePath, err := fetch.Download(cdnSource)
+				if err != nil {
+					fmt.Println("Erreur lors du téléchargement du pack" + packName + "\n[ERREUR]:" + err.Error())
+					break
+				}
+				if err := unpackPackFile(files, fragmentOutput, packFilePath, packName, options.Store); err != nil {
+					fmt.Println(err)
+				} else {
 					for _, hash := range pack.Hash {
-						if hash == file.Hash {
-							isFileInPackFile = true
-							break
-						}
+						extractedHashes[hash] = true
 					}
 				}
+				// on supprime le fichier, il ne sera plus utiliser
+				os.Remove(packFilePath)
+			}
 
-				if isFileInPackFile == false {
-					if errCreateDir := os.MkdirAll(fmt.Sprintf("%s%s", downloadDestination, filepath.Dir(fileName)), os.ModePerm); errCreateDir != nil {
-						fmt.Println("Impossible de crée le dossier de destination, emplacement:" + downloadDestination + "\n[ERREUR]:" + errCreateDir.Error())
-						break
-					}
-					downloadUrl := fmt.Sprintf("https://launcher.cdn.ankama.com/%s/hashes/%s/%s", game, file.Hash[0:2], file.Hash)
-					fmt.Println("Téléchargement du fichier", fileName, "URL:", downloadUrl)
-					if err := downloadFile(downloadUrl, fmt.Sprintf("%s%s", downloadDestination, fileName)); err != nil {
-						fmt.Println("Erreur lors du téléchargement du fichier" + fileName + "\n[ERREUR]: " + err.Error())
+			// les autres fichiers sont copiés depuis le dépôt local ou téléchargés de manière directe
+			missing := 0
+			for fileName, file := range files {
+				if seededFiles[fileName] || extractedHashes[file.Hash] {
+					continue
+				}
+				if options.Store != nil && options.Store.Has(file.Hash) {
+					if err := copyFromStore(options.Store, fragmentOutput, fileName, file); err != nil {
+						fmt.Println(err)
+						missing++
 					}
+					continue
+				}
+				filePath := HashPath(options.Game, file.Hash)
+				if _, planned := plan.FetchOf(filePath); !planned || isFileInPack(file, fragment.Packs) {
+					missing++
+					continue
+				}
+				fmt.Println("Téléchargement du fichier", fileName, "URL:", cdnSource.URL(filePath))
+				if err := downloadFile(cdnSource, filePath, fragmentOutput, fileName, file, options.Store); err != nil {
+					fmt.Println("Erreur lors du téléchargement du fichier" + fileName + "\n[ERREUR]: " + err.Error())
+					missing++
+					continue
+				}
+			}
+			if missing > 0 {
+				errorsMutex.Lock()
+				missingErrors = append(missingErrors, errors.New("Erreur, "+strconv.Itoa(missing)+" fichiers du fragment "+k+" n'ont pas pu être récupérés"))
+				errorsMutex.Unlock()
+			}
+			// la vérification des fichiers complets et la déduplication ne sont possibles que dans un dossier
+			downloadDestination := fmt.Sprintf("%s/%s/", contentDestination, k)
+			if options.Verify && isDir {
+				if errs := verifyFragmentFiles(k, Fragment{Files: files}, downloadDestination); len(errs) > 0 {
+					errorsMutex.Lock()
+					verifyErrors = append(verifyErrors, errs...)
+					errorsMutex.Unlock()
 				}
 			}
-		}(downloadDestination)
+			if options.Pool != nil && isDir {
+				linkFragmentFiles(options.Pool, k, fragment, downloadDestination)
+			}
+		}(k, fragment)
 
 	}
 	wg.Wait()
 
-	return nil
+	if len(verifyErrors) > 0 {
+		missingErrors = append(missingErrors, errors.New("Erreur, "+strconv.Itoa(len(verifyErrors))+" fichiers ne correspondent pas au manifest"))
+		missingErrors = append(missingErrors, verifyErrors...)
+	}
+	return errors.Join(missingErrors...)
 }
 
-func downloadJsonManifest(game string, release string, platform string, version string) ([]byte, error) {
-	// télécharge le fichier de manifest
-	res, err := http.Get(fmt.Sprintf("https://launcher.cdn.ankama.com/%s/releases/%s/%s/%s.json", game, release, platform, version))
-	if err != nil {
-		return []byte{}, errors.New("Erreur lors de la requete du téléchargement du fichier manifest, erreur: " + strconv.FormatInt(int64(res.StatusCode), 10))
+// fragmentSink écris les fichiers d'un fragment dans la sortie
+type fragmentSink struct {
+	output sink.Sink
+	name   string
+}
+
+func (f fragmentSink) writeFile(fileName string, file File, content io.Reader) error {
+	return sink.WriteFile(f.output, f.name+"/"+fileName, file.Size, file.Executable, content)
+}
+
+// writeFiles écris le même contenu dans plusieurs fichiers du fragment en ne le lisant qu'une fois
+func (f fragmentSink) writeFiles(fileNames []string, files map[string]File, content io.Reader) error {
+	outFiles := make([]sink.File, 0, len(fileNames))
+	writers := make([]io.Writer, 0, len(fileNames))
+	var errWrite error
+	for _, fileName := range fileNames {
+		file := files[fileName]
+		outFile, err := f.output.OpenFile(f.name+"/"+fileName, file.Size, file.Executable)
+		if err != nil {
+			errWrite = err
+			break
+		}
+		outFiles = append(outFiles, outFile)
+		writers = append(writers, io.NewOffsetWriter(outFile, 0))
+	}
+	if errWrite == nil {
+		if _, err := io.Copy(io.MultiWriter(writers...), content); err != nil {
+			errWrite = errors.New("Erreur lors de l'écriture des fichiers " + strings.Join(fileNames, ", ") + "\n[ERREUR]: " + err.Error())
+		}
+	}
+	for _, outFile := range outFiles {
+		if err := outFile.Close(); err != nil && errWrite == nil {
+			errWrite = err
+		}
 	}
+	return errWrite
+}
 
-	defer res.Body.Close()
-	data, errReadBody := io.ReadAll(res.Body)
-	if errReadBody != nil {
-		return []byte{}, errors.New("Erreur lors de la lecture du corps de la requête")
+// verifyFragmentFiles recalcule le hash de chaque fichier extrait du fragment
+func verifyFragmentFiles(fragmentName string, fragment Fragment, downloadDestination string) []error {
+	errs := []error{}
+	for fileName, file := range fragment.Files {
+		hash, err := store.HashFile(fmt.Sprintf("%s%s", downloadDestination, fileName))
+		if err != nil {
+			errs = append(errs, errors.New("Impossible de vérifier le fichier "+fragmentName+"/"+fileName))
+		} else if hash != file.Hash {
+			errs = append(errs, errors.New("Le hash du fichier "+fragmentName+"/"+fileName+" ne correspond pas au manifest"))
+		}
 	}
-	return data, nil
+	return errs
 }
 
-func downloadFile(downloadUrl string, destinationFile string) error {
-	res, err := http.Get(downloadUrl)
-	if err != nil {
-		return errors.New("Erreur de lien de telechargement d'un fichier, url: " + downloadUrl + "\n[ERREUR]: " + err.Error())
+// isFileInPack indique si le contenu du fichier est distribué dans un des packs du fragment
+func isFileInPack(file File, packs map[string]Hash) bool {
+	_, inPack := packOf(file, packs)
+	return inPack
+}
+
+// packOf renvoie le nom du pack qui contient le fichier
+func packOf(file File, packs map[string]Hash) (string, bool) {
+	for packName, pack := range packs {
+		for _, hash := range pack.Hash {
+			if hash == file.Hash {
+				return packName, true
+			}
+		}
 	}
-	defer res.Body.Close()
+	return "", false
+}
 
-	file, errOpenFile := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if errOpenFile != nil {
-		return errors.New("Erreur lors de l'ouverture du fichier " + destinationFile + "\n[ERREUR]: " + errOpenFile.Error())
+func downloadJsonManifest(options cytrus.Options) ([]byte, error) {
+	// télécharge le fichier de manifest
+	var data bytes.Buffer
+	if err := Source(options).Fetch(ManifestPath(options), &data); err != nil {
+		return []byte{}, errors.New("Erreur lors de la requete du téléchargement du fichier manifest\n[ERREUR]: " + err.Error())
 	}
-	defer file.Close()
+	return data.Bytes(), nil
+}
 
-	_, errCopyToFile := io.Copy(file, res.Body)
-	if errCopyToFile != nil {
-		return errors.New("Erreur lors de la copie du contenu vers le fichier" + errCopyToFile.Error())
+// Source renvoie l'origine des fichiers du cdn, par défaut le cdn de cytrus 5
+func Source(options cytrus.Options) cytrus.Source {
+	if options.Source != nil {
+		return options.Source
 	}
-	return nil
+	if options.CDNURL != "" {
+		return cytrus.NewSource(options.CDNURL)
+	}
+	return cytrus.HTTPSource{BaseURL: CDN_URL}
+}
+
+// ManifestPath renvoie le chemin du manifest json de la version sur le cdn
+func ManifestPath(options cytrus.Options) string {
+	return fmt.Sprintf("%s/releases/%s/%s/%s.json", options.Game, options.Release, options.Platform, options.Version)
+}
+
+// HashPath renvoie le chemin d'un fichier ou d'un pack sur le cdn
+func HashPath(game string, hash string) string {
+	return fmt.Sprintf("%s/hashes/%s/%s", game, hash[0:2], hash)
+}
+
+// downloadFile télécharge un fichier du cdn dans la sortie, en l'ajoutant au dépôt local s'il est utilisé
+func downloadFile(cdnSource cytrus.Source, path string, fragmentOutput fragmentSink, fileName string, file File, objectStore *store.Store) error {
+	if objectStore == nil {
+		outFile, err := fragmentOutput.output.OpenFile(fragmentOutput.name+"/"+fileName, file.Size, file.Executable)
+		if err != nil {
+			return err
+		}
+		errFetch := cdnSource.Fetch(path, io.NewOffsetWriter(outFile, 0))
+		errClose := outFile.Close()
+		if errFetch != nil {
+			return errFetch
+		}
+		return errClose
+	}
+
+	tmpFilePath, err := cytrus.Fetch{Path: path}.Download(cdnSource)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilePath)
+	if err := storeFile(objectStore, file.Hash, tmpFilePath); err != nil {
+		fmt.Println("Erreur lors de l'ajout du fichier", fileName, "au dépôt local\n[ERREUR]:", err)
+	}
+	tmpFile, err := os.Open(tmpFilePath)
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close()
+	return fragmentOutput.writeFile(fileName, file, tmpFile)
 }
 
-func unpackPackFile(files map[string]File, fragmentDir string, packName string) error {
+// nombre maximum de fichiers ouverts en même temps pour écrire une entrée d'un pack
+const maxOpenPackFiles = 16
+
+func unpackPackFile(files map[string]File, fragmentOutput fragmentSink, packFilePath string, packName string, objectStore *store.Store) error {
 	// ouvre le fichier pack en lecteur
-	packFilePath := fmt.Sprintf("%s%s", fragmentDir, packName)
 	packFileContent, errOpenFile := os.Open(packFilePath)
 	if errOpenFile != nil {
 		return errors.New("Erreur lors de l'ouverture du fichier " + packFilePath + "\n[ERREUR]: " + errOpenFile.Error())
 	}
 	defer packFileContent.Close()
 
+	// plusieurs fichiers peuvent avoir le même contenu, chaque entrée du pack est écrite dans tous les fichiers de son hash
+	destinations := map[string][]string{}
+	for fileName, file := range files {
+		destinations[file.Hash] = append(destinations[file.Hash], fileName)
+	}
+	for _, fileNames := range destinations {
+		sort.Strings(fileNames)
+	}
+
 	// le contenu du fichier pack est archivé dans du contenu tar
 	tarReader := tar.NewReader(packFileContent)
 
@@ -183,25 +523,28 @@ func unpackPackFile(files map[string]File, fragmentDir string, packName string)
 
 		switch header.Typeflag {
 		case tar.TypeReg:
-			// on charge le fichier lié au hash puis on envoi le contenu de l'archive dans son fichier
-			for fileName, file := range files {
-				if header.Name == file.Hash {
-					// le fichier correspond au hash du fichier pack
-					destinationFileName := fmt.Sprintf("%s%s", fragmentDir, fileName)
-					os.MkdirAll(filepath.Dir(destinationFileName), os.ModePerm) // crée l'arborescence
-
-					outFile, errCreateFile := os.OpenFile(destinationFileName, os.O_RDWR|os.O_CREATE, os.ModePerm)
-					if errCreateFile != nil {
-						return errors.New("Erreur lors de la création du fichier " + fragmentDir + fileName)
-					}
-					defer outFile.Close()
-
-					if _, err := io.Copy(outFile, tarReader); err != nil {
-						return errors.New("Erreur lors de l'écriture des données dans le fichier")
-					}
-
-					fmt.Println("Extraction du fichier", fileName, " depuis le pack", packName)
+			fileNames := destinations[header.Name]
+			if len(fileNames) == 0 && objectStore == nil {
+				// aucun fichier à écrire n'a ce contenu
+				continue
+			}
+			var entryReader io.Reader = tarReader
+			if objectStore != nil {
+				// le contenu est ajouté au dépôt local avant d'être extrait
+				entryContent, err := io.ReadAll(tarReader)
+				if err != nil {
+					return errors.New("Erreur lors de la lecture de " + header.Name + " dans le pack " + packName)
+				}
+				if err := objectStore.Put(header.Name, entryContent); err != nil {
+					fmt.Println("Erreur lors de l'ajout de", header.Name, "au dépôt local\n[ERREUR]:", err)
 				}
+				entryReader = bytes.NewReader(entryContent)
+			}
+			if err := writePackEntry(fragmentOutput, files, fileNames, entryReader); err != nil {
+				return errors.New("Erreur lors de l'extraction de " + header.Name + " depuis le pack " + packName + "\n[ERREUR]: " + err.Error())
+			}
+			for _, fileName := range fileNames {
+				fmt.Println("Extraction du fichier", fileName, " depuis le pack", packName)
 			}
 		default:
 		}
@@ -209,3 +552,88 @@ func unpackPackFile(files map[string]File, fragmentDir string, packName string)
 	}
 	return nil
 }
+
+// writePackEntry écris une entrée du pack dans tous les fichiers qui ont son hash, par groupes d'au plus maxOpenPackFiles fichiers
+// l'entrée n'est lue qu'une fois dans le pack, elle est conservée dans un fichier temporaire s'il faut la relire pour plusieurs groupes
+func writePackEntry(fragmentOutput fragmentSink, files map[string]File, fileNames []string, content io.Reader) error {
+	if _, seekable := content.(io.ReadSeeker); len(fileNames) > maxOpenPackFiles && !seekable {
+		tmpFile, err := os.CreateTemp("", "cytrus-pack-*")
+		if err != nil {
+			return errors.New("Impossible de crée un fichier temporaire\n[ERREUR]:" + err.Error())
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+		if _, err := io.Copy(tmpFile, content); err != nil {
+			return err
+		}
+		content = tmpFile
+	}
+
+	for start := 0; start < len(fileNames); start += maxOpenPackFiles {
+		if seeker, seekable := content.(io.ReadSeeker); seekable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if err := fragmentOutput.writeFiles(fileNames[start:min(start+maxOpenPackFiles, len(fileNames))], files, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkFragmentFiles remplace les fichiers du fragment par des liens vers leur copie partagée
+func linkFragmentFiles(pool *dedupe.Pool, fragmentName string, fragment Fragment, downloadDestination string) {
+	saved := int64(0)
+	for fileName, file := range fragment.Files {
+		fileSaved, err := pool.Link(fmt.Sprintf("%s%s", downloadDestination, fileName), file.Hash)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		saved += fileSaved
+	}
+	fmt.Println("Déduplication du fragment", fragmentName, ":", saved, "octets économisés")
+}
+
+// seedFragmentFiles copie les fichiers disponibles dans les dossiers d'amorçage et renvoie la liste des fichiers copiés
+func seedFragmentFiles(seedIndex *seed.Index, fragmentOutput fragmentSink, fragment Fragment) map[string]bool {
+	seededFiles := map[string]bool{}
+	for fileName, file := range fragment.Files {
+		source, found, err := seedIndex.Open(file.Hash)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if !found || err != nil {
+			continue
+		}
+		errWrite := fragmentOutput.writeFile(fileName, file, source)
+		source.Close()
+		if errWrite != nil {
+			fmt.Println(errWrite)
+			continue
+		}
+		seededFiles[fileName] = true
+	}
+	fmt.Println("Fragment", fragmentOutput.name, ":", len(seededFiles), "fichiers copiés depuis les dossiers d'amorçage")
+	return seededFiles
+}
+
+// copyFromStore copie un objet du dépôt local dans la sortie
+func copyFromStore(objectStore *store.Store, fragmentOutput fragmentSink, fileName string, file File) error {
+	objectFile, err := objectStore.Open(file.Hash)
+	if err != nil {
+		return err
+	}
+	defer objectFile.Close()
+	return fragmentOutput.writeFile(fileName, file, objectFile)
+}
+
+func storeFile(objectStore *store.Store, hash string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.New("Erreur lors de l'ouverture du fichier " + filePath + "\n[ERREUR]: " + err.Error())
+	}
+	defer file.Close()
+	return objectStore.PutReader(hash, file)
+}
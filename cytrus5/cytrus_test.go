@@ -0,0 +1,218 @@
+package cytrus5
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/sink"
+	"cytrusdownloader/store"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memorySink garde les fichiers écrits en mémoire et compte les fichiers ouverts en même temps
+type memorySink struct {
+	mutex   sync.Mutex
+	files   map[string][]byte
+	open    int
+	maxOpen int
+}
+
+type memoryFile struct {
+	sink *memorySink
+	name string
+}
+
+func (s *memorySink) OpenFile(name string, size int64, executable bool) (sink.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.files[name] == nil {
+		s.files[name] = make([]byte, size)
+	}
+	s.open++
+	s.maxOpen = max(s.maxOpen, s.open)
+	return &memoryFile{sink: s, name: name}, nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func (f *memoryFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.sink.mutex.Lock()
+	defer f.sink.mutex.Unlock()
+	content := f.sink.files[f.name]
+	if offset+int64(len(p)) > int64(len(content)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(content[offset:], p), nil
+}
+
+func (f *memoryFile) Close() error {
+	f.sink.mutex.Lock()
+	defer f.sink.mutex.Unlock()
+	f.sink.open--
+	return nil
+}
+
+// onlyReader cache les autres méthodes du lecteur, le contenu ne peut pas être relu
+type onlyReader struct {
+	io.Reader
+}
+
+func contentHash(content []byte) string {
+	hash := sha1.Sum(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// testPack renvoie les fichiers d'un fragment dont les contenus sont partagés par 1, 2 et 40 fichiers et le pack qui contient ces contenus
+func testPack(t *testing.T) (map[string]File, map[string][]byte, string) {
+	contents := map[string][]byte{
+		"unique":   []byte("contenu unique"),
+		"double":   []byte("contenu de deux fichiers"),
+		"quarante": bytes.Repeat([]byte("contenu de quarante fichiers "), 100),
+	}
+	copies := map[string]int{"unique": 1, "double": 2, "quarante": 40}
+
+	files := map[string]File{}
+	expected := map[string][]byte{}
+	for name, content := range contents {
+		hash := contentHash(content)
+		for i := range copies[name] {
+			fileName := fmt.Sprintf("%s/%02d.bin", name, i)
+			files[fileName] = File{Hash: hash, Size: int64(len(content))}
+			expected["main/"+fileName] = content
+		}
+	}
+
+	packPath := filepath.Join(t.TempDir(), "pack.tar")
+	packFile, err := os.Create(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packFile.Close()
+	writer := tar.NewWriter(packFile)
+	for _, content := range contents {
+		if err := writer.WriteHeader(&tar.Header{Name: contentHash(content), Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return files, expected, packPath
+}
+
+func checkSink(t *testing.T, output *memorySink, expected map[string][]byte) {
+	t.Helper()
+	if len(output.files) != len(expected) {
+		t.Errorf("%d fichiers écrits au lieu de %d", len(output.files), len(expected))
+	}
+	for name, content := range expected {
+		if !bytes.Equal(output.files[name], content) {
+			t.Errorf("%s: contenu incomplet ou différent (%d octets au lieu de %d)", name, len(output.files[name]), len(content))
+		}
+	}
+	if output.maxOpen > maxOpenPackFiles {
+		t.Errorf("%d fichiers ouverts en même temps, au plus %d attendus", output.maxOpen, maxOpenPackFiles)
+	}
+	if output.open != 0 {
+		t.Errorf("%d fichiers n'ont pas été fermés", output.open)
+	}
+}
+
+func TestUnpackPackFileSharedContent(t *testing.T) {
+	files, expected, packPath := testPack(t)
+
+	// sans dépôt local les entrées sont lues directement dans le pack, avec un dépôt elles sont relues depuis la mémoire
+	objectStore, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, objectStore := range map[string]*store.Store{"sans dépôt": nil, "avec dépôt": objectStore} {
+		t.Run(name, func(t *testing.T) {
+			output := &memorySink{files: map[string][]byte{}}
+			if err := unpackPackFile(files, fragmentSink{output: output, name: "main"}, packPath, "pack", objectStore); err != nil {
+				t.Fatal(err)
+			}
+			checkSink(t, output, expected)
+		})
+	}
+}
+
+func TestWritePackEntryReaders(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, count := range []int{2, maxOpenPackFiles, maxOpenPackFiles + 1, 40} {
+		files := map[string]File{}
+		fileNames := []string{}
+		expected := map[string][]byte{}
+		for i := range count {
+			fileName := fmt.Sprintf("%02d.bin", i)
+			files[fileName] = File{Size: int64(len(content))}
+			fileNames = append(fileNames, fileName)
+			expected["main/"+fileName] = content
+		}
+		readers := map[string]func() io.Reader{
+			"lecteur relisible":     func() io.Reader { return bytes.NewReader(content) },
+			"lecteur non relisible": func() io.Reader { return onlyReader{bytes.NewReader(content)} },
+		}
+		for name, reader := range readers {
+			t.Run(fmt.Sprintf("%s, %d fichiers", name, count), func(t *testing.T) {
+				output := &memorySink{files: map[string][]byte{}}
+				if err := writePackEntry(fragmentSink{output: output, name: "main"}, files, fileNames, reader()); err != nil {
+					t.Fatal(err)
+				}
+				checkSink(t, output, expected)
+			})
+		}
+	}
+}
+
+func TestDownloadReportsFailedFile(t *testing.T) {
+	inputDir := t.TempDir()
+	large := bytes.Repeat([]byte("fichier publié seul "), 100)
+	for name, content := range map[string][]byte{"main/petit.txt": []byte("petit"), "main/grand.bin": large, "main/autre.bin": bytes.Repeat([]byte("autre"), 500)} {
+		if err := os.MkdirAll(filepath.Join(inputDir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(inputDir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cdnDir := t.TempDir()
+	publishOptions := PublishOptions{Game: "test", Release: "main", Platform: "windows", Version: "5.0_1.0", OutputDir: cdnDir, PackThreshold: 100}
+	if _, err := Publish(inputDir, publishOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	// le cdn répond 500 pour un des fichiers publiés seuls
+	failedPath := "/" + HashPath("test", contentHash(large))
+	files := http.FileServer(http.Dir(cdnDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == failedPath {
+			http.Error(w, "indisponible", http.StatusInternalServerError)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	options := cytrus.Options{Game: "test", Release: "main", Platform: "windows", Version: "5.0_1.0", OutputDir: t.TempDir() + "/", CDNURL: server.URL}
+	if err := Cytrus5Downloader(options); err == nil {
+		t.Fatal("le fichier qui n'a pas pu être téléchargé doit faire échouer le téléchargement")
+	}
+	if content, err := os.ReadFile(filepath.Join(options.ContentDestination(), "main", "autre.bin")); err != nil || len(content) != 2500 {
+		t.Errorf("les autres fichiers doivent être téléchargés: %d octets, %v", len(content), err)
+	}
+}
@@ -0,0 +1,279 @@
+package cytrus5
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/store"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// les fichiers plus petits sont regroupés dans des packs, les autres sont publiés seuls
+	DefaultPackThreshold = 64 << 10
+	// taille visée par défaut des packs
+	DefaultPackSize = 4 << 20
+)
+
+// PublishOptions configure la publication d'un dossier au format cytrus 5
+type PublishOptions struct {
+	Game     string
+	Release  string
+	Platform string
+	Version  string
+	// racine du cdn généré, les fichiers et packs sont écrits dans <cdn>/<jeu>/hashes et le manifest dans <cdn>/<jeu>/releases
+	OutputDir string
+	// fragment unique dans lequel placer tout le dossier, sinon chaque sous-dossier est un fragment
+	Fragment      string
+	PackThreshold int64
+	PackSize      int64
+}
+
+// PublishResult résume le contenu publié
+type PublishResult struct {
+	ManifestPath string
+	Fragments    int
+	Files        int
+	// fichiers dont le contenu est déjà publié sous le même hash
+	DuplicateFiles int
+	Objects        int
+	Packs          int
+	// octets des fichiers et packs écrits
+	ObjectsSize int64
+}
+
+// Publish écris le manifest json de la version, les fichiers sous leur hash et les petits fichiers dans des packs tar
+// le résultat a l'arborescence du cdn et peut être téléchargé par Cytrus5Downloader
+func Publish(inputDir string, options PublishOptions) (PublishResult, error) {
+	result := PublishResult{}
+	if options.PackThreshold <= 0 {
+		options.PackThreshold = DefaultPackThreshold
+	}
+	if options.PackSize <= 0 {
+		options.PackSize = DefaultPackSize
+	}
+	fragmentNames, fragmentDirs, err := cytrus.PublishedFragments(inputDir, options.Fragment)
+	if err != nil {
+		return result, err
+	}
+	if err := os.MkdirAll(options.OutputDir, os.ModePerm); err != nil {
+		return result, errors.New("Erreur lors de la création du répertoire " + options.OutputDir)
+	}
+
+	manifest := map[string]Fragment{}
+	for _, fragmentName := range fragmentNames {
+		fragment, err := publishFragment(fragmentName, fragmentDirs[fragmentName], options, &result)
+		if err != nil {
+			return result, err
+		}
+		manifest[fragmentName] = fragment
+	}
+	result.Fragments = len(manifest)
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return result, err
+	}
+	result.ManifestPath = filepath.Join(options.OutputDir, filepath.FromSlash(ManifestPath(cytrus.Options{Game: options.Game, Release: options.Release, Platform: options.Platform, Version: options.Version})))
+	if err := os.MkdirAll(filepath.Dir(result.ManifestPath), os.ModePerm); err != nil {
+		return result, errors.New("Erreur lors de la création du répertoire " + filepath.Dir(result.ManifestPath))
+	}
+	if err := os.WriteFile(result.ManifestPath, manifestData, 0644); err != nil {
+		return result, errors.New("Impossible d'écrire le manifest " + result.ManifestPath + "\n[ERREUR]:" + err.Error())
+	}
+	return result, nil
+}
+
+func publishFragment(fragmentName string, fragmentDir string, options PublishOptions, result *PublishResult) (Fragment, error) {
+	fragment := Fragment{Files: map[string]File{}, Packs: map[string]Hash{}}
+	writer := &packWriter{options: options, published: map[string]bool{}, packs: fragment.Packs}
+
+	err := filepath.WalkDir(fragmentDir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(fragmentDir, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relativePath)
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			// le format cytrus 5 ne décrit que des fichiers
+			fmt.Println("Le fichier", fragmentName+"/"+name, "n'est pas un fichier régulier, il est ignoré")
+			return nil
+		}
+		file, err := writer.addFile(filePath, info)
+		if err != nil {
+			return errors.New("Erreur lors de la publication du fichier " + filePath + "\n[ERREUR]:" + err.Error())
+		}
+		fragment.Files[name] = file
+		return nil
+	})
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		writer.discard()
+		return fragment, err
+	}
+	if len(fragment.Packs) == 0 {
+		fragment.Packs = nil
+	}
+
+	result.Files += len(fragment.Files)
+	result.DuplicateFiles += writer.duplicates
+	result.Objects += writer.objects
+	result.Packs += len(writer.packs)
+	result.ObjectsSize += writer.written
+	fmt.Println("Fragment", fragmentName, "publié:", len(fragment.Files), "fichiers,", len(writer.packs), "packs")
+	return fragment, nil
+}
+
+// packWriter publie le contenu des fichiers d'un fragment, un contenu déjà publié n'est pas écrit à nouveau
+type packWriter struct {
+	options    PublishOptions
+	published  map[string]bool
+	packs      map[string]Hash
+	duplicates int
+	objects    int
+	written    int64
+
+	// pack en cours d'écriture
+	current     *os.File
+	currentHash hash.Hash
+	tarWriter   *tar.Writer
+	pending     Hash
+}
+
+func (w *packWriter) addFile(filePath string, info fs.FileInfo) (File, error) {
+	fileHash, err := store.HashFile(filePath)
+	if err != nil {
+		return File{}, err
+	}
+	file := File{Hash: fileHash, Size: info.Size(), Executable: info.Mode()&0111 != 0}
+	if w.published[fileHash] {
+		w.duplicates++
+		return file, nil
+	}
+	w.published[fileHash] = true
+
+	if info.Size() >= w.options.PackThreshold {
+		// le fichier est publié seul sous son hash
+		w.objects++
+		w.written += info.Size()
+		return file, copyObject(filePath, filepath.Join(w.options.OutputDir, filepath.FromSlash(HashPath(w.options.Game, fileHash))))
+	}
+	return file, w.addToPack(filePath, file)
+}
+
+// addToPack ajoute le contenu du fichier au pack en cours, nommé par le hash du fichier
+func (w *packWriter) addToPack(filePath string, file File) error {
+	if w.current == nil {
+		tmpFile, err := os.CreateTemp(w.options.OutputDir, "pack-*")
+		if err != nil {
+			return err
+		}
+		w.current, w.currentHash = tmpFile, sha1.New()
+		w.tarWriter = tar.NewWriter(io.MultiWriter(tmpFile, w.currentHash))
+	}
+	content, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	// les entêtes ne dépendent que du contenu, le pack est identique à chaque publication
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: file.Hash, Size: file.Size, Mode: 0644, Format: tar.FormatUSTAR}
+	if err := w.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w.tarWriter, content); err != nil {
+		return err
+	}
+	w.pending.Hash = append(w.pending.Hash, file.Hash)
+	w.pending.Size += file.Size
+	if w.pending.Size >= w.options.PackSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush termine le pack en cours et le range sous son hash: <jeu>/hashes/<2 premiers caractères>/<hash>
+func (w *packWriter) flush() error {
+	if w.current == nil {
+		return nil
+	}
+	tmpPath := w.current.Name()
+	errTar := w.tarWriter.Close()
+	info, errStat := w.current.Stat()
+	errClose := w.current.Close()
+	w.current = nil
+	if err := errors.Join(errTar, errStat, errClose); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	packHash := hex.EncodeToString(w.currentHash.Sum(nil))
+	packPath := filepath.Join(w.options.OutputDir, filepath.FromSlash(HashPath(w.options.Game, packHash)))
+	if err := os.MkdirAll(filepath.Dir(packPath), os.ModePerm); err != nil {
+		os.Remove(tmpPath)
+		return errors.New("Erreur lors de la création du répertoire " + filepath.Dir(packPath))
+	}
+	if err := os.Rename(tmpPath, packPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	w.packs[packHash] = Hash{Hash: w.pending.Hash, Size: info.Size()}
+	w.written += info.Size()
+	w.pending = Hash{}
+	return nil
+}
+
+func (w *packWriter) discard() {
+	if w.current != nil {
+		w.current.Close()
+		os.Remove(w.current.Name())
+		w.current = nil
+	}
+}
+
+func copyObject(filePath string, objectPath string) error {
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		return errors.New("Erreur lors de la création du répertoire " + filepath.Dir(objectPath))
+	}
+	source, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.Create(objectPath)
+	if err != nil {
+		return err
+	}
+	_, errCopy := io.Copy(destination, source)
+	errClose := destination.Close()
+	return errors.Join(errCopy, errClose)
+}
+
+// PublishedVersion ajoute le préfixe de cytrus 5 à une version si elle ne l'a pas
+func PublishedVersion(version string) string {
+	prefix := cytrus.Version{Generation: Generation}.Prefix()
+	if strings.HasPrefix(version, prefix) {
+		return version
+	}
+	return prefix + version
+}
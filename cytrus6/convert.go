@@ -0,0 +1,162 @@
+package cytrus6
+
+import (
+	"cytrusdownloader/cytrus5"
+	"encoding/json"
+	"sort"
+)
+
+// représentation json lisible du manifest, les hash sont en hexadécimal comme ceux renvoyés par extractHash
+type manifestJSON struct {
+	Fragments []fragmentJSON `json:"fragments"`
+}
+
+type fragmentJSON struct {
+	Name    string       `json:"name"`
+	Files   []fileJSON   `json:"files"`
+	Bundles []bundleJSON `json:"bundles"`
+}
+
+type fileJSON struct {
+	Name       string      `json:"name"`
+	Size       int64       `json:"size"`
+	Hash       string      `json:"hash"`
+	Chunks     []chunkJSON `json:"chunks,omitempty"`
+	Executable bool        `json:"executable,omitempty"`
+	Symlink    string      `json:"symlink,omitempty"`
+}
+
+type bundleJSON struct {
+	Hash   string      `json:"hash"`
+	Chunks []chunkJSON `json:"chunks"`
+}
+
+type chunkJSON struct {
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+// ParseManifest lis un manifest au format flatbuffer
+func ParseManifest(manifestData []byte) Manifest {
+	return extractManifestFromFileData(manifestData)
+}
+
+func (m Manifest) MarshalJSON() ([]byte, error) {
+	dump := manifestJSON{Fragments: []fragmentJSON{}}
+	for _, fragment := range m.fragments {
+		fragmentDump := fragmentJSON{Name: fragment.name, Files: []fileJSON{}, Bundles: []bundleJSON{}}
+		for _, file := range fragment.files {
+			fragmentDump.Files = append(fragmentDump.Files, fileJSON{Name: file.name, Size: file.size, Hash: file.hash, Chunks: chunksToJSON(file.chunks), Executable: file.executable, Symlink: file.symlink})
+		}
+		for _, bundle := range fragment.bundles {
+			bundleDump := bundleJSON{Hash: bundle.hash, Chunks: chunksToJSON(bundle.chunks)}
+			if bundleDump.Chunks == nil {
+				bundleDump.Chunks = []chunkJSON{}
+			}
+			fragmentDump.Bundles = append(fragmentDump.Bundles, bundleDump)
+		}
+		dump.Fragments = append(dump.Fragments, fragmentDump)
+	}
+	return json.Marshal(dump)
+}
+
+func (m *Manifest) UnmarshalJSON(data []byte) error {
+	dump := manifestJSON{}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return err
+	}
+	m.fragments = nil
+	for _, fragmentDump := range dump.Fragments {
+		fragment := Fragment{name: fragmentDump.Name}
+		for _, fileDump := range fragmentDump.Files {
+			fragment.files = append(fragment.files, File{name: fileDump.Name, size: fileDump.Size, hash: fileDump.Hash, chunks: chunksFromJSON(fileDump.Chunks), executable: fileDump.Executable, symlink: fileDump.Symlink})
+		}
+		for _, bundleDump := range fragmentDump.Bundles {
+			fragment.bundles = append(fragment.bundles, Bundle{hash: bundleDump.Hash, chunks: chunksFromJSON(bundleDump.Chunks)})
+		}
+		m.fragments = append(m.fragments, fragment)
+	}
+	return nil
+}
+
+func chunksToJSON(chunks []Chunk) []chunkJSON {
+	var dump []chunkJSON
+	for _, chunk := range chunks {
+		dump = append(dump, chunkJSON{Hash: chunk.hash, Size: chunk.size, Offset: chunk.offset})
+	}
+	return dump
+}
+
+func chunksFromJSON(dump []chunkJSON) []Chunk {
+	var chunks []Chunk
+	for _, chunk := range dump {
+		chunks = append(chunks, Chunk{hash: chunk.Hash, size: chunk.Size, offset: chunk.Offset})
+	}
+	return chunks
+}
+
+// FromCytrus5 convertit un manifest cytrus 5 dans le modèle de cytrus 6
+// un fichier publié seul devient un bundle d'un seul chunk nommé par son hash,
+// les fichiers des packs sont conservés sans bundle car leur position dans le pack n'est pas connue, ils sont comptés dans packed
+func FromCytrus5(fragments map[string]cytrus5.Fragment) (manifest Manifest, packed int) {
+	fragmentNames := make([]string, 0, len(fragments))
+	for name := range fragments {
+		fragmentNames = append(fragmentNames, name)
+	}
+	sort.Strings(fragmentNames)
+
+	for _, fragmentName := range fragmentNames {
+		legacyFragment := fragments[fragmentName]
+		inPack := map[string]bool{}
+		for _, pack := range legacyFragment.Packs {
+			for _, hash := range pack.Hash {
+				inPack[hash] = true
+			}
+		}
+
+		fragment := Fragment{name: fragmentName}
+		bundled := map[string]bool{}
+		for _, fileName := range sortedFileNames(legacyFragment.Files) {
+			legacyFile := legacyFragment.Files[fileName]
+			fragment.files = append(fragment.files, File{name: fileName, size: legacyFile.Size, hash: legacyFile.Hash, executable: legacyFile.Executable})
+			if inPack[legacyFile.Hash] {
+				packed++
+				continue
+			}
+			if !bundled[legacyFile.Hash] {
+				bundled[legacyFile.Hash] = true
+				fragment.bundles = append(fragment.bundles, Bundle{hash: legacyFile.Hash, chunks: []Chunk{{hash: legacyFile.Hash, size: legacyFile.Size, offset: 0}}})
+			}
+		}
+		manifest.fragments = append(manifest.fragments, fragment)
+	}
+	return manifest, packed
+}
+
+// ToCytrus5 convertit le manifest au format de cytrus 5, chaque fichier est publié seul sous son hash
+// les liens symboliques n'existent pas dans cytrus 5, ils sont ignorés et comptés dans skipped
+func (m Manifest) ToCytrus5() (fragments map[string]cytrus5.Fragment, skipped int) {
+	fragments = map[string]cytrus5.Fragment{}
+	for _, fragment := range m.fragments {
+		legacyFragment := cytrus5.Fragment{Files: map[string]cytrus5.File{}}
+		for _, file := range fragment.files {
+			if file.symlink != "" {
+				skipped++
+				continue
+			}
+			legacyFragment.Files[file.name] = cytrus5.File{Hash: file.hash, Size: file.size, Executable: file.executable}
+		}
+		fragments[fragment.name] = legacyFragment
+	}
+	return fragments, skipped
+}
+
+func sortedFileNames(files map[string]cytrus5.File) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
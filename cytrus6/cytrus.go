@@ -1,144 +1,546 @@
 package cytrus6
 
 import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/dedupe"
+	"cytrusdownloader/seed"
+	"cytrusdownloader/sink"
+	"cytrusdownloader/store"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 )
 
-func Cytrus6Downloader(manifestFile string, game string, release string, platform string, version string, outputDir string) error {
-	var manifestData []byte
-
-	if len(manifestFile) > 9 && strings.HasSuffix(manifestFile, ".manifest") {
+// LoadManifestData lis le fichier manifest indiqué dans les options ou le télécharge
+func LoadManifestData(options cytrus.Options) ([]byte, error) {
+	if len(options.ManifestFile) > 9 && strings.HasSuffix(options.ManifestFile, ".manifest") {
 		// si le fichier se termine par .manifest on essaye de l'ouvrir
-		file, err := os.ReadFile(manifestFile)
+		file, err := os.ReadFile(options.ManifestFile)
 		if err != nil {
-			return errors.New("Erreur lors de l'ouverture du fichier manifest")
+			return []byte{}, errors.New("Erreur lors de l'ouverture du fichier manifest")
 		}
-		manifestData = file
+		return file, nil
 
-	} else if len(manifestFile) > 1 && !strings.HasSuffix(manifestFile, ".manifest") {
-		return errors.New("Le fichier Manifest n'a pas la bonne extension")
-	} else {
-		// Telecharge le fichier de manifest de la version souhaitée
-		// si le fichier n'est pas saisi ou n'est pas valide, on essaye de télécharger le fichier de manifest
-		data, errDownloadManifest := downloadManifest(game, release, platform, version)
-		if errDownloadManifest != nil {
-			return errors.New("Erreur lors du téléchargement du fichier de manifest " + errDownloadManifest.Error())
+	} else if len(options.ManifestFile) > 1 && !strings.HasSuffix(options.ManifestFile, ".manifest") {
+		return []byte{}, errors.New("Le fichier Manifest n'a pas la bonne extension")
+	}
+	// Telecharge le fichier de manifest de la version souhaitée
+	// si le fichier n'est pas saisi ou n'est pas valide, on essaye de télécharger le fichier de manifest
+	data, errDownloadManifest := downloadManifest(options)
+	if errDownloadManifest != nil {
+		return []byte{}, errors.New("Erreur lors du téléchargement du fichier de manifest " + errDownloadManifest.Error())
+	}
+	if options.OnManifest != nil {
+		options.OnManifest(options, data)
+	}
+	return data, nil
+}
+
+// RequiredObjects renvoie le chemin sur le cdn des bundles nécessaires aux fragments sélectionnés
+func RequiredObjects(manifestData []byte, options cytrus.Options) []string {
+	manifestExtracted := extractManifestFromFileData(manifestData)
+	objects := []string{}
+	alreadyAdded := map[string]bool{}
+	for _, fragment := range manifestExtracted.fragments {
+		if !options.IsFragmentSelected(fragment.name) {
+			continue
+		}
+		for _, bundle := range fragment.bundles {
+			if !alreadyAdded[bundle.hash] {
+				alreadyAdded[bundle.hash] = true
+				objects = append(objects, BundlePath(options.Game, bundle.hash))
+			}
+		}
+	}
+	return objects
+}
+
+func Cytrus6Downloader(options cytrus.Options) error {
+	manifestData, err := LoadManifestData(options)
+	if err != nil {
+		return err
+	}
+	plan, err := planDownload(options, manifestData)
+	if err != nil {
+		return err
+	}
+	fmt.Println(len(plan.Files), "fichiers à écrire,", len(plan.Fetches), "bundles à télécharger,", plan.Unchanged, "fichiers inchangés")
+	return applyPlan(plan, options, manifestData)
+}
+
+// Plan calcule les fichiers à écrire et les bundles, ou parties de bundles, à télécharger sans rien modifier
+func Plan(options cytrus.Options) (cytrus.Plan, error) {
+	manifestData, err := LoadManifestData(options)
+	if err != nil {
+		return cytrus.Plan{}, err
+	}
+	return planDownload(options, manifestData)
+}
+
+// Apply exécute un plan, seuls les bundles et parties de bundles qu'il liste sont téléchargés
+func Apply(plan cytrus.Plan, options cytrus.Options) error {
+	manifestData, err := LoadManifestData(options)
+	if err != nil {
+		return err
+	}
+	return applyPlan(plan, options, manifestData)
+}
+
+// Listing renvoie les fichiers des fragments sélectionnés du manifest
+func Listing(manifestData []byte, options cytrus.Options) (cytrus.Listing, error) {
+	return listManifest(extractManifestFromFileData(manifestData), options), nil
+}
+
+func listManifest(manifestExtracted Manifest, options cytrus.Options) cytrus.Listing {
+	listing := cytrus.Listing{Names: make(map[string]bool), ManifestFragments: make(map[string]bool)}
+	for _, fragment := range manifestExtracted.fragments {
+		listing.ManifestFragments[fragment.name] = true
+		if !options.IsFragmentSelected(fragment.name) {
+			continue
+		}
+		listing.Fragments = append(listing.Fragments, fragment.name)
+		for _, file := range fragment.files {
+			name := fragment.name + "/" + file.name
+			listing.Names[name] = true
+			// les liens symboliques ne sont pas écrits
+			if file.symlink == "" {
+				listing.Files = append(listing.Files, cytrus.PlannedFile{Name: name, Hash: file.hash, Size: file.size})
+			}
+		}
+	}
+	return listing
+}
+
+func planDownload(options cytrus.Options, manifestData []byte) (cytrus.Plan, error) {
+	// convertis le contenu du fichier manifest en structure de données
+	manifestExtracted := extractManifestFromFileData(manifestData)
+	plan := cytrus.NewPlan(options, manifestData)
+
+	// l'état local n'est connu que si la sortie est un dossier
+	destination, _ := sink.Dir(options.Output())
+	toWrite, err := plan.CompareLocal(destination, listManifest(manifestExtracted, options), options.Prune)
+	if err != nil {
+		return plan, err
+	}
+	toWriteIndex := make(map[string]int, len(toWrite))
+	for i, file := range toWrite {
+		toWriteIndex[file.Name] = i
+	}
+
+	for _, fragment := range manifestExtracted.fragments {
+		if !options.IsFragmentSelected(fragment.name) {
+			continue
+		}
+		// chunks du fragment qui ne sont disponibles ni dans les dossiers d'amorçage ni dans le dépôt local
+		neededChunks := make(map[string]bool)
+		for _, file := range fragment.files {
+			index, write := toWriteIndex[fragment.name+"/"+file.name]
+			if !write {
+				continue
+			}
+			toWrite[index].Source = planFileSource(options, fragment, file, neededChunks)
+		}
+
+		// chaque chunk n'est téléchargé qu'une fois, depuis le premier bundle qui le contient
+		plannedChunks := make(map[string]bool)
+		for _, bundle := range fragment.bundles {
+			ranges := []cytrus.Range{}
+			bundleSize := int64(0)
+			for _, chunk := range bundle.chunks {
+				if end := chunk.offset + chunk.size; end > bundleSize {
+					bundleSize = end
+				}
+				if neededChunks[chunk.hash] && !plannedChunks[chunk.hash] {
+					plannedChunks[chunk.hash] = true
+					ranges = append(ranges, cytrus.Range{Offset: chunk.offset, Size: chunk.size})
+				}
+			}
+			if len(ranges) > 0 {
+				plan.AddFetch(BundlePath(options.Game, bundle.hash), bundle.hash, bundleSize, ranges)
+			}
+		}
+	}
+	plan.Files = toWrite
+	plan.Finish()
+	return plan, nil
+}
+
+// planFileSource indique d'où proviennent les parties du fichier et ajoute à neededChunks celles à télécharger
+func planFileSource(options cytrus.Options, fragment Fragment, file File, neededChunks map[string]bool) string {
+	if options.Seed != nil {
+		if _, found := options.Seed.Lookup(file.hash); found {
+			return cytrus.SourceSeed
+		}
+	}
+	sources := map[string]bool{}
+	for _, chunk := range fileChunks(file) {
+		if options.Seed != nil && len(file.chunks) > 0 {
+			if _, found := options.Seed.ReadChunk(fragment.name+"/"+file.name, chunk.hash, chunk.offset, chunk.size); found {
+				sources[cytrus.SourceSeed] = true
+				continue
+			}
+		}
+		if options.Store != nil && options.Store.Has(chunk.hash) {
+			sources[cytrus.SourceStore] = true
+			continue
 		}
-		manifestData = data
+		sources[cytrus.SourceCDN] = true
+		neededChunks[chunk.hash] = true
+	}
+	return cytrus.SourceOf(sources)
+}
+
+// fileChunks renvoie les chunks d'un fichier, un fichier sans chunk tiens entièrement dans un chunk de même hash
+func fileChunks(file File) []Chunk {
+	if len(file.chunks) == 0 {
+		return []Chunk{{hash: file.hash, size: file.size, offset: 0}}
 	}
+	return file.chunks
+}
 
+func applyPlan(plan cytrus.Plan, options cytrus.Options, manifestData []byte) error {
+	if err := plan.CheckManifest(manifestData); err != nil {
+		return err
+	}
 	// convertis le contenu du fichier manifest en structure de données
 	manifestExtracted := extractManifestFromFileData(manifestData)
 
-	// telecharge les fichiers bundles
-	contentDestination := fmt.Sprintf("%s%s/%s/%s", outputDir, game, strings.TrimPrefix(version, "6.0_"), platform)
+	// les fichiers sont écris dans la sortie, par défaut le dossier de la version
+	output := options.Output()
+	contentDestination, isDir := sink.Dir(output)
+	if isDir {
+		if err := plan.ApplyDeletions(contentDestination); err != nil {
+			return err
+		}
+	}
+	plannedFiles := plan.FileNames()
+
+	cdnSource := Source(options)
+	// erreurs de vérification des fichiers, le téléchargement est en échec s'il y en a
+	var verifyErrors []error
+	var missingErrors []error
+	var errorsMutex sync.Mutex
 
 	var wg sync.WaitGroup
 	for _, fragment := range manifestExtracted.fragments {
+		if !options.IsFragmentSelected(fragment.name) {
+			continue
+		}
 		wg.Add(1)
 		go func(fragment Fragment) {
 			defer wg.Done()
-			downloadDestination := fmt.Sprintf("%s/%s/", contentDestination, fragment.name)
-			os.MkdirAll(downloadDestination, os.ModePerm)
+			// seuls les fichiers du plan sont écrits, les autres sont inchangés
+			plannedFragment := Fragment{name: fragment.name, bundles: fragment.bundles}
+			for _, file := range fragment.files {
+				if plannedFiles[fragment.name+"/"+file.name] {
+					plannedFragment.files = append(plannedFragment.files, file)
+				}
+			}
+			fragmentOutput := fragmentSink{output: output, fragment: plannedFragment}
+
+			// les fichiers et chunks présents dans les dossiers d'amorçage ne sont pas téléchargés
+			var neededChunks map[string]bool
+			if options.Seed != nil {
+				neededChunks = seedFragmentFiles(options.Seed, fragmentOutput)
+			} else {
+				neededChunks = make(map[string]bool)
+				for _, file := range plannedFragment.files {
+					for _, chunk := range fileChunks(file) {
+						neededChunks[chunk.hash] = true
+					}
+				}
+			}
 			// parcours les bundle pour l'extraction
 			for _, bundle := range fragment.bundles {
-				downloadURL := fmt.Sprintf("https://cytrus.cdn.ankama.com/%s/bundles/%s/%s", game, bundle.hash[0:2], bundle.hash)
-				bundleFilePath := fmt.Sprintf("%s/%s", downloadDestination, bundle.hash)
-
-				fmt.Println("Telechargement du bundle", bundle.hash, "URL:", downloadURL)
-				errDownload := downloadBundleFile(downloadURL, bundleFilePath)
-				if errDownload != nil {
-					fmt.Println("Erreur lors du téléchargement du fichier bundle " + bundle.hash)
+				if !isBundleNeeded(bundle, neededChunks) {
+					continue
+				}
+				if err := extractPlannedBundle(plan, options, cdnSource, bundle, fragmentOutput, neededChunks); err != nil {
+					fmt.Println(err)
 					break
 				}
-				extractBundleFile(bundle, downloadDestination, fragment.files)
-				os.Remove(bundleFilePath)
-				fmt.Println("Tous les fichiers ont été téléchargés et extrait dans le répertoire ", downloadDestination)
+			}
+			if len(neededChunks) > 0 {
+				errorsMutex.Lock()
+				missingErrors = append(missingErrors, errors.New("Erreur, "+strconv.Itoa(len(neededChunks))+" chunks du fragment "+fragment.name+" n'ont pas pu être récupérés"))
+				errorsMutex.Unlock()
+			}
+			// la vérification des fichiers complets et la déduplication ne sont possibles que dans un dossier
+			downloadDestination := fmt.Sprintf("%s/%s/", contentDestination, fragment.name)
+			if options.Verify && isDir {
+				if errs := verifyFragmentFiles(plannedFragment, downloadDestination); len(errs) > 0 {
+					errorsMutex.Lock()
+					verifyErrors = append(verifyErrors, errs...)
+					errorsMutex.Unlock()
+				}
+			}
+			if options.Pool != nil && isDir {
+				linkFragmentFiles(options.Pool, fragment, downloadDestination)
 			}
 		}(fragment)
 	}
 	wg.Wait()
-	return nil
+
+	if len(verifyErrors) > 0 {
+		missingErrors = append(missingErrors, errors.New("Erreur, "+strconv.Itoa(len(verifyErrors))+" fichiers ne correspondent pas au manifest"))
+		missingErrors = append(missingErrors, verifyErrors...)
+	}
+	return errors.Join(missingErrors...)
+}
+
+// extractPlannedBundle télécharge les parties du bundle prévues par le plan
+// et extrait les chunks nécessaires disponibles dans ces parties ou dans le dépôt local
+func extractPlannedBundle(plan cytrus.Plan, options cytrus.Options, cdnSource cytrus.Source, bundle Bundle, fragmentOutput fragmentSink, neededChunks map[string]bool) error {
+	bundlePath := BundlePath(options.Game, bundle.hash)
+	fetch, planned := plan.FetchOf(bundlePath)
+	var bundleFileContent *os.File
+	if planned {
+		if len(fetch.Ranges) > 0 {
+			fmt.Println("Telechargement de", len(fetch.Ranges), "parties du bundle", bundle.hash, "URL:", cdnSource.URL(bundlePath))
+		} else {
+			fmt.Println("Telechargement du bundle", bundle.hash, "URL:", cdnSource.URL(bundlePath))
+		}
+		// le bundle est téléchargé dans un fichier temporaire, la sortie ne reçoit que les fichiers extraits
+		bundleFilePath, err := fetch.Download(cdnSource)
+		if err != nil {
+			return errors.New("Erreur lors du téléchargement du fichier bundle " + bundle.hash + "\n[ERREUR]: " + err.Error())
+		}
+		defer os.Remove(bundleFilePath)
+		if bundleFileContent, err = os.Open(bundleFilePath); err != nil {
+			return errors.New("Impossible d'ouvrir le fichier bundle" + err.Error())
+		}
+		defer bundleFileContent.Close()
+		if options.Store != nil {
+			if err := storeBundleChunks(options.Store, bundle, fetch, bundleFileContent); err != nil {
+				fmt.Println("Erreur lors de l'ajout du bundle", bundle.hash, "au dépôt local\n[ERREUR]:", err)
+			}
+		}
+	} else {
+		fmt.Println("Extraction du bundle", bundle.hash, "depuis le dépôt local")
+	}
+
+	readBundleChunk := chunkReader(nil)
+	if bundleFileContent != nil {
+		readBundleChunk = bundleChunkReader(bundleFileContent)
+	}
+	readChunk := func(bundleChunk Chunk) ([]byte, error) {
+		if readBundleChunk != nil && fetch.Covers(bundleChunk.offset, bundleChunk.size) {
+			return readBundleChunk(bundleChunk)
+		}
+		if options.Store != nil && options.Store.Has(bundleChunk.hash) {
+			return options.Store.Read(bundleChunk.hash)
+		}
+		return nil, errChunkUnavailable
+	}
+	return extractBundle(bundle, fragmentOutput, readChunk, neededChunks, options.Verify)
+}
+
+// fragmentSink écris les fichiers d'un fragment dans la sortie
+type fragmentSink struct {
+	output   sink.Sink
+	fragment Fragment
+}
+
+func (f fragmentSink) name(file File) string {
+	return f.fragment.name + "/" + file.name
+}
+
+// verifyFragmentFiles recalcule le hash de chaque fichier extrait du fragment
+func verifyFragmentFiles(fragment Fragment, downloadDestination string) []error {
+	errs := []error{}
+	for _, file := range fragment.files {
+		if file.symlink != "" {
+			continue
+		}
+		hash, err := store.HashFile(fmt.Sprintf("%s/%s", downloadDestination, file.name))
+		if err != nil {
+			errs = append(errs, errors.New("Impossible de vérifier le fichier "+fragment.name+"/"+file.name))
+		} else if hash != file.hash {
+			errs = append(errs, errors.New("Le hash du fichier "+fragment.name+"/"+file.name+" ne correspond pas au manifest"))
+		}
+	}
+	return errs
 }
 
-func extractBundleFile(bundle Bundle, downloadDestination string, fragmentFiles []File) error {
-	bundleFileContent, errOpenFile := os.Open(fmt.Sprintf("%s/%s", downloadDestination, bundle.hash))
-	if errOpenFile != nil {
-		return errors.New("Impossible d'ouvrir le fichier bundle" + errOpenFile.Error())
+// chunkReader renvoie le contenu d'un chunk d'un bundle
+type chunkReader func(bundleChunk Chunk) ([]byte, error)
+
+// errChunkUnavailable indique que le chunk n'est pas disponible dans ce bundle, il sera lu depuis un autre bundle
+var errChunkUnavailable = errors.New("Le chunk n'est pas disponible")
+
+func bundleChunkReader(bundleFileContent io.ReaderAt) chunkReader {
+	return func(bundleChunk Chunk) ([]byte, error) {
+		// lis le contenu du chunk
+		bufferContent := make([]byte, bundleChunk.size)
+		_, errReadChunk := bundleFileContent.ReadAt(bufferContent, bundleChunk.offset)
+		if errReadChunk != nil {
+			return []byte{}, errors.New("Erreur lors de la lecture du chunk")
+		}
+		return bufferContent, nil
 	}
-	defer bundleFileContent.Close()
+}
 
+// chunkTarget correspond à l'emplacement d'un chunk dans un fichier du fragment
+type chunkTarget struct {
+	file   File
+	offset int64
+}
+
+// extractBundle écris les chunks nécessaires du bundle dans les fichiers du fragment, les chunks écrits sont retirés de neededChunks
+func extractBundle(bundle Bundle, fragmentOutput fragmentSink, readChunk chunkReader, neededChunks map[string]bool, verify bool) error {
 	for _, chunkBundle := range bundle.chunks {
-		for _, file := range fragmentFiles {
+		if !neededChunks[chunkBundle.hash] {
+			continue
+		}
+		targets := []chunkTarget{}
+		for _, file := range fragmentOutput.fragment.files {
 			if len(file.chunks) == 0 && (chunkBundle.hash == file.hash) {
 				// si le fichier n'a pas de chunk, le fichier complet tiens sur un chunk du bundle
-				//fmt.Println("Extraction du fichier ", file.name)
-				extractChunkToFile(bundleFileContent, chunkBundle, fmt.Sprintf("%s/%s", downloadDestination, file.name), 0)
+				targets = append(targets, chunkTarget{file: file, offset: 0})
 			}
 
 			if len(file.chunks) > 0 {
 				for _, chunkFile := range file.chunks {
 					if chunkFile.hash == chunkBundle.hash {
-						// on crée le fichier et on copie de contenu du chuck de bundleFileContent dans ce fichier
-						//fmt.Println("Extraction d'un chunk du fichier ", file.name)
-						extractChunkToFile(bundleFileContent, chunkBundle, fmt.Sprintf("%s/%s", downloadDestination, file.name), chunkFile.offset)
+						// le chunk du bundle correspond à une partie du fichier
+						targets = append(targets, chunkTarget{file: file, offset: chunkFile.offset})
 					}
 				}
 			}
 		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		// le contenu du chunk n'est lu qu'une fois, même s'il est utilisé par plusieurs fichiers
+		chunkContent, err := readChunk(chunkBundle)
+		if errors.Is(err, errChunkUnavailable) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if verify && store.HashData(chunkBundle.hash, chunkContent) != chunkBundle.hash {
+			return errors.New("Le contenu du chunk " + chunkBundle.hash + " du bundle " + bundle.hash + " ne correspond pas à son hash")
+		}
+		for _, target := range targets {
+			if err := extractChunkToFile(chunkContent, fragmentOutput, target.file, target.offset); err != nil {
+				return err
+			}
+		}
+		delete(neededChunks, chunkBundle.hash)
 	}
 	return nil
 }
 
-func extractChunkToFile(bundleFileContent *os.File, bundleChunk Chunk, destinationFile string, fileOffset int64) error {
-	// lis le contenu du chunk
-	bufferContent := make([]byte, bundleChunk.size)
-	_, errReadChunk := bundleFileContent.ReadAt(bufferContent, bundleChunk.offset)
-	if errReadChunk != nil {
-		return errors.New("Erreur lors de la lecture du chunk")
+// linkFragmentFiles remplace les fichiers du fragment par des liens vers leur copie partagée
+func linkFragmentFiles(pool *dedupe.Pool, fragment Fragment, downloadDestination string) {
+	saved := int64(0)
+	for _, file := range fragment.files {
+		if file.symlink != "" {
+			continue
+		}
+		fileSaved, err := pool.Link(fmt.Sprintf("%s/%s", downloadDestination, file.name), file.hash)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		saved += fileSaved
 	}
-	// crée le path du fichier
-	errMkDir := os.MkdirAll(filepath.Dir(destinationFile), os.ModePerm)
-	if errMkDir != nil {
-		return errors.New("Erreur lors de la création du répertoire")
+	fmt.Println("Déduplication du fragment", fragment.name, ":", saved, "octets économisés")
+}
+
+// seedFragmentFiles copie les fichiers et chunks disponibles dans les dossiers d'amorçage
+// et renvoie les hash des chunks qui doivent encore être récupérés
+func seedFragmentFiles(seedIndex *seed.Index, fragmentOutput fragmentSink) map[string]bool {
+	fragment := fragmentOutput.fragment
+	neededChunks := make(map[string]bool)
+	seededFiles := 0
+	seededChunks := 0
+	for _, file := range fragment.files {
+		copied, err := seedFile(seedIndex, fragmentOutput, file)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if copied {
+			seededFiles++
+			continue
+		}
+		if len(file.chunks) == 0 {
+			neededChunks[file.hash] = true
+			continue
+		}
+		// le fichier a changé, on cherche ses parties inchangées dans le fichier de même nom
+		for _, chunk := range file.chunks {
+			chunkContent, found := seedIndex.ReadChunk(fragment.name+"/"+file.name, chunk.hash, chunk.offset, chunk.size)
+			if found {
+				if err := extractChunkToFile(chunkContent, fragmentOutput, file, chunk.offset); err == nil {
+					seededChunks++
+					continue
+				}
+			}
+			neededChunks[chunk.hash] = true
+		}
 	}
-	// ouvre le fichier
-	finalFile, err := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return errors.New("Erreur lors de la création ou création du fichier")
+	fmt.Println("Fragment", fragment.name, ":", seededFiles, "fichiers et", seededChunks, "chunks copiés depuis les dossiers d'amorçage")
+	return neededChunks
+}
+
+// seedFile copie le fichier depuis les dossiers d'amorçage s'il y est présent
+func seedFile(seedIndex *seed.Index, fragmentOutput fragmentSink, file File) (bool, error) {
+	source, found, err := seedIndex.Open(file.hash)
+	if !found || err != nil {
+		return false, err
 	}
-	defer finalFile.Close()
-	// ecris les ddonnées dans le fichier
-	_, errWriteChunk := finalFile.WriteAt(bufferContent[:bundleChunk.size], fileOffset)
-	if errWriteChunk != nil {
-		return errors.New("Erreur lors de l'écriture du chunk")
+	defer source.Close()
+	if err := sink.WriteFile(fragmentOutput.output, fragmentOutput.name(file), file.size, file.executable, source); err != nil {
+		return false, err
 	}
-	return nil
+	return true, nil
 }
 
-func downloadBundleFile(downloadUrl string, destinationFile string) error {
-	res, err := http.Get(downloadUrl)
-	if err != nil {
-		return errors.New("Erreur de lien de telechargement d'un bundle " + err.Error())
+// isBundleNeeded indique si le bundle contient au moins un chunk qui doit être récupéré
+func isBundleNeeded(bundle Bundle, neededChunks map[string]bool) bool {
+	for _, chunk := range bundle.chunks {
+		if neededChunks[chunk.hash] {
+			return true
+		}
 	}
-	defer res.Body.Close()
+	return false
+}
 
-	file, errOpenFile := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if errOpenFile != nil {
-		return errors.New("Erreur lors de l'ouverture d'un fichier bundle" + errOpenFile.Error())
+func storeBundleChunks(objectStore *store.Store, bundle Bundle, fetch cytrus.Fetch, bundleFileContent io.ReaderAt) error {
+	readChunk := bundleChunkReader(bundleFileContent)
+	for _, chunk := range bundle.chunks {
+		// seules les parties téléchargées du bundle sont disponibles
+		if objectStore.Has(chunk.hash) || !fetch.Covers(chunk.offset, chunk.size) {
+			continue
+		}
+		chunkContent, err := readChunk(chunk)
+		if err != nil {
+			return err
+		}
+		if err := objectStore.Put(chunk.hash, chunkContent); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
+	return nil
+}
 
-	_, errCopyToFile := io.Copy(file, res.Body)
-	if errCopyToFile != nil {
-		return errors.New("Erreur lors de la copie du contenu vers le fichier" + errCopyToFile.Error())
+func extractChunkToFile(chunkContent []byte, fragmentOutput fragmentSink, file File, fileOffset int64) error {
+	// ouvre le fichier dans la sortie
+	finalFile, err := fragmentOutput.output.OpenFile(fragmentOutput.name(file), file.size, file.executable)
+	if err != nil {
+		return err
 	}
-	return nil
+	// ecris les ddonnées dans le fichier
+	_, errWriteChunk := finalFile.WriteAt(chunkContent, fileOffset)
+	errClose := finalFile.Close()
+	if errWriteChunk != nil {
+		return errors.New("Erreur lors de l'écriture du chunk")
+	}
+	return errClose
 }
@@ -1,15 +1,22 @@
 package cytrus6
 
 import (
+	"bytes"
+	"cytrusdownloader/cytrus"
 	"cytrusdownloader/cytrus6/flatbuffer"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"sort"
 	"strconv"
 )
 
+const (
+	CDN_URL = "https://cytrus.cdn.ankama.com"
+	// numéro de génération, préfixe 6.0_ des versions publiées par cette version de cytrus
+	Generation = 6
+)
+
 type Manifest struct {
 	fragments []Fragment
 }
@@ -40,19 +47,34 @@ type File struct {
 	symlink    string
 }
 
-func downloadManifest(game string, release string, platform string, version string) ([]byte, error) {
+func downloadManifest(options cytrus.Options) ([]byte, error) {
 	// télécharge le fichier de manifest
-	res, err := http.Get(fmt.Sprintf("https://cytrus.cdn.ankama.com/%s/releases/%s/%s/%s.manifest", game, release, platform, version))
-	if err != nil {
-		return []byte{}, errors.New("Erreur lors de la requete du téléchargement du fichier manifest, erreur:" + strconv.FormatInt(int64(res.StatusCode), 10))
+	var data bytes.Buffer
+	if err := Source(options).Fetch(ManifestPath(options), &data); err != nil {
+		return []byte{}, errors.New("Erreur lors de la requete du téléchargement du fichier manifest\n[ERREUR]: " + err.Error())
 	}
+	return data.Bytes(), nil
+}
 
-	defer res.Body.Close()
-	data, errReadBody := io.ReadAll(res.Body)
-	if errReadBody != nil {
-		return []byte{}, errors.New("Erreur lors de la lecture du corps de la requête")
+// Source renvoie l'origine des fichiers du cdn, par défaut le cdn de cytrus 6
+func Source(options cytrus.Options) cytrus.Source {
+	if options.Source != nil {
+		return options.Source
+	}
+	if options.CDNURL != "" {
+		return cytrus.NewSource(options.CDNURL)
 	}
-	return data, nil
+	return cytrus.HTTPSource{BaseURL: CDN_URL}
+}
+
+// ManifestPath renvoie le chemin du manifest de la version sur le cdn
+func ManifestPath(options cytrus.Options) string {
+	return fmt.Sprintf("%s/releases/%s/%s/%s.manifest", options.Game, options.Release, options.Platform, options.Version)
+}
+
+// BundlePath renvoie le chemin d'un bundle sur le cdn
+func BundlePath(game string, hash string) string {
+	return fmt.Sprintf("%s/bundles/%s/%s", game, hash[0:2], hash)
 }
 
 func extractManifestFromFileData(data []byte) Manifest {
@@ -120,3 +142,40 @@ func extractHash(obj HashObject) string {
 	}
 	return hash
 }
+
+// Entries renvoie les fichiers des fragments sélectionnés avec l'emplacement de leurs chunks dans les bundles
+func Entries(manifestData []byte, options cytrus.Options) ([]cytrus.Entry, error) {
+	manifestExtracted := extractManifestFromFileData(manifestData)
+	entries := []cytrus.Entry{}
+	for _, fragment := range manifestExtracted.fragments {
+		if !options.IsFragmentSelected(fragment.name) {
+			continue
+		}
+		// emplacement de chaque chunk dans les bundles du fragment
+		chunkLocations := make(map[string]cytrus.EntryChunk)
+		for _, bundle := range fragment.bundles {
+			for _, chunk := range bundle.chunks {
+				if _, exists := chunkLocations[chunk.hash]; !exists {
+					chunkLocations[chunk.hash] = cytrus.EntryChunk{Bundle: bundle.hash, BundlePath: BundlePath(options.Game, bundle.hash), BundleOffset: chunk.offset}
+				}
+			}
+		}
+		for _, file := range fragment.files {
+			entry := cytrus.Entry{Fragment: fragment.name, Name: file.name, Size: file.size, Hash: file.hash, Executable: file.executable, Symlink: file.symlink}
+			if file.symlink == "" {
+				for _, chunk := range fileChunks(file) {
+					location := chunkLocations[chunk.hash]
+					location.Hash = chunk.hash
+					location.Offset = chunk.offset
+					location.Size = chunk.size
+					entry.Chunks = append(entry.Chunks, location)
+				}
+				// les chunks sont rangés dans l'ordre du fichier, quel que soit leur ordre dans le manifest
+				sort.SliceStable(entry.Chunks, func(i, j int) bool { return entry.Chunks[i].Offset < entry.Chunks[j].Offset })
+			}
+			entries = append(entries, entry)
+		}
+	}
+	cytrus.SortEntries(entries)
+	return entries, nil
+}
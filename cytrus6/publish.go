@@ -0,0 +1,271 @@
+package cytrus6
+
+import (
+	"crypto/sha1"
+	"cytrusdownloader/cytrus"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// taille par défaut des chunks, les fichiers plus petits sont stockés en un seul morceau
+	DefaultChunkSize = 1 << 20
+	// taille visée par défaut des bundles
+	DefaultBundleSize = 32 << 20
+)
+
+// PublishOptions configure la publication d'un dossier au format cytrus 6
+type PublishOptions struct {
+	Game     string
+	Release  string
+	Platform string
+	Version  string
+	// racine du cdn généré, les bundles sont écrits dans <cdn>/<jeu>/bundles et le manifest dans <cdn>/<jeu>/releases
+	OutputDir string
+	// fragment unique dans lequel placer tout le dossier, sinon chaque sous-dossier est un fragment
+	Fragment   string
+	ChunkSize  int64
+	BundleSize int64
+}
+
+// PublishResult résume le contenu publié
+type PublishResult struct {
+	ManifestPath string
+	Fragments    int
+	Files        int
+	Chunks       int
+	// chunks identiques à un chunk déjà présent dans le fragment, ils ne sont stockés qu'une fois
+	DuplicateChunks int
+	Bundles         int
+	// octets des bundles écrits
+	BundlesSize int64
+}
+
+// Publish découpe les fichiers du dossier en chunks, les regroupe dans des bundles et écris le manifest de la version
+// le résultat a l'arborescence du cdn et peut être téléchargé par Cytrus6Downloader
+func Publish(inputDir string, options PublishOptions) (PublishResult, error) {
+	result := PublishResult{}
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = DefaultChunkSize
+	}
+	if options.BundleSize <= 0 {
+		options.BundleSize = DefaultBundleSize
+	}
+	fragmentNames, fragmentDirs, err := cytrus.PublishedFragments(inputDir, options.Fragment)
+	if err != nil {
+		return result, err
+	}
+	if err := os.MkdirAll(options.OutputDir, os.ModePerm); err != nil {
+		return result, errors.New("Erreur lors de la création du répertoire " + options.OutputDir)
+	}
+
+	manifest := Manifest{}
+	for _, fragmentName := range fragmentNames {
+		fragment, err := publishFragment(fragmentName, fragmentDirs[fragmentName], options, &result)
+		if err != nil {
+			return result, err
+		}
+		manifest.fragments = append(manifest.fragments, fragment)
+	}
+	result.Fragments = len(manifest.fragments)
+
+	manifestData, err := WriteManifest(manifest)
+	if err != nil {
+		return result, err
+	}
+	result.ManifestPath = filepath.Join(options.OutputDir, filepath.FromSlash(fmt.Sprintf("%s/releases/%s/%s/%s.manifest", options.Game, options.Release, options.Platform, options.Version)))
+	if err := os.MkdirAll(filepath.Dir(result.ManifestPath), os.ModePerm); err != nil {
+		return result, errors.New("Erreur lors de la création du répertoire " + filepath.Dir(result.ManifestPath))
+	}
+	if err := os.WriteFile(result.ManifestPath, manifestData, 0644); err != nil {
+		return result, errors.New("Impossible d'écrire le manifest " + result.ManifestPath + "\n[ERREUR]:" + err.Error())
+	}
+	return result, nil
+}
+
+func publishFragment(fragmentName string, fragmentDir string, options PublishOptions, result *PublishResult) (Fragment, error) {
+	fragment := Fragment{name: fragmentName}
+	writer := &bundleWriter{options: options, stored: map[string]bool{}}
+
+	err := filepath.WalkDir(fragmentDir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(fragmentDir, filePath)
+		if err != nil {
+			return err
+		}
+		file, err := writer.addFile(filePath, filepath.ToSlash(relativePath))
+		if err != nil {
+			return errors.New("Erreur lors de la publication du fichier " + filePath + "\n[ERREUR]:" + err.Error())
+		}
+		fragment.files = append(fragment.files, file)
+		return nil
+	})
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		writer.discard()
+		return fragment, err
+	}
+
+	fragment.bundles = writer.bundles
+	result.Files += len(fragment.files)
+	result.Chunks += writer.chunks
+	result.DuplicateChunks += writer.duplicates
+	result.Bundles += len(writer.bundles)
+	result.BundlesSize += writer.written
+	fmt.Println("Fragment", fragmentName, "publié:", len(fragment.files), "fichiers,", len(writer.bundles), "bundles")
+	return fragment, nil
+}
+
+// bundleWriter regroupe les chunks d'un fragment dans des bundles, un chunk déjà stocké n'est pas écrit à nouveau
+type bundleWriter struct {
+	options    PublishOptions
+	stored     map[string]bool
+	bundles    []Bundle
+	chunks     int
+	duplicates int
+	written    int64
+
+	// bundle en cours d'écriture
+	current     *os.File
+	currentHash hash.Hash
+	pending     Bundle
+	pendingSize int64
+}
+
+func (w *bundleWriter) addFile(filePath string, name string) (File, error) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return File{}, err
+	}
+	file := File{name: name, executable: info.Mode()&0111 != 0}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return File{}, err
+		}
+		file.executable = false
+		file.symlink = filepath.ToSlash(target)
+		return file, nil
+	}
+	if !info.Mode().IsRegular() {
+		return File{}, errors.New("le type de fichier n'est pas supporté")
+	}
+
+	content, err := os.Open(filePath)
+	if err != nil {
+		return File{}, err
+	}
+	defer content.Close()
+
+	fileHasher := sha1.New()
+	buffer := make([]byte, w.options.ChunkSize)
+	for offset := int64(0); ; {
+		n, err := io.ReadFull(content, buffer)
+		if err == io.EOF && offset > 0 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return File{}, err
+		}
+		chunkData := buffer[:n]
+		fileHasher.Write(chunkData)
+		chunkHash := sha1.Sum(chunkData)
+		file.chunks = append(file.chunks, Chunk{hash: hex.EncodeToString(chunkHash[:]), size: int64(n), offset: offset})
+		if err := w.addChunk(hex.EncodeToString(chunkHash[:]), chunkData); err != nil {
+			return File{}, err
+		}
+		offset += int64(n)
+		if n < len(buffer) {
+			break
+		}
+	}
+	file.size = info.Size()
+	file.hash = hex.EncodeToString(fileHasher.Sum(nil))
+	// un fichier d'un seul chunk n'a pas de chunk dans le manifest, son contenu est stocké sous le hash du fichier
+	if len(file.chunks) == 1 {
+		file.chunks = nil
+	}
+	return file, nil
+}
+
+func (w *bundleWriter) addChunk(chunkHash string, data []byte) error {
+	w.chunks++
+	if w.stored[chunkHash] {
+		w.duplicates++
+		return nil
+	}
+	if w.current == nil {
+		tmpFile, err := os.CreateTemp(w.options.OutputDir, "bundle-*")
+		if err != nil {
+			return err
+		}
+		w.current, w.currentHash = tmpFile, sha1.New()
+	}
+	if _, err := w.current.Write(data); err != nil {
+		return err
+	}
+	w.currentHash.Write(data)
+	w.pending.chunks = append(w.pending.chunks, Chunk{hash: chunkHash, size: int64(len(data)), offset: w.pendingSize})
+	w.pendingSize += int64(len(data))
+	w.stored[chunkHash] = true
+	if w.pendingSize >= w.options.BundleSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush termine le bundle en cours et le range sous son hash: <jeu>/bundles/<2 premiers caractères>/<hash>
+func (w *bundleWriter) flush() error {
+	if w.current == nil {
+		return nil
+	}
+	tmpPath := w.current.Name()
+	if err := w.current.Close(); err != nil {
+		return err
+	}
+	w.current = nil
+	w.pending.hash = hex.EncodeToString(w.currentHash.Sum(nil))
+	bundlePath := filepath.Join(w.options.OutputDir, filepath.FromSlash(BundlePath(w.options.Game, w.pending.hash)))
+	if err := os.MkdirAll(filepath.Dir(bundlePath), os.ModePerm); err != nil {
+		os.Remove(tmpPath)
+		return errors.New("Erreur lors de la création du répertoire " + filepath.Dir(bundlePath))
+	}
+	if err := os.Rename(tmpPath, bundlePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	w.bundles = append(w.bundles, w.pending)
+	w.written += w.pendingSize
+	w.pending, w.pendingSize = Bundle{}, 0
+	return nil
+}
+
+func (w *bundleWriter) discard() {
+	if w.current != nil {
+		w.current.Close()
+		os.Remove(w.current.Name())
+		w.current = nil
+	}
+}
+
+// PublishedVersion ajoute le préfixe de cytrus 6 à une version si elle ne l'a pas
+func PublishedVersion(version string) string {
+	prefix := cytrus.Version{Generation: Generation}.Prefix()
+	if strings.HasPrefix(version, prefix) {
+		return version
+	}
+	return prefix + version
+}
@@ -0,0 +1,148 @@
+package cytrus6
+
+import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/cytrus6/flatbuffer"
+	"encoding/hex"
+	"errors"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// WriteManifest convertit un manifest en flatbuffer, au format des fichiers .manifest du cdn
+func WriteManifest(manifest Manifest) ([]byte, error) {
+	builder := flatbuffers.NewBuilder(1024)
+
+	// les objets d'un flatbuffer sont construits avant l'objet qui les contient
+	fragmentOffsets := make([]flatbuffers.UOffsetT, len(manifest.fragments))
+	for i, fragment := range manifest.fragments {
+		offset, err := writeFragment(builder, fragment)
+		if err != nil {
+			return nil, err
+		}
+		fragmentOffsets[i] = offset
+	}
+	fragments := writeOffsetVector(builder, flatbuffer.ManifestStartFragmentsVector, fragmentOffsets)
+
+	flatbuffer.ManifestStart(builder)
+	flatbuffer.ManifestAddFragments(builder, fragments)
+	flatbuffer.FinishManifestBuffer(builder, flatbuffer.ManifestEnd(builder))
+	return builder.FinishedBytes(), nil
+}
+
+func writeFragment(builder *flatbuffers.Builder, fragment Fragment) (flatbuffers.UOffsetT, error) {
+	fileOffsets := make([]flatbuffers.UOffsetT, len(fragment.files))
+	for i, file := range fragment.files {
+		offset, err := writeFile(builder, file)
+		if err != nil {
+			return 0, errors.New("Erreur lors de l'écriture du fichier " + file.name + " du fragment " + fragment.name + "\n[ERREUR]:" + err.Error())
+		}
+		fileOffsets[i] = offset
+	}
+	bundleOffsets := make([]flatbuffers.UOffsetT, len(fragment.bundles))
+	for i, bundle := range fragment.bundles {
+		offset, err := writeBundle(builder, bundle)
+		if err != nil {
+			return 0, errors.New("Erreur lors de l'écriture du bundle " + bundle.hash + " du fragment " + fragment.name + "\n[ERREUR]:" + err.Error())
+		}
+		bundleOffsets[i] = offset
+	}
+	files := writeOffsetVector(builder, flatbuffer.FragmentStartFilesVector, fileOffsets)
+	bundles := writeOffsetVector(builder, flatbuffer.FragmentStartBundlesVector, bundleOffsets)
+	name := builder.CreateString(fragment.name)
+
+	flatbuffer.FragmentStart(builder)
+	flatbuffer.FragmentAddName(builder, name)
+	flatbuffer.FragmentAddFiles(builder, files)
+	flatbuffer.FragmentAddBundles(builder, bundles)
+	return flatbuffer.FragmentEnd(builder), nil
+}
+
+func writeFile(builder *flatbuffers.Builder, file File) (flatbuffers.UOffsetT, error) {
+	hash, err := writeHash(builder, file.hash)
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := writeChunks(builder, flatbuffer.FileStartChunksVector, file.chunks)
+	if err != nil {
+		return 0, err
+	}
+	name := builder.CreateString(file.name)
+	var symlink flatbuffers.UOffsetT
+	if file.symlink != "" {
+		symlink = builder.CreateString(file.symlink)
+	}
+
+	flatbuffer.FileStart(builder)
+	flatbuffer.FileAddName(builder, name)
+	flatbuffer.FileAddSize(builder, file.size)
+	flatbuffer.FileAddHash(builder, hash)
+	flatbuffer.FileAddChunks(builder, chunks)
+	flatbuffer.FileAddExecutable(builder, file.executable)
+	if file.symlink != "" {
+		flatbuffer.FileAddSymlink(builder, symlink)
+	}
+	return flatbuffer.FileEnd(builder), nil
+}
+
+func writeBundle(builder *flatbuffers.Builder, bundle Bundle) (flatbuffers.UOffsetT, error) {
+	hash, err := writeHash(builder, bundle.hash)
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := writeChunks(builder, flatbuffer.BundleStartChunksVector, bundle.chunks)
+	if err != nil {
+		return 0, err
+	}
+
+	flatbuffer.BundleStart(builder)
+	flatbuffer.BundleAddHash(builder, hash)
+	flatbuffer.BundleAddChunks(builder, chunks)
+	return flatbuffer.BundleEnd(builder), nil
+}
+
+func writeChunks(builder *flatbuffers.Builder, startVector func(*flatbuffers.Builder, int) flatbuffers.UOffsetT, chunks []Chunk) (flatbuffers.UOffsetT, error) {
+	chunkOffsets := make([]flatbuffers.UOffsetT, len(chunks))
+	for i, chunk := range chunks {
+		hash, err := writeHash(builder, chunk.hash)
+		if err != nil {
+			return 0, err
+		}
+		flatbuffer.ChunkStart(builder)
+		flatbuffer.ChunkAddHash(builder, hash)
+		flatbuffer.ChunkAddSize(builder, chunk.size)
+		flatbuffer.ChunkAddOffset(builder, chunk.offset)
+		chunkOffsets[i] = flatbuffer.ChunkEnd(builder)
+	}
+	return writeOffsetVector(builder, startVector, chunkOffsets), nil
+}
+
+// writeHash écris un hash hexadécimal sous forme d'octets, l'inverse de extractHash
+func writeHash(builder *flatbuffers.Builder, hash string) (flatbuffers.UOffsetT, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0, errors.New("Le hash " + hash + " n'est pas un hash hexadécimal valide")
+	}
+	return builder.CreateByteVector(hashBytes), nil
+}
+
+// writeOffsetVector écris un vecteur d'objets déjà construits, dans leur ordre d'origine
+func writeOffsetVector(builder *flatbuffers.Builder, startVector func(*flatbuffers.Builder, int) flatbuffers.UOffsetT, offsets []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	startVector(builder, len(offsets))
+	for i := len(offsets) - 1; i >= 0; i-- {
+		builder.PrependUOffsetT(offsets[i])
+	}
+	return builder.EndVector(len(offsets))
+}
+
+// FilterManifest renvoie un manifest qui ne contient que les fragments sélectionnés dans les options
+func FilterManifest(manifestData []byte, options cytrus.Options) ([]byte, error) {
+	manifestExtracted := extractManifestFromFileData(manifestData)
+	filtered := Manifest{}
+	for _, fragment := range manifestExtracted.fragments {
+		if options.IsFragmentSelected(fragment.name) {
+			filtered.fragments = append(filtered.fragments, fragment)
+		}
+	}
+	return WriteManifest(filtered)
+}
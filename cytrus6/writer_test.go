@@ -0,0 +1,110 @@
+package cytrus6
+
+import (
+	"cytrusdownloader/cytrus"
+	"reflect"
+	"testing"
+)
+
+func testManifest() Manifest {
+	return Manifest{fragments: []Fragment{
+		{
+			name: "main",
+			files: []File{
+				{name: "Dofus.exe", size: 6, hash: "aa01", executable: true, chunks: []Chunk{
+					{hash: "c001", size: 4, offset: 0},
+					{hash: "c002", size: 2, offset: 4},
+				}},
+				{name: "data/config.xml", size: 3, hash: "bb02"},
+				{name: "data/vide.txt", size: 0, hash: "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+				{name: "lib/libcurrent.so", hash: "cc03", symlink: "libcurrent.so.1"},
+			},
+			bundles: []Bundle{
+				{hash: "b0b1", chunks: []Chunk{{hash: "c001", size: 4, offset: 0}, {hash: "bb02", size: 3, offset: 4}}},
+				{hash: "b0b2", chunks: []Chunk{{hash: "c002", size: 2, offset: 0}}},
+			},
+		},
+		{name: "vide"},
+		{
+			name:    "lang_fr",
+			files:   []File{{name: "lang/fr.d2i", size: 5, hash: "dd04", chunks: []Chunk{{hash: "dd04", size: 5, offset: 0}}}},
+			bundles: []Bundle{{hash: "b0b3", chunks: []Chunk{{hash: "dd04", size: 5, offset: 0}}}},
+		},
+	}}
+}
+
+func TestWriteManifestRoundTrip(t *testing.T) {
+	manifests := map[string]Manifest{
+		"vide":        {},
+		"complet":     testManifest(),
+		"un fragment": {fragments: testManifest().fragments[:1]},
+	}
+	for name, manifest := range manifests {
+		data, err := WriteManifest(manifest)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if parsed := extractManifestFromFileData(data); !reflect.DeepEqual(parsed, manifest) {
+			t.Errorf("%s: le manifest relu est différent\n%+v\n%+v", name, parsed, manifest)
+		}
+	}
+}
+
+func TestWriteManifestRejectsInvalidHash(t *testing.T) {
+	manifest := testManifest()
+	manifest.fragments[0].files[1].hash = "pas un hash"
+	if _, err := WriteManifest(manifest); err == nil {
+		t.Error("un hash invalide doit être refusé")
+	}
+}
+
+func TestFilterManifestRoundTrip(t *testing.T) {
+	data, err := WriteManifest(testManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := FilterManifest(data, cytrus.Options{Fragments: []string{"lang_fr", "vide"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Manifest{fragments: []Fragment{testManifest().fragments[1], testManifest().fragments[2]}}
+	if parsed := extractManifestFromFileData(filtered); !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("le manifest filtré est différent\n%+v\n%+v", parsed, expected)
+	}
+
+	all, err := FilterManifest(data, cytrus.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed := extractManifestFromFileData(all); !reflect.DeepEqual(parsed, testManifest()) {
+		t.Errorf("sans sélection le manifest filtré doit contenir tous les fragments\n%+v", parsed)
+	}
+}
+
+func TestEntriesOrdersChunksByOffset(t *testing.T) {
+	manifest := testManifest()
+	chunks := manifest.fragments[0].files[0].chunks
+	chunks[0], chunks[1] = chunks[1], chunks[0]
+	data, err := WriteManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Entries(data, cytrus.Options{Game: "dofus", Fragments: []string{"main"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name != "Dofus.exe" {
+			continue
+		}
+		hashes := []string{}
+		for _, chunk := range entry.Chunks {
+			hashes = append(hashes, chunk.Hash)
+		}
+		if !reflect.DeepEqual(hashes, []string{"c001", "c002"}) {
+			t.Errorf("chunks de %s dans l'ordre %v", entry.Name, hashes)
+		}
+		return
+	}
+	t.Error("Dofus.exe absent des fichiers")
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/cytrus5"
+	"cytrusdownloader/cytrus6"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	CYTRUS_LAST_GAMES_VERSION = "https://cytrus.cdn.ankama.com/cytrus.json"
+	// catalogue des versions publiées par cytrus 5
+	CYTRUS5_LAST_GAMES_VERSION = "https://launcher.cdn.ankama.com/cytrus.json"
 )
 
 type Cytrus struct {
@@ -41,91 +53,394 @@ type Platform struct {
 	Darwin  map[string]string `json:"darwin,omitempty"`
 }
 
-func downloadLastCytrusJson() ([]byte, error) {
-	// télécharge le fichier de manifest
-	res, err := http.Get(CYTRUS_LAST_GAMES_VERSION)
-	if err != nil {
-		return []byte{}, errors.New("Erreur lors de la requete du téléchargement du fichier manifest, erreur: " + strconv.FormatInt(int64(res.StatusCode), 10))
+// Releases renvoie les releases de chaque plateforme disponible, indexées par le nom de la plateforme
+func (p Platform) Releases() map[string]map[string]string {
+	platforms := make(map[string]map[string]string)
+	if len(p.Windows) > 0 {
+		platforms["windows"] = p.Windows
+	}
+	if len(p.Linux) > 0 {
+		platforms["linux"] = p.Linux
+	}
+	if len(p.Darwin) > 0 {
+		platforms["darwin"] = p.Darwin
 	}
+	return platforms
+}
 
-	defer res.Body.Close()
-	data, errReadBody := io.ReadAll(res.Body)
-	if errReadBody != nil {
-		return []byte{}, errors.New("Erreur lors de la lecture du corps de la requête")
+// Releases renvoie les versions des assets indexées par le nom de la release
+func (m Meta) Releases() map[string]string {
+	releases := make(map[string]string)
+	if m.Main != "" {
+		releases["main"] = m.Main
+	}
+	if m.Beta != "" {
+		releases["beta"] = m.Beta
+	}
+	return releases
+}
+
+// Catalog contient le fichier cytrus.json, il n'est téléchargé qu'une seule fois par exécution
+// le catalogue de cytrus 5 n'est récupéré que lorsqu'une version absente du catalogue de cytrus 6 est recherchée
+type Catalog struct {
+	Cytrus
+	// indique que le catalogue provient du cache local sans avoir pu être revalidé
+	FromCache bool
+
+	options    *catalogOptions
+	legacyOnce sync.Once
+	legacy     *Cytrus
+}
+
+// catalogOptions regroupe les options de récupération du catalogue communes à toutes les commandes
+type catalogOptions struct {
+	url       string
+	legacyURL string
+	cacheDir  string
+	offline   bool
+}
+
+// useCDN remplace les catalogues par défaut par celui du cdn indiqué, un miroir ne contient qu'un seul catalogue
+func (o *catalogOptions) useCDN(cdnURL string) {
+	if cdnURL == "" {
+		return
+	}
+	if o.url == CYTRUS_LAST_GAMES_VERSION {
+		o.url = strings.TrimSuffix(cdnURL, "/") + "/cytrus.json"
+	}
+	if o.legacyURL == CYTRUS5_LAST_GAMES_VERSION {
+		o.legacyURL = ""
 	}
-	return data, nil
 }
 
-func getAvalaibleGameList() ([]string, error) {
-	lastcytrusjson, err := downloadLastCytrusJson()
+// informations de revalidation du fichier cytrus.json mis en cache
+type catalogCacheMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+func defaultCacheDir() string {
+	userCacheDir, err := os.UserCacheDir()
 	if err != nil {
-		return []string{}, err
+		return ".cache/cytrus-downloader"
 	}
+	return filepath.Join(userCacheDir, "cytrus-downloader")
+}
 
-	lastcytrusUnmarshal := Cytrus{}
-	if errorUnmarshal := json.Unmarshal(lastcytrusjson, &lastcytrusUnmarshal); errorUnmarshal != nil {
-		return []string{}, errorUnmarshal
+func addCatalogFlags(flags *flag.FlagSet) *catalogOptions {
+	options := &catalogOptions{}
+	flags.StringVar(&options.url, "catalog-url", CYTRUS_LAST_GAMES_VERSION, "Url du catalogue cytrus.json")
+	flags.StringVar(&options.legacyURL, "legacy-catalog-url", CYTRUS5_LAST_GAMES_VERSION, "Url du catalogue des versions publiées par cytrus 5, vide pour ne pas l'utiliser")
+	flags.StringVar(&options.cacheDir, "cache-dir", defaultCacheDir(), "Dossier de cache local (catalogue cytrus.json)")
+	flags.BoolVar(&options.offline, "offline", false, "N'utilise pas le réseau pour le catalogue, la dernière copie en cache est utilisée")
+	return options
+}
+
+func loadCatalog(options *catalogOptions) (*Catalog, error) {
+	data, fromCache, err := fetchCatalogData(options.url, "cytrus.json", options)
+	if err != nil {
+		return nil, err
 	}
+	catalog, err := parseCatalog(data, fromCache)
+	if err != nil {
+		return nil, err
+	}
+	if !fromCache && isRemoteCatalog(options.url) {
+		recordCatalogHistory(options.cacheDir, catalog, data)
+	}
+	catalog.options = options
+	return catalog, nil
+}
+
+func isRemoteCatalog(catalogURL string) bool {
+	return strings.HasPrefix(catalogURL, "http://") || strings.HasPrefix(catalogURL, "https://")
+}
 
-	gameList := []string{}
-	for gameName := range lastcytrusUnmarshal.Games {
-		gameList = append(gameList, gameName)
+// fetchCatalogData récupère un catalogue en le revalidant avec la copie conservée sous cacheName dans le dossier de cache
+// fromCache indique que la copie locale est utilisée sans avoir pu être revalidée
+func fetchCatalogData(catalogURL string, cacheName string, options *catalogOptions) (data []byte, fromCache bool, err error) {
+	if !isRemoteCatalog(catalogURL) {
+		// catalogue d'un cdn local, il est lu directement sans passer par le cache
+		data, err := os.ReadFile(catalogURL)
+		if err != nil {
+			return nil, false, errors.New("Impossible de lire le catalogue " + catalogURL + "\n[ERREUR]:" + err.Error())
+		}
+		return data, false, nil
+	}
+
+	cachePath := filepath.Join(options.cacheDir, cacheName)
+	metaPath := cachePath + ".meta"
+
+	cachedData, errReadCache := os.ReadFile(cachePath)
+	cacheMeta := catalogCacheMeta{}
+	if metaData, err := os.ReadFile(metaPath); err == nil {
+		json.Unmarshal(metaData, &cacheMeta)
 	}
 
-	return gameList, nil
+	if options.offline {
+		if errReadCache != nil {
+			return nil, false, errors.New("Erreur, aucun catalogue " + cacheName + " en cache dans " + options.cacheDir + ", lancez l'outil une fois sans -offline")
+		}
+		return cachedData, true, nil
+	}
+
+	if errReadCache != nil {
+		// sans copie locale, il ne faut pas envoyer les entêtes de revalidation
+		cacheMeta = catalogCacheMeta{}
+	}
+	data, newMeta, notModified, errDownload := downloadLastCytrusJson(catalogURL, cacheMeta)
+	if errDownload != nil {
+		if errReadCache != nil {
+			return nil, false, errDownload
+		}
+		fmt.Println("Impossible de télécharger le catalogue, utilisation de la copie en cache du", cacheMeta.FetchedAt.Format(time.DateTime), "\n[ERREUR]:", errDownload)
+		return cachedData, true, nil
+	}
+	if notModified {
+		data = cachedData
+	} else if _, err := parseCatalog(data, false); err != nil {
+		// un catalogue illisible ne doit pas remplacer la copie en cache
+		return nil, false, err
+	}
+
+	// le cache n'est qu'une optimisation, une erreur d'écriture n'empêche pas de continuer
+	if err := os.MkdirAll(options.cacheDir, os.ModePerm); err == nil {
+		if !notModified {
+			os.WriteFile(cachePath, data, 0644)
+		}
+		if metaData, err := json.Marshal(newMeta); err == nil {
+			os.WriteFile(metaPath, metaData, 0644)
+		}
+	}
+	return data, false, nil
+}
+
+func parseCatalog(data []byte, fromCache bool) (*Catalog, error) {
+	catalog := &Catalog{FromCache: fromCache}
+	if errorUnmarshal := json.Unmarshal(data, &catalog.Cytrus); errorUnmarshal != nil {
+		return nil, errors.New("Erreur lors de la lecture du catalogue cytrus.json " + errorUnmarshal.Error())
+	}
+	return catalog, nil
 }
 
-func isGameAvalaible(gameName string) (bool, error) {
-	gameExist := false
-	lastcytrusjson, err := downloadLastCytrusJson()
+func downloadLastCytrusJson(catalogURL string, cacheMeta catalogCacheMeta) ([]byte, catalogCacheMeta, bool, error) {
+	// télécharge le fichier de manifest, en le revalidant si une copie est en cache
+	req, err := http.NewRequest(http.MethodGet, catalogURL, nil)
 	if err != nil {
-		return false, err
+		return []byte{}, cacheMeta, false, err
+	}
+	if cacheMeta.ETag != "" {
+		req.Header.Set("If-None-Match", cacheMeta.ETag)
+	}
+	if cacheMeta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cacheMeta.LastModified)
 	}
 
-	lastcytrusUnmarshal := Cytrus{}
-	if errorUnmarshal := json.Unmarshal(lastcytrusjson, &lastcytrusUnmarshal); errorUnmarshal != nil {
-		return false, errorUnmarshal
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return []byte{}, cacheMeta, false, errors.New("Erreur lors de la requete du téléchargement du fichier cytrus.json " + err.Error())
 	}
+	defer res.Body.Close()
 
-	for cytrusGameName := range lastcytrusUnmarshal.Games {
-		if gameName == cytrusGameName {
-			gameExist = true
-			break
+	newMeta := catalogCacheMeta{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified"), FetchedAt: time.Now()}
+	if res.StatusCode == http.StatusNotModified {
+		if newMeta.ETag == "" {
+			newMeta.ETag = cacheMeta.ETag
+		}
+		if newMeta.LastModified == "" {
+			newMeta.LastModified = cacheMeta.LastModified
 		}
+		return []byte{}, newMeta, true, nil
 	}
+	if res.StatusCode != http.StatusOK {
+		return []byte{}, cacheMeta, false, errors.New("Erreur lors de la requete du téléchargement du fichier cytrus.json, erreur: " + strconv.FormatInt(int64(res.StatusCode), 10))
+	}
+
+	data, errReadBody := io.ReadAll(res.Body)
+	if errReadBody != nil {
+		return []byte{}, cacheMeta, false, errors.New("Erreur lors de la lecture du corps de la requête")
+	}
+	return data, newMeta, false, nil
+}
 
-	return gameExist, nil
+// Legacy renvoie le catalogue de cytrus 5, il n'est récupéré qu'une fois et une erreur n'empêche pas d'utiliser le catalogue de cytrus 6
+func (c *Catalog) Legacy() *Cytrus {
+	c.legacyOnce.Do(func() {
+		if c.options == nil || c.options.legacyURL == "" {
+			return
+		}
+		data, fromCache, err := fetchCatalogData(c.options.legacyURL, "cytrus5.json", c.options)
+		if err == nil {
+			var legacy *Catalog
+			if legacy, err = parseCatalog(data, fromCache); err == nil {
+				c.legacy = &legacy.Cytrus
+				return
+			}
+		}
+		fmt.Println("Impossible de récupérer le catalogue de cytrus 5\n[ERREUR]:", err)
+	})
+	return c.legacy
 }
 
-func getLastVersionOfGame(gameName string, platform string, release string) (string, error) {
+// catalogSource est un catalogue et la génération des versions qu'il publie sans préfixe
+type catalogSource struct {
+	cytrus     *Cytrus
+	generation int
+}
 
-	lastcytrusjson, err := downloadLastCytrusJson()
-	if err != nil {
-		return "", err
+// each parcourt le catalogue de cytrus 6 puis celui de cytrus 5 jusqu'à ce que visit renvoie vrai, le second n'est récupéré que s'il est nécessaire
+func (c *Catalog) each(visit func(source catalogSource) bool) {
+	if visit(catalogSource{cytrus: &c.Cytrus, generation: cytrus6.Generation}) {
+		return
+	}
+	if legacy := c.Legacy(); legacy != nil {
+		visit(catalogSource{cytrus: legacy, generation: cytrus5.Generation})
 	}
+}
 
-	lastcytrusUnmarshal := Cytrus{}
-	if errorUnmarshal := json.Unmarshal(lastcytrusjson, &lastcytrusUnmarshal); errorUnmarshal != nil {
-		return "", errorUnmarshal
+// game cherche le jeu dans le catalogue de cytrus 6 puis dans celui de cytrus 5
+func (c *Catalog) game(gameName string) (gameInfo Game, catalogGeneration int, found bool) {
+	c.each(func(source catalogSource) bool {
+		gameInfo, found = source.cytrus.Games[gameName]
+		catalogGeneration = source.generation
+		return found
+	})
+	return gameInfo, catalogGeneration, found
+}
+
+// taggedVersion renvoie la version avec le préfixe de sa génération, les versions sans préfixe appartiennent à la génération du catalogue
+func taggedVersion(version string, catalogGeneration int) (string, int) {
+	if parsed, err := cytrus.ParseVersion(version); err == nil {
+		return version, parsed.Generation
+	}
+	if parsed, err := cytrus.NewVersion(catalogGeneration, version); err == nil {
+		return parsed.String(), catalogGeneration
 	}
+	return version, catalogGeneration
+}
 
-	releasesAvalaible := make(map[string]string)
-	switch platform {
-	case "windows":
-		releasesAvalaible = lastcytrusUnmarshal.Games[gameName].Platforms.Windows
-	case "linux":
-		releasesAvalaible = lastcytrusUnmarshal.Games[gameName].Platforms.Linux
-	case "darwin":
-		releasesAvalaible = lastcytrusUnmarshal.Games[gameName].Platforms.Darwin
-	default:
+// GameList renvoie les jeux des catalogues de cytrus 6 et de cytrus 5
+func (c *Catalog) GameList() []string {
+	games := make(map[string]bool)
+	c.each(func(source catalogSource) bool {
+		for gameName := range source.cytrus.Games {
+			games[gameName] = true
+		}
+		return false
+	})
+	return sortedKeys(games)
+}
+
+func (c *Catalog) IsGameAvalaible(gameName string) bool {
+	_, _, gameExist := c.game(gameName)
+	return gameExist
+}
+
+func (c *Catalog) LastVersionOfGame(gameName string, platform string, release string) (string, error) {
+	return c.LastVersionOfGeneration(gameName, platform, release, 0)
+}
+
+// LastVersionOfGeneration renvoie la dernière version publiée par la génération de cytrus demandée, 0 pour la plus récente des générations
+// le catalogue de cytrus 6 est consulté en premier, celui de cytrus 5 seulement si la version n'y est pas trouvée
+func (c *Catalog) LastVersionOfGeneration(gameName string, platform string, release string, generation int) (string, error) {
+	if platform != "windows" && platform != "linux" && platform != "darwin" && platform != "meta" {
 		return "", errors.New("Erreur, la plateforme n'existe pas")
 	}
 
-	version, exists := releasesAvalaible[release]
-	if !exists {
-		return "", errors.New("Erreur, le nom de la release n'existe pas (généralement main ou beta)")
+	releaseFound := false
+	lastVersion := ""
+	c.each(func(source catalogSource) bool {
+		version, found := source.lastVersion(gameName, platform, release)
+		if !found {
+			return false
+		}
+		releaseFound = true
+		tagged, versionGeneration := taggedVersion(version, source.generation)
+		if generation != 0 && versionGeneration != generation {
+			return false
+		}
+		lastVersion = tagged
+		return true
+	})
+	if lastVersion != "" {
+		return lastVersion, nil
+	}
+	if releaseFound {
+		return "", errors.New("Erreur, aucune version de la release " + release + " publiée par cytrus " + strconv.Itoa(generation) + " n'est disponible pour " + gameName + " sur la plateforme " + platform)
 	}
+	return "", errors.New("Erreur, le nom de la release n'existe pas (généralement main ou beta)")
+}
 
-	return version, nil
+// lastVersion renvoie la version publiée dans ce catalogue pour le couple plateforme, release
+func (s catalogSource) lastVersion(gameName string, platform string, release string) (string, bool) {
+	gameInfo := s.cytrus.Games[gameName]
+	releasesAvalaible := gameInfo.Platforms.Releases()[platform]
+	if platform == "meta" {
+		// les assets ne dépendent pas d'une plateforme
+		releasesAvalaible = gameInfo.Assets.Metas.Releases()
+	}
+	version, exists := releasesAvalaible[release]
+	return version, exists
+}
+
+// CatalogRelease est une version publiée pour un couple plateforme, release
+type CatalogRelease struct {
+	Platform string
+	Release  string
+	Version  string
+	// version de cytrus qui a publié la version
+	Generation int
+}
 
+// ReleasesOfGame énumère les couples plateforme, release proposés par les catalogues de cytrus 6 et de cytrus 5 pour le jeu
+// all à la place de la plateforme ou de la release sélectionne toutes les valeurs disponibles,
+// seules les versions publiées par la génération demandée sont gardées, 0 pour toutes les générations
+// comme pour LastVersionOfGeneration, la version d'un couple est celle du premier catalogue qui le propose
+func (c *Catalog) ReleasesOfGame(gameName string, platform string, release string, generation int) ([]CatalogRelease, error) {
+	found := map[string]CatalogRelease{}
+	platformFound := false
+	c.each(func(source catalogSource) bool {
+		game, exists := source.cytrus.Games[gameName]
+		if !exists {
+			return false
+		}
+		platforms := game.Platforms.Releases()
+		if platform == "meta" {
+			platforms = map[string]map[string]string{"meta": game.Assets.Metas.Releases()}
+		}
+		for platformName, releases := range platforms {
+			if platform != "all" && platform != platformName {
+				continue
+			}
+			platformFound = true
+			for releaseName, version := range releases {
+				key := platformName + "/" + releaseName
+				if _, exists := found[key]; exists || (release != "all" && release != releaseName) {
+					continue
+				}
+				tagged, versionGeneration := taggedVersion(version, source.generation)
+				if generation != 0 && versionGeneration != generation {
+					continue
+				}
+				found[key] = CatalogRelease{Platform: platformName, Release: releaseName, Version: tagged, Generation: versionGeneration}
+			}
+		}
+		return false
+	})
+	if !platformFound {
+		return nil, errors.New("Erreur, la plateforme " + platform + " n'est pas disponible pour le jeu " + gameName)
+	}
+	if len(found) == 0 && generation != 0 {
+		return nil, errors.New("Erreur, aucune release " + release + " publiée par cytrus " + strconv.Itoa(generation) + " n'est disponible pour le jeu " + gameName + " sur la plateforme " + platform)
+	}
+	if len(found) == 0 {
+		return nil, errors.New("Erreur, aucune release " + release + " n'est disponible pour le jeu " + gameName + " sur la plateforme " + platform)
+	}
+
+	releases := make([]CatalogRelease, 0, len(found))
+	for _, key := range sortedKeys(found) {
+		releases = append(releases, found[key])
+	}
+	return releases, nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testCatalog renvoie un catalogue de cytrus 6 et un catalogue de cytrus 5 déjà récupéré
+func testCatalog() *Catalog {
+	catalog := &Catalog{Cytrus: Cytrus{Version: 6, Games: map[string]Game{
+		"dofus": {Platforms: Platform{
+			Windows: map[string]string{"main": "6.0_3.1", "beta": "6.0_3.2"},
+			Linux:   map[string]string{"main": "6.0_3.1"},
+		}},
+	}}}
+	catalog.legacy = &Cytrus{Version: 5, Games: map[string]Game{
+		"dofus": {Platforms: Platform{
+			Windows: map[string]string{"main": "2.70", "beta": "6.0_3.0"},
+			Darwin:  map[string]string{"main": "2.70"},
+		}},
+		"retro": {Platforms: Platform{Windows: map[string]string{"main": "1.29"}}},
+	}}
+	return catalog
+}
+
+func TestReleasesOfGame(t *testing.T) {
+	cases := []struct {
+		game, platform, release string
+		generation              int
+		expected                []CatalogRelease
+	}{
+		{"dofus", "all", "main", 0, []CatalogRelease{
+			{Platform: "darwin", Release: "main", Version: "5.0_2.70", Generation: 5},
+			{Platform: "linux", Release: "main", Version: "6.0_3.1", Generation: 6},
+			{Platform: "windows", Release: "main", Version: "6.0_3.1", Generation: 6},
+		}},
+		{"dofus", "windows", "all", 5, []CatalogRelease{
+			{Platform: "windows", Release: "main", Version: "5.0_2.70", Generation: 5},
+		}},
+		{"dofus", "all", "all", 5, []CatalogRelease{
+			{Platform: "darwin", Release: "main", Version: "5.0_2.70", Generation: 5},
+			{Platform: "windows", Release: "main", Version: "5.0_2.70", Generation: 5},
+		}},
+		{"dofus", "windows", "beta", 6, []CatalogRelease{
+			{Platform: "windows", Release: "beta", Version: "6.0_3.2", Generation: 6},
+		}},
+		{"retro", "all", "all", 0, []CatalogRelease{
+			{Platform: "windows", Release: "main", Version: "5.0_1.29", Generation: 5},
+		}},
+	}
+	for _, c := range cases {
+		releases, err := testCatalog().ReleasesOfGame(c.game, c.platform, c.release, c.generation)
+		if err != nil {
+			t.Errorf("%s %s %s cytrus %d: %v", c.game, c.platform, c.release, c.generation, err)
+			continue
+		}
+		if !reflect.DeepEqual(releases, c.expected) {
+			t.Errorf("%s %s %s cytrus %d:\n%+v\nau lieu de\n%+v", c.game, c.platform, c.release, c.generation, releases, c.expected)
+		}
+	}
+
+	if _, err := testCatalog().ReleasesOfGame("dofus", "linux", "all", 5); err == nil {
+		t.Error("dofus linux n'a pas de version publiée par cytrus 5")
+	}
+	if _, err := testCatalog().ReleasesOfGame("retro", "linux", "all", 0); err == nil {
+		t.Error("retro n'est pas disponible sur linux")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"cytrusdownloader/dedupe"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+)
+
+func init() {
+	commands["dedupe"] = command{description: "Remplace les fichiers identiques des versions déjà installées par des liens", run: dedupeCommand}
+}
+
+// openPool ouvre le dossier des copies partagées, situé dans le dossier de sortie pour que les liens restent sur le même système de fichiers
+// nil est renvoyé si la déduplication est désactivée
+func openPool(outDownload string, linkMode string) (*dedupe.Pool, error) {
+	mode, err := dedupe.ParseMode(linkMode)
+	if err != nil {
+		return nil, err
+	}
+	if mode == dedupe.ModeNone {
+		return nil, nil
+	}
+	return dedupe.Open(filepath.Join(outDownload, ".files"), mode)
+}
+
+func dedupeCommand(args []string) error {
+	var outDownload string
+	var linkMode string
+
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	flags.StringVar(&outDownload, "outdir", "out/", "Dossier de sortie des téléchargements, contenant les copies partagées")
+	flags.StringVar(&linkMode, "link", "hardlink", "Type de lien utilisé [hardlink|reflink|auto]")
+	flags.Parse(args)
+
+	pool, err := openPool(outDownload, linkMode)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		return errors.New("Erreur, veuillez indiquer un type de lien [hardlink|reflink|auto]")
+	}
+
+	// sans dossier précisé, toutes les installations du dossier de sortie sont dédupliquées
+	directories := flags.Args()
+	if len(directories) == 0 {
+		directories = []string{outDownload}
+	}
+
+	total := dedupe.Report{}
+	for _, directory := range directories {
+		report, err := pool.Tree(directory)
+		if err != nil {
+			return err
+		}
+		fmt.Println(directory, ":", report.Files, "fichiers,", report.Linked, "remplacés par un lien,", formatSize(report.Saved), "économisés")
+		total.Files += report.Files
+		total.Linked += report.Linked
+		total.Saved += report.Saved
+	}
+	fmt.Println("Total:", total.Files, "fichiers,", total.Linked, "remplacés par un lien,", formatSize(total.Saved), "économisés")
+	return nil
+}
@@ -0,0 +1,255 @@
+package dedupe
+
+import (
+	"cytrusdownloader/store"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mode indique comment les fichiers identiques sont partagés
+type Mode string
+
+const (
+	ModeNone     Mode = "none"
+	ModeHardlink Mode = "hardlink"
+	ModeReflink  Mode = "reflink"
+	// ModeAuto utilise un reflink quand le système de fichiers le supporte, un lien physique sinon
+	ModeAuto Mode = "auto"
+)
+
+// Pool contient une copie de chaque fichier rangée par hash: <dossier>/<2 premiers caractères>/<hash>
+// les fichiers des installations sont des liens vers ces copies
+type Pool struct {
+	dir  string
+	mode Mode
+}
+
+func ParseMode(value string) (Mode, error) {
+	switch Mode(strings.ToLower(value)) {
+	case "", ModeNone:
+		return ModeNone, nil
+	case ModeHardlink:
+		return ModeHardlink, nil
+	case ModeReflink:
+		return ModeReflink, nil
+	case ModeAuto:
+		return ModeAuto, nil
+	}
+	return ModeNone, errors.New("Erreur, le mode de déduplication " + value + " n'existe pas [none|hardlink|reflink|auto]")
+}
+
+func Open(dir string, mode Mode) (*Pool, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.New("Impossible de crée le dossier des fichiers partagés " + dir + "\n[ERREUR]:" + err.Error())
+	}
+	return &Pool{dir: dir, mode: mode}, nil
+}
+
+func (p *Pool) Dir() string {
+	return p.dir
+}
+
+func (p *Pool) path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(p.dir, hash)
+	}
+	return filepath.Join(p.dir, hash[0:2], hash)
+}
+
+// Link remplace le fichier filePath par un lien vers la copie partagée du contenu hash
+// si la copie n'existe pas encore, le fichier devient la copie partagée une fois son contenu vérifié
+// la taille économisée est renvoyée, elle vaut 0 si le fichier était déjà partagé
+func (p *Pool) Link(filePath string, hash string) (int64, error) {
+	return p.link(filePath, hash, false)
+}
+
+// link partage le fichier, verified indique que le hash vient d'être calculé depuis son contenu
+func (p *Pool) link(filePath string, hash string, verified bool) (int64, error) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return 0, errors.New("Impossible de lire le fichier " + filePath + "\n[ERREUR]:" + err.Error())
+	}
+	if !info.Mode().IsRegular() {
+		return 0, nil
+	}
+
+	sharedPath := p.path(hash)
+	sharedInfo, errShared := os.Stat(sharedPath)
+	if errShared != nil {
+		if err := os.MkdirAll(filepath.Dir(sharedPath), os.ModePerm); err != nil {
+			return 0, errors.New("Impossible de crée le dossier " + filepath.Dir(sharedPath) + "\n[ERREUR]:" + err.Error())
+		}
+		// le premier fichier rencontré devient la copie partagée, son contenu doit correspondre au hash
+		if !verified {
+			fileHash, err := hashFile(filePath, hash)
+			if err != nil {
+				return 0, errors.New("Impossible de lire le fichier " + filePath + "\n[ERREUR]:" + err.Error())
+			}
+			if fileHash != hash {
+				return 0, errors.New("Le contenu du fichier " + filePath + " ne correspond pas à son hash " + hash + " (" + fileHash + "), il n'est pas partagé")
+			}
+		}
+		if err := p.materialise(filePath, sharedPath); err != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	if os.SameFile(info, sharedInfo) {
+		return 0, nil
+	}
+	if sharedInfo.Size() != info.Size() {
+		return 0, errors.New("La taille du fichier " + filePath + " ne correspond pas à la copie partagée " + hash)
+	}
+
+	// le lien est créé à côté puis renommé pour ne jamais laisser le fichier absent
+	tmpPath := filePath + ".dedupe.tmp"
+	os.Remove(tmpPath)
+	if err := p.materialise(sharedPath, tmpPath); err != nil {
+		return 0, err
+	}
+	// un lien physique partage aussi les droits de la copie, ils ne sont changés que sur un fichier indépendant
+	tmpInfo, err := os.Stat(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, errors.New("Impossible de lire le fichier " + tmpPath + "\n[ERREUR]:" + err.Error())
+	}
+	if tmpInfo.Mode().Perm() != info.Mode().Perm() {
+		if os.SameFile(tmpInfo, sharedInfo) {
+			// les droits diffèrent de ceux de la copie partagée, le fichier garde son propre contenu
+			os.Remove(tmpPath)
+			return 0, nil
+		}
+		if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+			os.Remove(tmpPath)
+			return 0, errors.New("Impossible de changer les droits du fichier " + tmpPath + "\n[ERREUR]:" + err.Error())
+		}
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return 0, errors.New("Impossible de remplacer le fichier " + filePath + "\n[ERREUR]:" + err.Error())
+	}
+	return info.Size(), nil
+}
+
+// materialise crée destination avec le contenu de source suivant le mode du pool
+func (p *Pool) materialise(source string, destination string) error {
+	switch p.mode {
+	case ModeHardlink:
+		return hardlink(source, destination)
+	case ModeReflink:
+		return reflinkFile(source, destination)
+	case ModeAuto:
+		if err := reflinkFile(source, destination); err == nil {
+			return nil
+		}
+		return hardlink(source, destination)
+	}
+	return errors.New("Erreur, la déduplication n'est pas activée")
+}
+
+func hardlink(source string, destination string) error {
+	if err := os.Link(source, destination); err != nil {
+		return errors.New("Impossible de crée le lien " + destination + "\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
+
+func reflinkFile(source string, destination string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return errors.New("Impossible d'ouvrir le fichier " + source + "\n[ERREUR]:" + err.Error())
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return errors.New("Impossible de crée le fichier " + destination + "\n[ERREUR]:" + err.Error())
+	}
+	errClone := reflink(destinationFile, sourceFile)
+	destinationFile.Close()
+	if errClone != nil {
+		os.Remove(destination)
+		return errors.New("Le système de fichiers ne supporte pas les reflinks\n[ERREUR]:" + errClone.Error())
+	}
+	return nil
+}
+
+// BreakLink supprime le fichier s'il existe, pour qu'une nouvelle écriture ne modifie jamais une copie partagée
+func BreakLink(filePath string) error {
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New("Impossible de supprimer le fichier " + filePath + "\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
+
+// Report résume une déduplication
+type Report struct {
+	Files  int64
+	Linked int64
+	Saved  int64
+}
+
+// Tree déduplique tous les fichiers de root, le hash de chaque fichier est recalculé
+// le dossier du pool est ignoré s'il se trouve dans root
+func (p *Pool) Tree(root string) (Report, error) {
+	report := Report{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if sameDir(path, p.dir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		hash, err := store.HashFile(path)
+		if err != nil {
+			return err
+		}
+		saved, err := p.link(path, hash, true)
+		if err != nil {
+			return err
+		}
+		report.Files++
+		if saved > 0 {
+			report.Linked++
+			report.Saved += saved
+		}
+		return nil
+	})
+	if err != nil {
+		return report, errors.New("Erreur lors de la déduplication de " + root + "\n[ERREUR]:" + err.Error())
+	}
+	return report, nil
+}
+
+// hashFile calcule le hash du fichier avec l'algorithme correspondant à la longueur de expectedHash
+func hashFile(filePath string, expectedHash string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := store.NewHasher(expectedHash)
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func sameDir(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
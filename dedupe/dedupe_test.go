@@ -0,0 +1,104 @@
+package dedupe
+
+import (
+	"cytrusdownloader/store"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, filePath string, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(filePath, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filePath, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sameFile(t *testing.T, a string, b string) bool {
+	t.Helper()
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+func TestLinkSharesIdenticalFiles(t *testing.T) {
+	dir := t.TempDir()
+	pool, err := Open(filepath.Join(dir, "pool"), ModeHardlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := filepath.Join(dir, "a.bin"), filepath.Join(dir, "b.bin")
+	writeFile(t, first, "contenu partagé", 0644)
+	writeFile(t, second, "contenu partagé", 0644)
+	hash := store.HashData("0123456789012345678901234567890123456789", []byte("contenu partagé"))
+
+	if saved, err := pool.Link(first, hash); err != nil || saved != 0 {
+		t.Fatalf("premier fichier: %d, %v", saved, err)
+	}
+	if saved, err := pool.Link(second, hash); err != nil || saved != int64(len("contenu partagé")) {
+		t.Fatalf("second fichier: %d, %v", saved, err)
+	}
+	if !sameFile(t, first, second) || !sameFile(t, first, pool.path(hash)) {
+		t.Error("les deux fichiers doivent être des liens vers la copie partagée")
+	}
+}
+
+func TestLinkRejectsCorruptFirstCopy(t *testing.T) {
+	dir := t.TempDir()
+	pool, err := Open(filepath.Join(dir, "pool"), ModeHardlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt, valid := filepath.Join(dir, "corrompu.bin"), filepath.Join(dir, "valide.bin")
+	writeFile(t, corrupt, "contenu corrompu", 0644)
+	writeFile(t, valid, "contenu attendu", 0644)
+	hash := store.HashData("0123456789012345678901234567890123456789", []byte("contenu attendu"))
+
+	if _, err := pool.Link(corrupt, hash); err == nil {
+		t.Error("un fichier dont le contenu ne correspond pas au hash ne doit pas devenir la copie partagée")
+	}
+	if _, err := os.Stat(pool.path(hash)); !os.IsNotExist(err) {
+		t.Fatalf("la copie partagée a été créée: %v", err)
+	}
+	if _, err := pool.Link(valid, hash); err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(t, valid, pool.path(hash)) {
+		t.Error("le fichier valide doit devenir la copie partagée")
+	}
+}
+
+func TestLinkKeepsSharedMode(t *testing.T) {
+	dir := t.TempDir()
+	pool, err := Open(filepath.Join(dir, "pool"), ModeHardlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, executable := filepath.Join(dir, "data.bin"), filepath.Join(dir, "run.bin")
+	writeFile(t, shared, "même contenu", 0644)
+	writeFile(t, executable, "même contenu", 0755)
+	hash := store.HashData("0123456789012345678901234567890123456789", []byte("même contenu"))
+
+	if _, err := pool.Link(shared, hash); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := pool.Link(executable, hash); err != nil || saved != 0 {
+		t.Fatalf("fichier exécutable: %d, %v", saved, err)
+	}
+	info, err := os.Stat(pool.path(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("les droits de la copie partagée sont devenus %v", info.Mode().Perm())
+	}
+	if executableInfo, err := os.Stat(executable); err != nil || executableInfo.Mode().Perm() != 0755 || sameFile(t, executable, shared) {
+		t.Errorf("le fichier exécutable doit garder son propre contenu et ses droits: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package dedupe
+
+import (
+	"os"
+	"syscall"
+)
+
+// valeur de l'ioctl FICLONE de linux/fs.h
+const ficlone = 0x40049409
+
+func reflink(destination *os.File, source *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, destination.Fd(), ficlone, source.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dedupe
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(destination *os.File, source *os.File) error {
+	return errors.New("les reflinks ne sont supportés que sous linux")
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"cytrusdownloader/cytrus"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["export"] = command{description: "Crée une archive autonome d'une version pour une installation sans réseau", run: exportCommand}
+	commands["import"] = command{description: "Installe une version depuis une archive créée par export", run: importCommand}
+}
+
+const exportInfoName = "export.json"
+
+// exportInfo décrit le contenu d'une archive d'export, l'arborescence des autres fichiers est celle du cdn
+type exportInfo struct {
+	Game      string   `json:"game"`
+	Release   string   `json:"release"`
+	Platform  string   `json:"platform"`
+	Version   string   `json:"version"`
+	Fragments []string `json:"fragments,omitempty"`
+	Manifest  string   `json:"manifest"`
+	Objects   []string `json:"objects"`
+	Catalog   *Game    `json:"catalog,omitempty"`
+	// génération de cytrus du catalogue d'où provient l'entrée du jeu
+	CatalogGeneration int       `json:"catalogGeneration,omitempty"`
+	CreatedAt         time.Time `json:"createdAt"`
+}
+
+func exportCommand(args []string) error {
+	var output string
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	versionOpts := addVersionFlags(flags)
+	flags.StringVar(&output, "o", "", "Fichier d'archive créé, par défaut <jeu>_<plateforme>_<version>.tar")
+	flags.Parse(args)
+
+	options, err := versionOpts.options()
+	if err != nil {
+		return err
+	}
+	info := exportInfo{Game: options.Game, Release: options.Release, Platform: options.Platform, Version: options.Version, Fragments: options.Fragments, CreatedAt: time.Now()}
+	// l'entrée du jeu dans le catalogue est ajoutée à l'archive quand le catalogue est disponible
+	catalog, err := loadCatalog(versionOpts.catalog)
+	if err != nil {
+		fmt.Println("Le catalogue n'est pas disponible, il ne sera pas inclus dans l'archive\n[ERREUR]:", err)
+	} else {
+		gameInfo, catalogGeneration, found := catalog.game(options.Game)
+		if !found {
+			return errors.New("Le nom du jeu saisi n'existe pas")
+		}
+		info.Catalog = &gameInfo
+		info.CatalogGeneration = catalogGeneration
+	}
+
+	cytrusGeneration, err := generationOf(info.Version)
+	if err != nil {
+		return err
+	}
+	manifestData, err := cytrusGeneration.loadManifest(options)
+	if err != nil {
+		return err
+	}
+	info.Manifest = cytrusGeneration.manifestPath(options)
+	if info.Objects, err = cytrusGeneration.requiredObjects(manifestData, options); err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("%s_%s_%s.tar", options.Game, options.Platform, options.VersionNumber())
+	}
+	if err := writeExportArchive(output, info, manifestData, cytrusGeneration.source(options)); err != nil {
+		os.Remove(output)
+		return err
+	}
+	fmt.Println("Archive", output, "créée avec", len(info.Objects), "fichiers du cdn")
+	return nil
+}
+
+func writeExportArchive(output string, info exportInfo, manifestData []byte, source cytrus.Source) error {
+	archiveFile, err := os.Create(output)
+	if err != nil {
+		return errors.New("Impossible de crée l'archive " + output + "\n[ERREUR]:" + err.Error())
+	}
+	defer archiveFile.Close()
+	tarWriter := tar.NewWriter(archiveFile)
+
+	infoData, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tarWriter, exportInfoName, bytes.NewReader(infoData), int64(len(infoData))); err != nil {
+		return err
+	}
+	if err := writeTarEntry(tarWriter, info.Manifest, bytes.NewReader(manifestData), int64(len(manifestData))); err != nil {
+		return err
+	}
+
+	// chaque fichier est téléchargé dans un fichier temporaire, sa taille doit être connue avant de l'écrire dans l'archive
+	tmpFile, err := os.CreateTemp("", "cytrus-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	for i, object := range info.Objects {
+		fmt.Println("Export de", object, "(", i+1, "/", len(info.Objects), ")")
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := tmpFile.Truncate(0); err != nil {
+			return err
+		}
+		if err := source.Fetch(object, tmpFile); err != nil {
+			return err
+		}
+		size, err := tmpFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := writeTarEntry(tarWriter, object, tmpFile, size); err != nil {
+			return err
+		}
+	}
+	return tarWriter.Close()
+}
+
+func writeTarEntry(tarWriter *tar.Writer, name string, content io.Reader, size int64) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return errors.New("Erreur lors de l'écriture de " + name + " dans l'archive\n[ERREUR]:" + err.Error())
+	}
+	if _, err := io.CopyN(tarWriter, content, size); err != nil {
+		return errors.New("Erreur lors de l'écriture de " + name + " dans l'archive\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
+
+func importCommand(args []string) error {
+	var outDownload string
+	var linkMode string
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&outDownload, "outdir", "out/", "Emplacement de sortie de l'installation")
+	flags.StringVar(&linkMode, "link", "none", "Remplace les fichiers identiques entre les versions installées par des liens vers une copie partagée [none|hardlink|reflink|auto]")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Erreur, veuillez indiquer l'archive à importer")
+	}
+
+	// l'archive est extraite dans un dossier temporaire qui sert de cdn local
+	tmpDir, err := os.MkdirTemp("", "cytrus-import-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := extractExportArchive(flags.Arg(0), tmpDir); err != nil {
+		return err
+	}
+	infoData, err := os.ReadFile(filepath.Join(tmpDir, exportInfoName))
+	if err != nil {
+		return errors.New("L'archive ne contient pas de fichier " + exportInfoName)
+	}
+	info := exportInfo{}
+	if err := json.Unmarshal(infoData, &info); err != nil {
+		return errors.New("Erreur lors de la lecture de " + exportInfoName + "\n[ERREUR]:" + err.Error())
+	}
+
+	fmt.Println("Import de", info.Game, " plateforme:", info.Platform, " release:", info.Release, " version:", info.Version)
+	options := cytrus.Options{
+		Game:      info.Game,
+		Release:   info.Release,
+		Platform:  info.Platform,
+		Version:   info.Version,
+		OutputDir: outDownload,
+		Source:    cytrus.DirSource{Dir: tmpDir},
+		Fragments: info.Fragments,
+		Verify:    true,
+	}
+	manifestPath, err := info.validate(options)
+	if err != nil {
+		return err
+	}
+	options.ManifestFile = filepath.Join(tmpDir, filepath.FromSlash(manifestPath))
+	if options.Pool, err = openPool(outDownload, linkMode); err != nil {
+		return err
+	}
+	if err := downloadVersion(options); err != nil {
+		return err
+	}
+	fmt.Println("L'import s'est correctement terminé dans", options.ContentDestination())
+	return nil
+}
+
+// validate vérifie les informations de l'archive avant qu'elles servent de chemins: le jeu, la plateforme et la release
+// sont des noms simples, la version a le préfixe de sa génération et le manifest est celui de la version dans le cdn de l'archive
+func (info exportInfo) validate(options cytrus.Options) (string, error) {
+	for _, value := range []string{info.Game, info.Release, info.Platform} {
+		if !isPlainName(value) {
+			return "", errors.New("Erreur, l'archive est invalide: " + strconv.Quote(value) + " n'est pas un nom de jeu, de plateforme ou de release")
+		}
+	}
+	switch info.Platform {
+	case "windows", "linux", "darwin", "meta":
+	default:
+		return "", errors.New("Erreur, l'archive est invalide: la plateforme " + info.Platform + " n'existe pas [windows,linux,darwin,meta]")
+	}
+	if info.Catalog != nil {
+		releases := info.Catalog.Platforms.Releases()[info.Platform]
+		if info.Platform == "meta" {
+			releases = info.Catalog.Assets.Metas.Releases()
+		}
+		if _, exists := releases[info.Release]; !exists {
+			return "", errors.New("Erreur, l'archive est invalide: la release " + info.Release + " de " + info.Platform + " n'existe pas dans le catalogue de " + info.Game)
+		}
+	}
+	cytrusGeneration, err := generationOf(info.Version)
+	if err != nil {
+		return "", errors.New("Erreur, l'archive est invalide: " + strconv.Quote(info.Version) + " n'est pas une version\n[ERREUR]:" + err.Error())
+	}
+	if expected := cytrusGeneration.manifestPath(options); info.Manifest != expected {
+		return "", errors.New("Erreur, l'archive est invalide: le manifest " + info.Manifest + " n'est pas celui de la version (" + expected + ")")
+	}
+	return info.Manifest, nil
+}
+
+// isPlainName indique que la valeur peut être utilisée comme un seul élément d'un chemin
+func isPlainName(value string) bool {
+	return value != "" && value != "." && value != ".." && !strings.ContainsAny(value, `/\`) && !filepath.IsAbs(value)
+}
+
+func extractExportArchive(archivePath string, destination string) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return errors.New("Impossible d'ouvrir l'archive " + archivePath + "\n[ERREUR]:" + err.Error())
+	}
+	defer archiveFile.Close()
+
+	tarReader := tar.NewReader(archiveFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("Erreur lors de la lecture de l'archive " + archivePath + "\n[ERREUR]:" + err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// les chemins de l'archive doivent rester dans le dossier d'extraction
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.New("Le chemin " + header.Name + " de l'archive est invalide")
+		}
+		destinationFile := filepath.Join(destination, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(destinationFile), os.ModePerm); err != nil {
+			return err
+		}
+		file, err := os.Create(destinationFile)
+		if err != nil {
+			return err
+		}
+		_, errCopy := io.Copy(file, tarReader)
+		file.Close()
+		if errCopy != nil {
+			return errors.New("Erreur lors de l'extraction de " + header.Name + "\n[ERREUR]:" + errCopy.Error())
+		}
+	}
+}
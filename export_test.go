@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// packTestVersion publie une version de monmod windows dans le cdn local avec la commande pack
+func packTestVersion(t *testing.T, cdnDir string, generation string, content string) {
+	inputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "config.xml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := packCommand([]string{"-game", "monmod", "-platform", "windows", "-version", "1.0", "-generation", generation, "-fragment", "main", "-cdn-dir", cdnDir, inputDir}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImportGeneration(t *testing.T) {
+	cdnDir := t.TempDir()
+	packTestVersion(t, cdnDir, "5", "publiée par cytrus 5")
+
+	archive := filepath.Join(t.TempDir(), "monmod.tar")
+	if err := exportCommand([]string{"-game", "monmod", "-platform", "windows", "-generation", "5", "-cdn-url", cdnDir, "-cache-dir", t.TempDir(), "-o", archive}); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir() + "/"
+	if err := importCommand([]string{"-outdir", outDir, archive}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(outDir, "monmod", "1.0", "windows", "main", "config.xml"))
+	if err != nil || string(content) != "publiée par cytrus 5" {
+		t.Errorf("fichier importé: %q, %v", content, err)
+	}
+}
+
+// rewriteExportInfo recopie l'archive en remplaçant son export.json
+func rewriteExportInfo(t *testing.T, archive string, change func(info *exportInfo)) string {
+	source, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	rewritten := filepath.Join(t.TempDir(), "archive.tar")
+	output, err := os.Create(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	tarReader := tar.NewReader(source)
+	tarWriter := tar.NewWriter(output)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name == exportInfoName {
+			info := exportInfo{}
+			if err := json.Unmarshal(content, &info); err != nil {
+				t.Fatal(err)
+			}
+			change(&info)
+			if content, err = json.Marshal(info); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeTarEntry(tarWriter, header.Name, bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return rewritten
+}
+
+func TestImportRejectsInvalidArchive(t *testing.T) {
+	cdnDir := t.TempDir()
+	packTestVersion(t, cdnDir, "6", "publiée par cytrus 6")
+	archive := filepath.Join(t.TempDir(), "monmod.tar")
+	if err := exportCommand([]string{"-game", "monmod", "-platform", "windows", "-cdn-url", cdnDir, "-cache-dir", t.TempDir(), "-o", archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]func(info *exportInfo){
+		"jeu parent":        func(info *exportInfo) { info.Game = "../../evil" },
+		"jeu absolu":        func(info *exportInfo) { info.Game = "/tmp/evil" },
+		"plateforme":        func(info *exportInfo) { info.Platform = "windows/../../../evil" },
+		"plateforme connue": func(info *exportInfo) { info.Platform = "amiga" },
+		"release":           func(info *exportInfo) { info.Release = ".." },
+		"version":           func(info *exportInfo) { info.Version = "../../evil" },
+		"manifest parent":   func(info *exportInfo) { info.Manifest = "../../etc/passwd" },
+		"manifest absolu":   func(info *exportInfo) { info.Manifest = "/etc/passwd" },
+		"release inconnue":  func(info *exportInfo) { info.Catalog.Platforms.Windows = map[string]string{"beta": "6.0_1.0"} },
+	}
+	for name, change := range invalid {
+		// la sortie est deux niveaux sous base, rien ne doit être écrit ailleurs dans base
+		base := t.TempDir()
+		outDir := filepath.Join(base, "a", "b")
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := importCommand([]string{"-outdir", outDir + "/", rewriteExportInfo(t, archive, change)}); err == nil {
+			t.Errorf("%s: l'archive doit être refusée", name)
+		}
+		if written, _ := os.ReadDir(base); len(written) != 1 {
+			t.Errorf("%s: %d fichiers écrits hors de la sortie", name, len(written)-1)
+		}
+		if written, _ := os.ReadDir(outDir); len(written) > 0 {
+			t.Errorf("%s: %d fichiers écrits malgré l'erreur", name, len(written))
+		}
+	}
+
+	if err := importCommand([]string{"-outdir", t.TempDir() + "/", archive}); err != nil {
+		t.Errorf("l'archive d'origine doit être importée: %v", err)
+	}
+}
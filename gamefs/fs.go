@@ -0,0 +1,499 @@
+// Package gamefs présente une version d'un jeu comme un système de fichiers en lecture seule (io/fs)
+// les données ne sont téléchargées qu'à la lecture, seules les parties des bundles nécessaires sont récupérées
+package gamefs
+
+import (
+	"archive/tar"
+	"bytes"
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/store"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// taille maximale des objets cytrus 5 gardés en mémoire sans dépôt local, les moins récemment lus sont oubliés au-delà
+const maxObjectsSize = 64 << 20
+
+// FS est la vue d'une version: les fragments sont les dossiers de premier niveau
+// il implémente fs.FS, fs.ReadDirFS et fs.StatFS
+type FS struct {
+	source cytrus.Source
+	// dépôt local dans lequel les chunks et objets lus sont conservés, peut être nil
+	cache   *store.Store
+	files   map[string]cytrus.Entry
+	dirs    map[string][]string
+	modTime time.Time
+	// contenu des derniers objets cytrus 5 lus en entier, gardé en mémoire sans dépôt local
+	// objectsOrder va du moins récemment lu au plus récent, objectsSize ne dépasse pas objectsLimit
+	mu           sync.Mutex
+	objects      map[string][]byte
+	objectsOrder []string
+	objectsSize  int64
+	objectsLimit int64
+}
+
+// New crée la vue à partir des fichiers d'un manifest, obtenus avec cytrus5.Entries ou cytrus6.Entries
+func New(source cytrus.Source, entries []cytrus.Entry, cache *store.Store) *FS {
+	fsys := &FS{
+		source:       source,
+		cache:        cache,
+		files:        make(map[string]cytrus.Entry, len(entries)),
+		dirs:         map[string][]string{".": {}},
+		modTime:      time.Now(),
+		objects:      make(map[string][]byte),
+		objectsLimit: maxObjectsSize,
+	}
+	children := map[string]map[string]bool{".": {}}
+	for _, entry := range entries {
+		name := entry.Path()
+		fsys.files[name] = entry
+		// chaque dossier parent est ajouté jusqu'à la racine
+		for child, dir := name, path.Dir(name); ; child, dir = dir, path.Dir(dir) {
+			if children[dir] == nil {
+				children[dir] = map[string]bool{}
+			}
+			children[dir][path.Base(child)] = true
+			if dir == "." {
+				break
+			}
+		}
+	}
+	for dir, names := range children {
+		list := make([]string, 0, len(names))
+		for name := range names {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		fsys.dirs[dir] = list
+	}
+	return fsys
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, exists := fsys.files[name]; exists {
+		return &File{fsys: fsys, entry: entry}, nil
+	}
+	if _, exists := fsys.dirs[name]; exists {
+		return &dir{fsys: fsys, name: name}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, exists := fsys.files[name]; exists {
+		return fileInfo{entry: entry, modTime: fsys.modTime}, nil
+	}
+	if _, exists := fsys.dirs[name]; exists {
+		return dirInfo{name: path.Base(name), modTime: fsys.modTime}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	children, exists := fsys.dirs[name]
+	if !exists {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		info, err := fsys.Stat(path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// readChunk renvoie le contenu d'un chunk depuis le dépôt local ou en téléchargeant sa partie du bundle
+func (fsys *FS) readChunk(chunk cytrus.EntryChunk) ([]byte, error) {
+	if fsys.cache != nil && fsys.cache.Has(chunk.Hash) {
+		if content, err := fsys.cache.Read(chunk.Hash); err == nil && int64(len(content)) == chunk.Size {
+			return content, nil
+		}
+	}
+	if chunk.BundlePath == "" {
+		return nil, errors.New("Le chunk " + chunk.Hash + " ne fait partie d'aucun bundle")
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, chunk.Size))
+	if err := fsys.source.FetchRange(chunk.BundlePath, chunk.BundleOffset, chunk.Size, buffer); err != nil {
+		return nil, err
+	}
+	content := buffer.Bytes()
+	if store.HashData(chunk.Hash, content) != chunk.Hash {
+		return nil, errors.New("Le contenu du chunk " + chunk.Hash + " du bundle " + chunk.Bundle + " ne correspond pas à son hash")
+	}
+	if fsys.cache != nil {
+		fsys.cache.Put(chunk.Hash, content)
+	}
+	return content, nil
+}
+
+// readObject renvoie le contenu complet d'un fichier sans chunk (cytrus 5), depuis le dépôt local ou le cdn
+func (fsys *FS) readObject(entry cytrus.Entry) ([]byte, error) {
+	if content, exists := fsys.cachedObject(entry.Hash); exists {
+		return content, nil
+	}
+	if fsys.cache != nil && fsys.cache.Has(entry.Hash) {
+		if content, err := fsys.cache.Read(entry.Hash); err == nil && int64(len(content)) == entry.Size {
+			return content, nil
+		}
+	}
+
+	if entry.Pack != "" {
+		return fsys.readPack(entry)
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, entry.Size))
+	if err := cytrus.WriteEntry(fsys.source, entry, buffer); err != nil {
+		return nil, err
+	}
+	content := buffer.Bytes()
+	fsys.keep(entry.Hash, content)
+	return content, nil
+}
+
+// readPack télécharge le pack du fichier et garde tous les fichiers de la version qu'il contient,
+// le pack n'est pas relu pour les autres fichiers tant qu'ils sont dans le dépôt local ou en mémoire
+func (fsys *FS) readPack(entry cytrus.Entry) ([]byte, error) {
+	packed := map[string]bool{}
+	for _, file := range fsys.files {
+		if file.Pack == entry.Pack {
+			packed[file.Hash] = true
+		}
+	}
+	var pack bytes.Buffer
+	if err := fsys.source.Fetch(entry.Object, &pack); err != nil {
+		return nil, errors.New("Erreur lors du téléchargement du pack " + entry.Pack + "\n[ERREUR]:" + err.Error())
+	}
+
+	var content []byte
+	tarReader := tar.NewReader(&pack)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New("Erreur lors de la lecture du pack " + entry.Pack + "\n[ERREUR]:" + err.Error())
+		}
+		if header.Typeflag != tar.TypeReg || !packed[header.Name] {
+			continue
+		}
+		packedContent, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, errors.New("Erreur lors de la lecture de " + header.Name + " dans le pack " + entry.Pack + "\n[ERREUR]:" + err.Error())
+		}
+		if store.HashData(header.Name, packedContent) != header.Name {
+			return nil, errors.New("Le contenu de " + header.Name + " du pack " + entry.Pack + " ne correspond pas à son hash")
+		}
+		if header.Name == entry.Hash {
+			content = packedContent
+		}
+		fsys.keep(header.Name, packedContent)
+	}
+	if content == nil {
+		return nil, errors.New("Le fichier " + entry.Hash + " est absent du pack " + entry.Pack)
+	}
+	return content, nil
+}
+
+// keep garde le contenu d'un objet dans le dépôt local, ou en mémoire sans dépôt
+func (fsys *FS) keep(hash string, content []byte) {
+	if fsys.cache != nil {
+		fsys.cache.Put(hash, content)
+	} else {
+		fsys.keepObject(hash, content)
+	}
+}
+
+// cachedObject renvoie le contenu d'un objet gardé en mémoire et le marque comme le plus récemment lu
+func (fsys *FS) cachedObject(hash string) ([]byte, bool) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	content, exists := fsys.objects[hash]
+	if exists {
+		fsys.forgetObject(hash)
+		fsys.objects[hash] = content
+		fsys.objectsOrder = append(fsys.objectsOrder, hash)
+		fsys.objectsSize += int64(len(content))
+	}
+	return content, exists
+}
+
+// keepObject garde le contenu d'un objet en mémoire en oubliant les objets les moins récemment lus au-delà de objectsLimit,
+// un objet plus grand que la limite n'est pas gardé
+func (fsys *FS) keepObject(hash string, content []byte) {
+	size := int64(len(content))
+	if size > fsys.objectsLimit {
+		return
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.forgetObject(hash)
+	for len(fsys.objectsOrder) > 0 && fsys.objectsSize+size > fsys.objectsLimit {
+		fsys.forgetObject(fsys.objectsOrder[0])
+	}
+	fsys.objects[hash] = content
+	fsys.objectsOrder = append(fsys.objectsOrder, hash)
+	fsys.objectsSize += size
+}
+
+// forgetObject retire un objet de la mémoire, fsys.mu doit être verrouillé
+func (fsys *FS) forgetObject(hash string) {
+	content, exists := fsys.objects[hash]
+	if !exists {
+		return
+	}
+	delete(fsys.objects, hash)
+	fsys.objectsSize -= int64(len(content))
+	for i, kept := range fsys.objectsOrder {
+		if kept == hash {
+			fsys.objectsOrder = append(fsys.objectsOrder[:i], fsys.objectsOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// File est un fichier ouvert de la version, il implémente io.ReaderAt et io.Seeker
+// ReadAt peut être appelé en parallèle, Read et Seek partagent la position du fichier et ne le peuvent pas
+type File struct {
+	fsys   *FS
+	entry  cytrus.Entry
+	offset int64
+	// mu protège closed et les contenus gardés entre deux lectures
+	mu     sync.Mutex
+	closed bool
+	// dernier chunk lu, les lectures séquentielles réutilisent son contenu
+	lastChunk   cytrus.EntryChunk
+	lastContent []byte
+	// contenu d'un fichier sans chunk, gardé jusqu'à la fermeture même s'il est oublié par fsys
+	object []byte
+}
+
+func (f *File) Stat() (fs.FileInfo, error) {
+	return fileInfo{entry: f.entry, modTime: f.fsys.modTime}, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return 0, &fs.PathError{Op: "read", Path: f.entry.Path(), Err: fs.ErrClosed}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.entry.Path(), Err: fs.ErrInvalid}
+	}
+	if f.entry.Symlink != "" {
+		return 0, &fs.PathError{Op: "read", Path: f.entry.Path(), Err: errors.New("le fichier est un lien symbolique vers " + f.entry.Symlink)}
+	}
+	if offset >= f.entry.Size {
+		return 0, io.EOF
+	}
+	end := offset + int64(len(p))
+	if end > f.entry.Size {
+		end = f.entry.Size
+	}
+
+	if len(f.entry.Chunks) == 0 {
+		content, err := f.objectContent()
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.entry.Path(), Err: err}
+		}
+		n := copy(p, content[offset:end])
+		if end == f.entry.Size && n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	n := 0
+	for _, chunk := range f.entry.Chunks {
+		if chunk.Offset+chunk.Size <= offset || chunk.Offset >= end {
+			continue
+		}
+		content, err := f.chunkContent(chunk)
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: f.entry.Path(), Err: err}
+		}
+		start := max(offset, chunk.Offset)
+		stop := min(end, chunk.Offset+chunk.Size)
+		n += copy(p[start-offset:], content[start-chunk.Offset:stop-chunk.Offset])
+	}
+	if end == f.entry.Size && n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// objectContent renvoie le contenu complet d'un fichier sans chunk, il n'est lu qu'une fois tant que le fichier est ouvert
+func (f *File) objectContent() ([]byte, error) {
+	f.mu.Lock()
+	content := f.object
+	f.mu.Unlock()
+	if content != nil {
+		return content, nil
+	}
+	content, err := f.fsys.readObject(f.entry)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.object = content
+	f.mu.Unlock()
+	return content, nil
+}
+
+func (f *File) chunkContent(chunk cytrus.EntryChunk) ([]byte, error) {
+	f.mu.Lock()
+	if f.lastContent != nil && f.lastChunk.Hash == chunk.Hash {
+		content := f.lastContent
+		f.mu.Unlock()
+		return content, nil
+	}
+	f.mu.Unlock()
+	content, err := f.fsys.readChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.lastChunk, f.lastContent = chunk, content
+	f.mu.Unlock()
+	return content, nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.Size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.entry.Path(), Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.entry.Path(), Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.entry.Path(), Err: fs.ErrClosed}
+	}
+	f.closed = true
+	f.lastContent = nil
+	f.object = nil
+	return nil
+}
+
+// dir est un dossier ouvert de la version
+type dir struct {
+	fsys    *FS
+	name    string
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.fsys.Stat(d.name)
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("est un dossier")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+	remaining := d.entries[d.read:]
+	if count <= 0 {
+		d.read = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	d.read += count
+	return remaining[:count], nil
+}
+
+type fileInfo struct {
+	entry   cytrus.Entry
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return path.Base(i.entry.Name) }
+func (i fileInfo) Size() int64        { return i.entry.Size }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return false }
+func (i fileInfo) Sys() any           { return i.entry }
+
+func (i fileInfo) Mode() fs.FileMode {
+	switch {
+	case i.entry.Symlink != "":
+		return fs.ModeSymlink | 0777
+	case i.entry.Executable:
+		return 0755
+	}
+	return 0644
+}
+
+type dirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i dirInfo) Name() string       { return i.name }
+func (i dirInfo) Size() int64        { return 0 }
+func (i dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (i dirInfo) ModTime() time.Time { return i.modTime }
+func (i dirInfo) IsDir() bool        { return true }
+func (i dirInfo) Sys() any           { return nil }
+
+var (
+	_ fs.ReadDirFS   = (*FS)(nil)
+	_ fs.StatFS      = (*FS)(nil)
+	_ io.ReaderAt    = (*File)(nil)
+	_ io.Seeker      = (*File)(nil)
+	_ fs.ReadDirFile = (*dir)(nil)
+)
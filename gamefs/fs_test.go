@@ -0,0 +1,204 @@
+package gamefs
+
+import (
+	"bytes"
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/cytrus5"
+	"cytrusdownloader/cytrus6"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// testContent est le dossier publié, chaque sous-dossier est un fragment
+var testContent = map[string][]byte{
+	"main/config.xml":        []byte("<config/>"),
+	"main/data/items.d2o":    bytes.Repeat([]byte("items-0123456789"), 40),
+	"main/data/monsters.d2o": bytes.Repeat([]byte("monsters"), 90),
+	"main/data/copy.d2o":     bytes.Repeat([]byte("items-0123456789"), 40),
+	"lang/fr.txt":            []byte("bonjour"),
+	"lang/en.txt":            []byte("hello"),
+}
+
+func writeTestContent(t *testing.T) string {
+	t.Helper()
+	inputDir := t.TempDir()
+	for name, content := range testContent {
+		file := filepath.Join(inputDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inputDir
+}
+
+func testNames() []string {
+	names := make([]string, 0, len(testContent))
+	for name := range testContent {
+		names = append(names, name)
+	}
+	return names
+}
+
+func checkContent(t *testing.T, fsys fs.FS) {
+	t.Helper()
+	for name, expected := range testContent {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("lecture de %s: %v", name, err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Errorf("%s: contenu différent", name)
+		}
+	}
+}
+
+func newCytrus6FS(t *testing.T) *FS {
+	t.Helper()
+	cdnDir := t.TempDir()
+	result, err := cytrus6.Publish(writeTestContent(t), cytrus6.PublishOptions{
+		Game: "test", Release: "main", Platform: "windows", Version: "1.0", OutputDir: cdnDir,
+		ChunkSize: 128, BundleSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := os.ReadFile(result.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := cytrus6.Entries(manifestData, cytrus.Options{Game: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cytrus.NewSource(cdnDir), entries, nil)
+}
+
+func newCytrus5FS(t *testing.T) *FS {
+	t.Helper()
+	cdnDir := t.TempDir()
+	result, err := cytrus5.Publish(writeTestContent(t), cytrus5.PublishOptions{
+		Game: "test", Release: "main", Platform: "windows", Version: "1.0", OutputDir: cdnDir,
+		PackThreshold: 100, PackSize: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := os.ReadFile(result.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := cytrus5.Entries(manifestData, cytrus.Options{Game: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cytrus.NewSource(cdnDir), entries, nil)
+}
+
+func TestFSCytrus6(t *testing.T) {
+	fsys := newCytrus6FS(t)
+	if err := fstest.TestFS(fsys, testNames()...); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, fsys)
+}
+
+func TestFSCytrus5(t *testing.T) {
+	fsys := newCytrus5FS(t)
+	if err := fstest.TestFS(fsys, testNames()...); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, fsys)
+}
+
+func TestFSForgetsObjectsBeyondLimit(t *testing.T) {
+	fsys := newCytrus5FS(t)
+	fsys.objectsLimit = 700
+	checkContent(t, fsys)
+	checkContent(t, fsys)
+
+	total := int64(0)
+	for hash, content := range fsys.objects {
+		total += int64(len(content))
+		if int64(len(content)) > fsys.objectsLimit {
+			t.Errorf("l'objet %s dépasse la limite et ne doit pas être gardé", hash)
+		}
+	}
+	if total != fsys.objectsSize || total > fsys.objectsLimit {
+		t.Errorf("%d octets gardés en mémoire (%d comptés) pour une limite de %d", total, fsys.objectsSize, fsys.objectsLimit)
+	}
+	if len(fsys.objects) != len(fsys.objectsOrder) {
+		t.Errorf("%d objets gardés pour %d dans l'ordre de lecture", len(fsys.objects), len(fsys.objectsOrder))
+	}
+}
+
+func TestFileParallelReadAt(t *testing.T) {
+	for name, fsys := range map[string]*FS{"cytrus 6": newCytrus6FS(t), "cytrus 5": newCytrus5FS(t)} {
+		for fileName, expected := range testContent {
+			file, err := fsys.Open(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := file.(io.ReaderAt)
+			var wg sync.WaitGroup
+			for i := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// chaque lecture commence dans un chunk différent
+					offset := int64(i*97) % int64(len(expected))
+					buffer := make([]byte, len(expected)-int(offset))
+					if n, err := reader.ReadAt(buffer, offset); (err != nil && err != io.EOF) || !bytes.Equal(buffer[:n], expected[offset:]) {
+						t.Errorf("%s, %s: lecture à %d différente (%d octets, %v)", name, fileName, offset, n, err)
+					}
+				}()
+			}
+			wg.Wait()
+			file.Close()
+		}
+	}
+}
+
+// countingSource compte les téléchargements de chaque fichier du cdn
+type countingSource struct {
+	cytrus.Source
+	mutex   sync.Mutex
+	fetches map[string]int
+}
+
+func (s *countingSource) Fetch(path string, destination io.Writer) error {
+	s.mutex.Lock()
+	s.fetches[path]++
+	s.mutex.Unlock()
+	return s.Source.Fetch(path, destination)
+}
+
+func TestFSReadsEachPackOnce(t *testing.T) {
+	fsys := newCytrus5FS(t)
+	source := &countingSource{Source: fsys.source, fetches: map[string]int{}}
+	fsys.source = source
+	checkContent(t, fsys)
+	checkContent(t, fsys)
+
+	packs := map[string]bool{}
+	for _, entry := range fsys.files {
+		if entry.Pack != "" {
+			packs[entry.Object] = true
+		}
+	}
+	if len(packs) == 0 {
+		t.Fatal("la version de test ne contient aucun pack")
+	}
+	for pack := range packs {
+		if source.fetches[pack] != 1 {
+			t.Errorf("le pack %s a été téléchargé %d fois", pack, source.fetches[pack])
+		}
+	}
+}
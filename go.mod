@@ -2,4 +2,12 @@ module cytrusdownloader
 
 go 1.23.0
 
-require github.com/google/flatbuffers v24.3.25+incompatible
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/google/flatbuffers v24.3.25+incompatible
+	github.com/klauspost/compress v1.18.0
+	go.etcd.io/bbolt v1.4.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/history"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	commands["history"] = command{description: "Consulte l'historique local des versions vues dans le catalogue et des manifests téléchargés [versions|changes|find]", run: historyCommand}
+}
+
+// le fichier de l'historique ne peut être ouvert qu'une fois, les téléchargements simultanés l'utilisent chacun leur tour
+var historyMutex sync.Mutex
+
+func historyPath(cacheDir string) string {
+	return filepath.Join(cacheDir, "history.db")
+}
+
+// updateHistory ouvre l'historique le temps d'une mise à jour, l'historique n'est qu'une information en plus, une erreur n'empêche pas de continuer
+func updateHistory(cacheDir string, update func(db *history.DB) error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	db, err := history.Open(historyPath(cacheDir))
+	if err == nil {
+		err = update(db)
+		db.Close()
+	}
+	if err != nil {
+		fmt.Println("Impossible de mettre à jour l'historique des versions\n[ERREUR]:", err)
+	}
+}
+
+// recordCatalogHistory conserve le catalogue récupéré et les versions qu'il propose
+func recordCatalogHistory(cacheDir string, catalog *Catalog, catalogData []byte) {
+	versions := []history.VersionRecord{}
+	for gameName, gameInfo := range catalog.Games {
+		platforms := gameInfo.Platforms.Releases()
+		platforms["meta"] = gameInfo.Assets.Metas.Releases()
+		for platform, releases := range platforms {
+			for release, version := range releases {
+				versions = append(versions, history.VersionRecord{Game: gameName, Platform: platform, Release: release, Version: version})
+			}
+		}
+	}
+	updateHistory(cacheDir, func(db *history.DB) error {
+		return db.RecordCatalog(catalogData, versions, time.Now())
+	})
+}
+
+// manifestRecorder renvoie la fonction qui conserve chaque manifest téléchargé dans l'historique
+func manifestRecorder(cacheDir string) func(options cytrus.Options, manifestData []byte) {
+	return func(options cytrus.Options, manifestData []byte) {
+		cytrusGeneration, err := generationOf(options.Version)
+		if err != nil {
+			return
+		}
+		// tous les fragments sont conservés, quels que soient les fragments téléchargés
+		options.Fragments = nil
+		entries, err := cytrusGeneration.entries(manifestData, options)
+		if err != nil {
+			fmt.Println("Impossible d'ajouter le manifest à l'historique des versions\n[ERREUR]:", err)
+			return
+		}
+		files := make([]history.FileRecord, 0, len(entries))
+		for _, entry := range entries {
+			files = append(files, history.FileRecord{Path: entry.Path(), Size: entry.Size, Hash: entry.Hash})
+		}
+		version := history.VersionRecord{Game: options.Game, Platform: options.Platform, Release: options.Release, Version: options.Version}
+		updateHistory(cacheDir, func(db *history.DB) error {
+			return db.RecordManifest(version, manifestData, files, time.Now())
+		})
+	}
+}
+
+func historyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Erreur, veuillez indiquer une action [versions|changes|find]")
+	}
+	action := args[0]
+
+	var cacheDir string
+	var game string
+	var platform string
+	var release string
+	var format string
+
+	flags := flag.NewFlagSet("history "+action, flag.ExitOnError)
+	flags.StringVar(&cacheDir, "cache-dir", defaultCacheDir(), "Dossier de cache local qui contient l'historique")
+	flags.StringVar(&format, "format", "table", "Format de sortie [table|json]")
+	switch action {
+	case "versions":
+		flags.StringVar(&game, "game", "", "Affiche uniquement les versions de ce jeu")
+		flags.StringVar(&platform, "platform", "", "Affiche uniquement les versions de cette plateforme")
+		flags.StringVar(&release, "release", "", "Affiche uniquement les versions de cette release")
+	case "changes":
+		flags.StringVar(&game, "game", "", "Nom du jeu")
+		flags.StringVar(&platform, "platform", "", "Plateforme de la version [windows,linux,darwin,meta]")
+	case "find":
+	default:
+		return errors.New("Erreur, l'action " + action + " n'existe pas [versions|changes|find]")
+	}
+	flags.Parse(args[1:])
+	if format != "table" && format != "json" {
+		return errors.New("Erreur, le format " + format + " n'existe pas [table|json]")
+	}
+	game, platform, release = strings.ToLower(game), strings.ToLower(platform), strings.ToLower(release)
+
+	if _, err := os.Stat(historyPath(cacheDir)); err != nil {
+		return errors.New("Erreur, aucun historique dans " + cacheDir + ", il est créé lors de la récupération du catalogue et du téléchargement des manifests")
+	}
+	db, err := history.Open(historyPath(cacheDir))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result any
+	switch action {
+	case "versions":
+		records, err := db.Versions(game, platform, release)
+		if err != nil {
+			return err
+		}
+		result = records
+		if format == "table" {
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "JEU\tPLATEFORME\tRELEASE\tVERSION\tPREMIÈRE FOIS\tDERNIÈRE FOIS\tMANIFEST")
+			for _, record := range records {
+				manifest := "non"
+				if record.Manifest {
+					manifest = "oui"
+				}
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.Game, record.Platform, record.Release, record.Version, record.FirstSeen.Local().Format(time.DateTime), record.LastSeen.Local().Format(time.DateTime), manifest)
+			}
+			return writer.Flush()
+		}
+	case "changes":
+		if game == "" || platform == "" || flags.NArg() != 1 {
+			return errors.New("Erreur, veuillez indiquer le jeu, la plateforme et la version: history changes -game dofus -platform windows 6.0_3.0.12.5")
+		}
+		changes, err := db.Changes(game, platform, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		result = changes
+		if format == "table" {
+			if changes.Previous == "" {
+				fmt.Println("Aucune version précédente de", game, platform, "n'est connue, tous les fichiers de", changes.Version, "sont considérés comme ajoutés")
+			} else {
+				fmt.Println("Changements de", changes.Version, "par rapport à", changes.Previous)
+			}
+			for _, section := range []struct {
+				symbol string
+				files  []history.FileRecord
+			}{{"+", changes.Added}, {"~", changes.Modified}, {"-", changes.Removed}} {
+				for _, file := range section.files {
+					fmt.Printf("  %s %s (%s)\n", section.symbol, file.Path, formatSize(file.Size))
+				}
+			}
+			fmt.Println(len(changes.Added), "ajoutés,", len(changes.Modified), "modifiés,", len(changes.Removed), "supprimés")
+			return nil
+		}
+	case "find":
+		if flags.NArg() != 1 {
+			return errors.New("Erreur, veuillez indiquer le hash recherché")
+		}
+		records, err := db.FindHash(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		result = records
+		if format == "table" {
+			if len(records) == 0 {
+				fmt.Println("Aucune version connue ne contient le hash", flags.Arg(0))
+				return nil
+			}
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "JEU\tPLATEFORME\tVERSION\tFICHIER")
+			for _, record := range records {
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", record.Game, record.Platform, record.Version, record.Path)
+			}
+			return writer.Flush()
+		}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
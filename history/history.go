@@ -0,0 +1,338 @@
+package history
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"cytrusdownloader/cytrus"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// copies du catalogue cytrus.json, indexées par date de récupération
+	bucketCatalogs = []byte("catalogs")
+	// versions vues dans le catalogue ou téléchargées: <jeu>/<plateforme>/<release>/<version>
+	bucketVersions = []byte("versions")
+	// manifests téléchargés, tels que publiés sur le cdn: <jeu>/<plateforme>/<version>
+	bucketManifests = []byte("manifests")
+	// fichiers de chaque manifest: <jeu>/<plateforme>/<version>
+	bucketFiles = []byte("files")
+	// versions qui contiennent un hash: <hash>\x00<jeu>/<plateforme>/<version>\x00<fichier>
+	bucketHashes = []byte("hashes")
+)
+
+// les dates des copies du catalogue ont une largeur fixe pour être triées par ordre chronologique
+const catalogDateFormat = "2006-01-02T15:04:05.000000000Z"
+
+// DB est l'historique local des versions publiées par le cdn, qui ne conserve que la dernière version de chaque release
+type DB struct {
+	db *bolt.DB
+}
+
+// VersionRecord est une version d'une release, avec les dates de la première et de la dernière fois qu'elle a été vue
+type VersionRecord struct {
+	Game      string    `json:"game"`
+	Platform  string    `json:"platform"`
+	Release   string    `json:"release"`
+	Version   string    `json:"version"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// le manifest de la version a été téléchargé et ses fichiers sont connus
+	Manifest bool `json:"manifest"`
+}
+
+// FileRecord est un fichier d'une version
+type FileRecord struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// HashRecord est un fichier d'une version dont le contenu a le hash recherché
+type HashRecord struct {
+	Game     string `json:"game"`
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	Path     string `json:"path"`
+}
+
+// Changes décrit les fichiers modifiés par une version par rapport à la version précédente connue
+type Changes struct {
+	Version string `json:"version"`
+	// version précédente de la même plateforme, vide si aucune version précédente n'est connue
+	Previous string       `json:"previous"`
+	Added    []FileRecord `json:"added"`
+	Removed  []FileRecord `json:"removed"`
+	Modified []FileRecord `json:"modified"`
+}
+
+// Open ouvre ou crée l'historique, le fichier ne peut être ouvert que par un seul processus à la fois
+func Open(dbPath string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), os.ModePerm); err != nil {
+		return nil, errors.New("Erreur lors de la création du répertoire " + filepath.Dir(dbPath))
+	}
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errors.New("Impossible d'ouvrir l'historique des versions " + dbPath + "\n[ERREUR]:" + err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketCatalogs, bucketVersions, bucketManifests, bucketFiles, bucketHashes} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+func (h *DB) Close() error {
+	return h.db.Close()
+}
+
+func versionKey(game string, platform string, release string, version string) []byte {
+	return []byte(game + "/" + platform + "/" + release + "/" + version)
+}
+
+func manifestKey(game string, platform string, version string) string {
+	return game + "/" + platform + "/" + version
+}
+
+// seeVersion met à jour les dates de la version, elle est créée si elle n'est pas encore connue
+func seeVersion(tx *bolt.Tx, record VersionRecord, seenAt time.Time, manifest bool) error {
+	bucket := tx.Bucket(bucketVersions)
+	key := versionKey(record.Game, record.Platform, record.Release, record.Version)
+	if data := bucket.Get(key); data != nil {
+		existing := VersionRecord{}
+		if err := json.Unmarshal(data, &existing); err == nil {
+			record.FirstSeen = existing.FirstSeen
+			record.Manifest = existing.Manifest
+		}
+	}
+	if record.FirstSeen.IsZero() || seenAt.Before(record.FirstSeen) {
+		record.FirstSeen = seenAt
+	}
+	if seenAt.After(record.LastSeen) {
+		record.LastSeen = seenAt
+	}
+	record.Manifest = record.Manifest || manifest
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// RecordCatalog conserve le catalogue s'il a changé depuis la dernière copie et marque ses versions comme vues
+func (h *DB) RecordCatalog(catalogData []byte, versions []VersionRecord, seenAt time.Time) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		catalogs := tx.Bucket(bucketCatalogs)
+		_, last := catalogs.Cursor().Last()
+		if last == nil || sha1.Sum(last) != sha1.Sum(catalogData) {
+			if err := catalogs.Put([]byte(seenAt.UTC().Format(catalogDateFormat)), catalogData); err != nil {
+				return err
+			}
+		}
+		for _, record := range versions {
+			if err := seeVersion(tx, record, seenAt, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RecordManifest conserve le manifest de la version et indexe ses fichiers par hash
+func (h *DB) RecordManifest(version VersionRecord, manifestData []byte, files []FileRecord, seenAt time.Time) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		key := manifestKey(version.Game, version.Platform, version.Version)
+		manifests := tx.Bucket(bucketManifests)
+		if !bytes.Equal(manifests.Get([]byte(key)), manifestData) {
+			if err := manifests.Put([]byte(key), manifestData); err != nil {
+				return err
+			}
+			filesData, err := json.Marshal(files)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketFiles).Put([]byte(key), filesData); err != nil {
+				return err
+			}
+			hashes := tx.Bucket(bucketHashes)
+			for _, file := range files {
+				if err := hashes.Put([]byte(file.Hash+"\x00"+key+"\x00"+file.Path), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return seeVersion(tx, version, seenAt, true)
+	})
+}
+
+// Versions renvoie les versions connues, filtrées par jeu, plateforme et release s'ils sont indiqués, de la plus ancienne à la plus récente
+func (h *DB) Versions(game string, platform string, release string) ([]VersionRecord, error) {
+	records := []VersionRecord{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketVersions).ForEach(func(key []byte, data []byte) error {
+			record := VersionRecord{}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if (game == "" || record.Game == game) && (platform == "" || record.Platform == platform) && (release == "" || record.Release == release) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Game != b.Game {
+			return a.Game < b.Game
+		}
+		if a.Platform != b.Platform {
+			return a.Platform < b.Platform
+		}
+		if a.Release != b.Release {
+			return a.Release < b.Release
+		}
+		return lessVersion(a.Version, b.Version)
+	})
+	return records, err
+}
+
+// lessVersion ordonne les versions, une version invalide est rangée par ordre alphabétique
+func lessVersion(a string, b string) bool {
+	versionA, errA := cytrus.ParseVersion(a)
+	versionB, errB := cytrus.ParseVersion(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return versionA.Less(versionB)
+}
+
+// Files renvoie les fichiers de la version, found est faux si son manifest n'a jamais été téléchargé
+func (h *DB) Files(game string, platform string, version string) (files []FileRecord, found bool, err error) {
+	err = h.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketFiles).Get([]byte(manifestKey(game, platform, version)))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &files)
+	})
+	return files, found, err
+}
+
+// Manifest renvoie le manifest de la version tel que publié sur le cdn
+func (h *DB) Manifest(game string, platform string, version string) (manifestData []byte, found bool, err error) {
+	err = h.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketManifests).Get([]byte(manifestKey(game, platform, version))); data != nil {
+			manifestData, found = append([]byte{}, data...), true
+		}
+		return nil
+	})
+	return manifestData, found, err
+}
+
+// Changes compare les fichiers de la version à ceux de la version précédente dont le manifest est connu
+func (h *DB) Changes(game string, platform string, version string) (Changes, error) {
+	changes := Changes{Version: version, Added: []FileRecord{}, Removed: []FileRecord{}, Modified: []FileRecord{}}
+	files, found, err := h.Files(game, platform, version)
+	if err != nil {
+		return changes, err
+	}
+	if !found {
+		return changes, errors.New("Erreur, le manifest de la version " + version + " de " + game + " " + platform + " n'a jamais été téléchargé")
+	}
+
+	// la version précédente est la plus récente des versions antérieures dont le manifest est connu
+	err = h.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(game + "/" + platform + "/")
+		cursor := tx.Bucket(bucketFiles).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			candidate := strings.TrimPrefix(string(key), string(prefix))
+			if lessVersion(candidate, version) && (changes.Previous == "" || lessVersion(changes.Previous, candidate)) {
+				changes.Previous = candidate
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return changes, err
+	}
+	previousFiles := []FileRecord{}
+	if changes.Previous != "" {
+		if previousFiles, _, err = h.Files(game, platform, changes.Previous); err != nil {
+			return changes, err
+		}
+	}
+
+	previousByPath := map[string]FileRecord{}
+	for _, file := range previousFiles {
+		previousByPath[file.Path] = file
+	}
+	for _, file := range files {
+		previous, exists := previousByPath[file.Path]
+		if !exists {
+			changes.Added = append(changes.Added, file)
+		} else if previous.Hash != file.Hash {
+			changes.Modified = append(changes.Modified, file)
+		}
+		delete(previousByPath, file.Path)
+	}
+	for _, file := range previousByPath {
+		changes.Removed = append(changes.Removed, file)
+	}
+	for _, list := range [][]FileRecord{changes.Added, changes.Removed, changes.Modified} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return changes, nil
+}
+
+// FindHash renvoie les fichiers des versions connues dont le contenu a ce hash
+func (h *DB) FindHash(hash string) ([]HashRecord, error) {
+	records := []HashRecord{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(strings.ToLower(hash) + "\x00")
+		cursor := tx.Bucket(bucketHashes).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			parts := strings.SplitN(string(key[len(prefix):]), "\x00", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			location := strings.SplitN(parts[0], "/", 3)
+			if len(location) != 3 {
+				continue
+			}
+			records = append(records, HashRecord{Game: location[0], Platform: location[1], Version: location[2], Path: parts[1]})
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Catalogs renvoie les dates des copies conservées du catalogue
+func (h *DB) Catalogs() ([]time.Time, error) {
+	dates := []time.Time{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCatalogs).ForEach(func(key []byte, _ []byte) error {
+			date, err := time.Parse(catalogDateFormat, string(key))
+			if err == nil {
+				dates = append(dates, date)
+			}
+			return nil
+		})
+	})
+	return dates, err
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+func init() {
+	commands["ls"] = command{description: "Liste les fichiers d'une version à partir de son manifest, sans la télécharger", run: lsCommand}
+	commands["tree"] = command{description: "Affiche l'arborescence de chaque fragment d'une version", run: treeCommand}
+	commands["stat"] = command{description: "Affiche le détail d'un fichier d'une version: bundles ou pack et découpage en chunks", run: statCommand}
+}
+
+// loadEntries résout la version et renvoie les fichiers de son manifest
+func loadEntries(versionOpts *versionFlags) (cytrus.Options, []cytrus.Entry, error) {
+	options, err := versionOpts.options()
+	if err != nil {
+		return options, nil, err
+	}
+	cytrusGeneration, err := generationOf(options.Version)
+	if err != nil {
+		return options, nil, err
+	}
+	manifestData, err := cytrusGeneration.loadManifest(options)
+	if err != nil {
+		return options, nil, err
+	}
+	entries, err := cytrusGeneration.entries(manifestData, options)
+	return options, entries, err
+}
+
+// matchEntry indique si le chemin du fichier commence par pattern ou correspond au motif
+func matchEntry(entry cytrus.Entry, pattern string) bool {
+	if pattern == "" || strings.HasPrefix(entry.Path(), strings.TrimPrefix(pattern, "/")) {
+		return true
+	}
+	matched, _ := path.Match(pattern, entry.Path())
+	return matched
+}
+
+func lsCommand(args []string) error {
+	var long bool
+	var format string
+
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	versionOpts := addVersionFlags(flags)
+	flags.BoolVar(&long, "l", false, "Affiche la taille, le hash et le type de chaque fichier")
+	flags.StringVar(&format, "format", "text", "Format de sortie [text|json]")
+	flags.Parse(args)
+
+	_, entries, err := loadEntries(versionOpts)
+	if err != nil {
+		return err
+	}
+	matching := []cytrus.Entry{}
+	for _, entry := range entries {
+		if matchEntry(entry, flags.Arg(0)) {
+			matching = append(matching, entry)
+		}
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(matching)
+	case "text":
+		for _, entry := range matching {
+			if !long {
+				fmt.Println(entry.Path())
+				continue
+			}
+			kind := "-"
+			if entry.Symlink != "" {
+				kind = "l"
+			} else if entry.Executable {
+				kind = "x"
+			}
+			line := fmt.Sprintf("%s %12d %s %s", kind, entry.Size, entry.Hash, entry.Path())
+			if entry.Symlink != "" {
+				line += " -> " + entry.Symlink
+			}
+			fmt.Println(line)
+		}
+		return nil
+	}
+	return errors.New("Erreur, le format " + format + " n'existe pas")
+}
+
+// treeNode est un dossier de l'arborescence affichée par tree
+type treeNode struct {
+	dirs  map[string]*treeNode
+	files []cytrus.Entry
+	size  int64
+	count int
+}
+
+func newTreeNode() *treeNode {
+	return &treeNode{dirs: make(map[string]*treeNode)}
+}
+
+func (n *treeNode) add(parts []string, entry cytrus.Entry) {
+	n.size += entry.Size
+	n.count++
+	if len(parts) == 1 {
+		n.files = append(n.files, entry)
+		return
+	}
+	child, exists := n.dirs[parts[0]]
+	if !exists {
+		child = newTreeNode()
+		n.dirs[parts[0]] = child
+	}
+	child.add(parts[1:], entry)
+}
+
+func (n *treeNode) print(prefix string) {
+	type line struct {
+		name  string
+		dir   *treeNode
+		entry cytrus.Entry
+	}
+	lines := []line{}
+	for _, name := range sortedKeys(n.dirs) {
+		lines = append(lines, line{name: name, dir: n.dirs[name]})
+	}
+	for _, entry := range n.files {
+		lines = append(lines, line{name: path.Base(entry.Name), entry: entry})
+	}
+
+	for i, l := range lines {
+		branch, childPrefix := "├── ", "│   "
+		if i == len(lines)-1 {
+			branch, childPrefix = "└── ", "    "
+		}
+		if l.dir != nil {
+			fmt.Printf("%s%s%s/ (%d fichiers, %s)\n", prefix, branch, l.name, l.dir.count, formatSize(l.dir.size))
+			l.dir.print(prefix + childPrefix)
+			continue
+		}
+		details := formatSize(l.entry.Size)
+		if l.entry.Symlink != "" {
+			details = "-> " + l.entry.Symlink
+		} else if l.entry.Executable {
+			details += ", exécutable"
+		}
+		fmt.Printf("%s%s%s (%s)\n", prefix, branch, l.name, details)
+	}
+}
+
+func treeCommand(args []string) error {
+	flags := flag.NewFlagSet("tree", flag.ExitOnError)
+	versionOpts := addVersionFlags(flags)
+	flags.Parse(args)
+
+	options, entries, err := loadEntries(versionOpts)
+	if err != nil {
+		return err
+	}
+	fragments := map[string]*treeNode{}
+	for _, entry := range entries {
+		if !matchEntry(entry, flags.Arg(0)) {
+			continue
+		}
+		fragment, exists := fragments[entry.Fragment]
+		if !exists {
+			fragment = newTreeNode()
+			fragments[entry.Fragment] = fragment
+		}
+		fragment.add(strings.Split(entry.Name, "/"), entry)
+	}
+
+	fmt.Println(options.Game, options.Platform, options.Release, options.Version)
+	for _, name := range sortedKeys(fragments) {
+		fmt.Printf("%s/ (%d fichiers, %s)\n", name, fragments[name].count, formatSize(fragments[name].size))
+		fragments[name].print("")
+	}
+	return nil
+}
+
+func statCommand(args []string) error {
+	var format string
+
+	flags := flag.NewFlagSet("stat", flag.ExitOnError)
+	versionOpts := addVersionFlags(flags)
+	flags.StringVar(&format, "format", "text", "Format de sortie [text|json]")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Erreur, veuillez indiquer le fichier à afficher: <fragment>/<chemin>")
+	}
+	_, entries, err := loadEntries(versionOpts)
+	if err != nil {
+		return err
+	}
+	entry, found := cytrus.FindEntry(entries, flags.Arg(0))
+	if !found {
+		return errors.New("Erreur, le fichier " + flags.Arg(0) + " ne fait pas partie de la version")
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entry)
+	case "text":
+		printEntry(entry)
+		return nil
+	}
+	return errors.New("Erreur, le format " + format + " n'existe pas")
+}
+
+func printEntry(entry cytrus.Entry) {
+	fmt.Println("Fichier:", entry.Path())
+	fmt.Println("Taille:", entry.Size, "octets (", formatSize(entry.Size), ")")
+	fmt.Println("Hash:", entry.Hash)
+	fmt.Println("Exécutable:", entry.Executable)
+	if entry.Symlink != "" {
+		fmt.Println("Lien symbolique vers:", entry.Symlink)
+		return
+	}
+	if entry.Pack != "" {
+		fmt.Println("Pack:", entry.Pack, "(", entry.Object, ")")
+		return
+	}
+	if len(entry.Chunks) == 0 {
+		fmt.Println("Objet:", entry.Object)
+		return
+	}
+
+	containers := entry.Containers()
+	sort.Strings(containers)
+	fmt.Println("Bundles:", strings.Join(containers, ", "))
+	fmt.Println("Chunks:", len(entry.Chunks))
+	fmt.Printf("  %12s %10s  %-40s  %s\n", "position", "taille", "hash", "bundle@position")
+	for _, chunk := range entry.Chunks {
+		fmt.Printf("  %12d %10d  %-40s  %s@%d\n", chunk.Offset, chunk.Size, chunk.Hash, chunk.Bundle, chunk.BundleOffset)
+	}
+}
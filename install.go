@@ -0,0 +1,203 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	commands["rollback"] = command{description: "Fait pointer le lien current d'une installation versionnée vers la version précédente", run: rollbackCommand}
+}
+
+const (
+	currentLinkName = "current"
+	// versions activées de la plus ancienne à la plus récente
+	historyFileName = "history.json"
+)
+
+// currentVersion renvoie la version désignée par le lien current de l'installation
+func currentVersion(installRoot string) (string, bool) {
+	target, err := os.Readlink(filepath.Join(installRoot, currentLinkName))
+	if err != nil {
+		return "", false
+	}
+	return filepath.Base(target), true
+}
+
+// switchCurrent remplace le lien current de façon atomique: le nouveau lien est créé à côté puis renommé
+func switchCurrent(installRoot string, versionNumber string) error {
+	if _, err := os.Stat(filepath.Join(installRoot, "versions", versionNumber)); err != nil {
+		return errors.New("Erreur, la version " + versionNumber + " n'est pas installée dans " + installRoot)
+	}
+	tmpLink := filepath.Join(installRoot, currentLinkName+".tmp-"+strconv.Itoa(os.Getpid()))
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Join("versions", versionNumber), tmpLink); err != nil {
+		return errors.New("Impossible de crée le lien vers la version " + versionNumber + "\n[ERREUR]:" + err.Error())
+	}
+	if err := os.Rename(tmpLink, filepath.Join(installRoot, currentLinkName)); err != nil {
+		os.Remove(tmpLink)
+		return errors.New("Impossible de remplacer le lien " + currentLinkName + "\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
+
+func readHistory(installRoot string) []string {
+	history := []string{}
+	if data, err := os.ReadFile(filepath.Join(installRoot, historyFileName)); err == nil {
+		json.Unmarshal(data, &history)
+	}
+	return history
+}
+
+func saveHistory(installRoot string, history []string) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(installRoot, historyFileName), data, 0644)
+}
+
+// activateVersion fait pointer le lien current vers la version téléchargée et l'ajoute à l'historique
+func activateVersion(options cytrus.Options) error {
+	installRoot := options.InstallRoot()
+	versionNumber := options.VersionDirName()
+	if err := switchCurrent(installRoot, versionNumber); err != nil {
+		return err
+	}
+	history := []string{}
+	for _, version := range readHistory(installRoot) {
+		if version != versionNumber {
+			history = append(history, version)
+		}
+	}
+	if err := saveHistory(installRoot, append(history, versionNumber)); err != nil {
+		return errors.New("Impossible d'enregistrer l'historique des versions\n[ERREUR]:" + err.Error())
+	}
+	fmt.Println("La version", versionNumber, "est maintenant la version courante de", installRoot)
+	return nil
+}
+
+// prepareVersioned complète les options d'une installation versionnée:
+// les fichiers sont toujours vérifiés et la version courante sert de dossier d'amorçage
+func prepareVersioned(options *cytrus.Options, cacheDir string) {
+	options.Verify = true
+	if options.Seed != nil {
+		return
+	}
+	current, exists := currentVersion(options.InstallRoot())
+	if !exists || current == options.VersionDirName() {
+		return
+	}
+	seedIndex, err := openSeed([]string{filepath.Join(options.InstallRoot(), "versions", current)}, cacheDir)
+	if err != nil {
+		fmt.Println("La version courante", current, "ne peut pas servir de dossier d'amorçage\n[ERREUR]:", err)
+		return
+	}
+	options.Seed = seedIndex
+}
+
+// installedVersionDir renvoie le dossier installé de la version demandée, une version sans préfixe désigne
+// l'unique version installée avec ce numéro
+func installedVersionDir(installRoot string, version string) (string, error) {
+	if _, err := cytrus.ParseVersion(version); err == nil {
+		return version, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(installRoot, "versions"))
+	if err != nil {
+		return "", errors.New("Erreur, aucune version n'est installée dans " + installRoot)
+	}
+	matches := []string{}
+	for _, entry := range entries {
+		if parsed, err := cytrus.ParseVersion(entry.Name()); err == nil && parsed.Number == version {
+			matches = append(matches, entry.Name())
+		}
+	}
+	if len(matches) > 1 {
+		return "", errors.New("Erreur, plusieurs versions " + version + " sont installées (" + strings.Join(matches, ", ") + "), veuillez indiquer le préfixe de la génération")
+	}
+	if len(matches) == 0 {
+		return "", errors.New("Erreur, la version " + version + " n'est pas installée dans " + installRoot)
+	}
+	return matches[0], nil
+}
+
+func rollbackCommand(args []string) error {
+	var game string
+	var platform string
+	var outDownload string
+	var to string
+	var assets bool
+
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	flags.StringVar(&game, "game", "", "Nom du jeu")
+	flags.StringVar(&platform, "platform", runtime.GOOS, "Plateforme de l'installation [windows,linux,darwin]")
+	flags.StringVar(&outDownload, "outdir", "out/", "Emplacement de l'installation")
+	flags.BoolVar(&assets, "assets", false, "Utilise l'installation des assets du jeu (release meta)")
+	flags.StringVar(&to, "to", "", "Version vers laquelle revenir, par défaut la version activée précédemment")
+	flags.Parse(args)
+
+	if game == "" {
+		return errors.New("Erreur, veuillez indiquer le nom d'un jeu")
+	}
+	options := cytrus.Options{Game: strings.ToLower(game), Platform: strings.ToLower(platform), OutputDir: outDownload, Layout: cytrus.LayoutVersioned}
+	if assets {
+		options.Platform = "meta"
+	}
+	installRoot := options.InstallRoot()
+	current, exists := currentVersion(installRoot)
+	if !exists {
+		return errors.New("Erreur, " + installRoot + " n'est pas une installation versionnée")
+	}
+
+	// l'historique est parcouru depuis la version courante, les versions supprimées sont ignorées
+	history := readHistory(installRoot)
+	for len(history) > 0 && history[len(history)-1] != current {
+		history = history[:len(history)-1]
+	}
+	if len(history) > 0 {
+		history = history[:len(history)-1]
+	}
+	if to == "" {
+		for len(history) > 0 {
+			if _, err := os.Stat(filepath.Join(installRoot, "versions", history[len(history)-1])); err == nil {
+				break
+			}
+			history = history[:len(history)-1]
+		}
+		if len(history) == 0 {
+			return errors.New("Erreur, aucune version précédente n'est disponible pour " + installRoot)
+		}
+		to = history[len(history)-1]
+	} else {
+		var err error
+		if to, err = installedVersionDir(installRoot, to); err != nil {
+			return err
+		}
+		for i, version := range history {
+			if version == to {
+				history = history[:i+1]
+				break
+			}
+		}
+		if len(history) == 0 || history[len(history)-1] != to {
+			history = append(history, to)
+		}
+	}
+
+	if err := switchCurrent(installRoot, to); err != nil {
+		return err
+	}
+	if err := saveHistory(installRoot, history); err != nil {
+		return errors.New("Impossible d'enregistrer l'historique des versions\n[ERREUR]:" + err.Error())
+	}
+	fmt.Println("Retour de la version", current, "à la version", to, "pour", installRoot)
+	return nil
+}
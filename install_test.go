@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cytrusdownloader/cytrus"
+)
+
+func TestVersionDirNameKeepsTheGeneration(t *testing.T) {
+	legacy := cytrus.Options{Version: "5.0_3.0.1", Layout: cytrus.LayoutVersioned, OutputDir: "out/", Game: "dofus", Platform: "windows"}
+	current := legacy
+	current.Version = "6.0_3.0.1"
+	if legacy.ContentDestination() == current.ContentDestination() {
+		t.Fatalf("les versions 5.0_3.0.1 et 6.0_3.0.1 partagent le dossier %s", current.ContentDestination())
+	}
+}
+
+func TestInstalledVersionDir(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"5.0_3.0.1", "6.0_3.0.1", "6.0_3.1.0"} {
+		if err := os.MkdirAll(filepath.Join(root, "versions", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := map[string]string{"3.1.0": "6.0_3.1.0", "5.0_3.0.1": "5.0_3.0.1"}
+	for version, expected := range cases {
+		dir, err := installedVersionDir(root, version)
+		if err != nil || dir != expected {
+			t.Errorf("%s: %q, %v au lieu de %q", version, dir, err, expected)
+		}
+	}
+	if _, err := installedVersionDir(root, "3.0.1"); err == nil {
+		t.Error("3.0.1 est installée par les deux générations, la version doit être refusée")
+	}
+	if _, err := installedVersionDir(root, "2.70"); err == nil {
+		t.Error("2.70 n'est pas installée, la version doit être refusée")
+	}
+}
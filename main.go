@@ -1,11 +1,21 @@
 package main
 
 import (
+	"cytrusdownloader/cytrus"
 	"cytrusdownloader/cytrus5"
 	"cytrusdownloader/cytrus6"
+	"cytrusdownloader/dedupe"
+	"cytrusdownloader/seed"
+	"cytrusdownloader/sink"
+	"cytrusdownloader/store"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -42,74 +52,440 @@ import (
 */
 
 func main() {
-	var game string
-	var version string
-	var platform string
-	var release string
-	var manifestFile string
-	var outDownload string
-
-	flag.StringVar(&game, "game", "", "Nom du jeu à téléchager (liste non complète) [dofus|retro|wakfu]")
-	flag.StringVar(&version, "version", "latest", "Version précise à téléchargée, par défaut la dernière version est téléchargée")
-	flag.StringVar(&platform, "platform", runtime.GOOS, "Plateforme choisie, par défaut il s'agit de celle du système d'exploitation [windows,linux,darwin]")
-	flag.StringVar(&release, "release", "main", "Version à télécharger, main si n'est pas précisé [main|beta]")
-	flag.StringVar(&manifestFile, "manifest-file", "", "Utilise un fichier manifest en local plutot qu'aller le télécharger sur le cdn (Cytrus 6 seulement)")
-	flag.StringVar(&outDownload, "outdir", "out/", "Emplacement de sortie du téléchargement")
-	flag.Parse()
+	// si le premier argument n'est pas une option, il s'agit d'une sous commande
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// pour éviter les problèmes, on met tout en minuscule
-	game = strings.ToLower(game)
-	platform = strings.ToLower(platform)
-	release = strings.ToLower(release)
+	var output string
+	var s3Endpoint string
 
-	if game == "" {
-		gamelist, err := getAvalaibleGameList()
-		if err != nil {
-			fmt.Println("Erreur, veuillez indiquer le nom d'un jeu")
+	downloadOpts := addDownloadFlags(flag.CommandLine)
+	flag.StringVar(&output, "output", "", "Écris les fichiers dans une archive ou un bucket plutôt que dans outdir [<fichier>.tar|<fichier>.tar.zst|<fichier>.zip|s3://<bucket>/<préfixe>]")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "Adresse du stockage compatible S3, par défaut AWS_ENDPOINT_URL ou le service d'AWS")
+	flag.Parse()
+
+	if downloadOpts.fansOut() {
+		if output != "" {
+			fmt.Println("Erreur, l'option -output n'est pas disponible avec -platform all ou -release all")
+			return
+		}
+		if err := downloadAll(downloadOpts); err != nil {
+			fmt.Println(err)
 			return
 		}
-		fmt.Println("Erreur, veuillez indiquer un jeu, liste des jeux disponibles: ", gamelist)
+		fmt.Println("Les téléchargements se sont correctement terminés")
 		return
-	} else if version == "latest" {
-		gameExist, err := isGameAvalaible(game)
-		if err != nil {
-			fmt.Println("Erreur, lors de la vérification du jeu")
+	}
+
+	options, err := downloadOpts.options()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Informations sur les données à télécharger")
+	fmt.Println("Nom du jeu:", options.Game, " plateforme:", options.Platform, " release:", options.Release, " version:", options.Version)
+	if output != "" {
+		if options.Layout == cytrus.LayoutVersioned {
+			fmt.Println("Erreur, l'option -output n'est pas disponible pour une installation versionnée")
 			return
 		}
-		if gameExist == false {
-			fmt.Println("Le nom du jeu saisi n'existe pas")
+		if options.Pool != nil {
+			fmt.Println("Erreur, l'option -link n'est disponible que pour une installation dans outdir")
 			return
 		}
+		if options.Sink, err = sink.Open(output, options.ContentDestination(), s3Endpoint); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if err := installVersion(options); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Le téléchargement s'est correctement terminé")
+}
+
+// installVersion télécharge la version, ferme la sortie et active la version d'une installation versionnée
+func installVersion(options cytrus.Options) error {
+	errDownload := downloadVersion(options)
+	if err := options.Output().Close(); err != nil && errDownload == nil {
+		errDownload = err
+	}
+	if errDownload == nil && options.Layout == cytrus.LayoutVersioned {
+		// la version courante ne change qu'une fois la nouvelle version complète et vérifiée
+		errDownload = activateVersion(options)
+	}
+	return errDownload
+}
+
+// versionFlags regroupe les options qui désignent une version et son emplacement d'installation
+type versionFlags struct {
+	game         string
+	version      string
+	platform     string
+	release      string
+	manifestFile string
+	outDownload  string
+	assets       bool
+	fragments    stringList
+	layout       string
+	cdnURL       string
+	generation   int
+	catalog      *catalogOptions
+}
+
+func addVersionFlags(flags *flag.FlagSet) *versionFlags {
+	v := &versionFlags{}
+	flags.StringVar(&v.game, "game", "", "Nom du jeu à téléchager (liste non complète) [dofus|retro|wakfu]")
+	flags.StringVar(&v.version, "version", "latest", "Version précise à téléchargée, par défaut la dernière version est téléchargée")
+	flags.StringVar(&v.platform, "platform", runtime.GOOS, "Plateforme choisie, par défaut il s'agit de celle du système d'exploitation, all pour toutes les plateformes du jeu [windows,linux,darwin,all]")
+	flags.StringVar(&v.release, "release", "main", "Version à télécharger, main si n'est pas précisé, all pour toutes les releases du jeu [main|beta|all]")
+	flags.StringVar(&v.manifestFile, "manifest-file", "", "Utilise un fichier manifest en local plutot qu'aller le télécharger sur le cdn (Cytrus 6 seulement)")
+	flags.StringVar(&v.outDownload, "outdir", "out/", "Emplacement de sortie du téléchargement")
+	flags.BoolVar(&v.assets, "assets", false, "Télécharge les assets du jeu (release meta, indépendante de la plateforme) à la place du jeu")
+	flags.Var(&v.fragments, "fragments", "Fragments à télécharger séparés par des virgules, tous par défaut")
+	flags.StringVar(&v.layout, "layout", cytrus.LayoutFlat, "Organisation de l'installation, versioned place chaque version dans <outdir><jeu>/<plateforme>/versions/<version> avec un lien current vers la version utilisée [flat|versioned]")
+	flags.StringVar(&v.cdnURL, "cdn-url", "", "Adresse d'un autre cdn, url http ou dossier local ayant l'arborescence du cdn (miroir, version publiée avec pack)")
+	flags.IntVar(&v.generation, "generation", 0, "Version de cytrus qui a publié la version, 5 pour la dernière version publiée par cytrus 5, par défaut la génération la plus récente disponible [5|6]")
+	v.catalog = addCatalogFlags(flags)
+	return v
+}
+
+// options résout la version demandée
+func (v *versionFlags) options() (cytrus.Options, error) {
+	// pour éviter les problèmes, on met tout en minuscule
+	game := strings.ToLower(v.game)
+	platform := strings.ToLower(v.platform)
+	release := strings.ToLower(v.release)
+	version := v.version
+	if v.fansOut() {
+		return cytrus.Options{}, errors.New("Erreur, -platform all et -release all ne sont disponibles que pour le téléchargement")
+	}
+	if v.layout != cytrus.LayoutFlat && v.layout != cytrus.LayoutVersioned {
+		return cytrus.Options{}, errors.New("Erreur, l'organisation " + v.layout + " n'existe pas [flat|versioned]")
+	}
+	if v.assets {
+		// les assets sont publiés dans la release meta du catalogue
+		platform = "meta"
+	}
+
+	if v.generation != 0 {
+		if _, exists := generations[v.generation]; !exists {
+			return cytrus.Options{}, errors.New("Erreur, la génération " + strconv.Itoa(v.generation) + " de cytrus n'est pas supportée [5|6]")
+		}
+		if version != "latest" && v.manifestFile == "" {
+			if _, err := cytrus.ParseVersion(version); err != nil {
+				// une version sans préfixe prend celui de la génération demandée
+				if parsed, errNumber := cytrus.NewVersion(v.generation, version); errNumber == nil {
+					version = parsed.String()
+				}
+			}
+			if parsed, err := cytrus.ParseVersion(version); err == nil && parsed.Generation != v.generation {
+				return cytrus.Options{}, errors.New("Erreur, la version " + version + " n'a pas été publiée par cytrus " + strconv.Itoa(v.generation))
+			}
+		}
+	}
+
+	// le catalogue est celui du cdn indiqué
+	v.catalog.useCDN(v.cdnURL)
+
+	// le catalogue n'est récupéré qu'une fois et seulement s'il est nécessaire
+	var catalog *Catalog
+	if game == "" || version == "latest" {
+		var err error
+		catalog, err = loadCatalog(v.catalog)
+		if err != nil {
+			return cytrus.Options{}, errors.New("Erreur, lors de la récupération du catalogue des jeux\n[ERREUR]: " + err.Error())
+		}
+	}
+
+	if game == "" {
+		return cytrus.Options{}, errors.New("Erreur, veuillez indiquer un jeu, liste des jeux disponibles: " + strings.Join(catalog.GameList(), ", "))
+	} else if version == "latest" {
+		if catalog.IsGameAvalaible(game) == false {
+			return cytrus.Options{}, errors.New("Le nom du jeu saisi n'existe pas")
+		}
 	}
 
 	if version == "latest" {
 		// on récupère la dernière version
 		var err error
-		version, err = getLastVersionOfGame(game, platform, release)
+		version, err = catalog.LastVersionOfGeneration(game, platform, release, v.generation)
 		if err != nil {
-			fmt.Println("Impossible de vérifier la dernière version disponible du jeu")
-			return
+			return cytrus.Options{}, errors.New("Impossible de vérifier la dernière version disponible du jeu\n[ERREUR]:" + err.Error())
 		}
 	}
+	return cytrus.Options{ManifestFile: v.manifestFile, Game: game, Release: release, Platform: platform, Version: version, OutputDir: v.outDownload, Fragments: v.fragments, Layout: v.layout, CDNURL: v.cdnURL, OnManifest: manifestRecorder(v.catalog.cacheDir)}, nil
+}
 
-	fmt.Println("Informations sur les données à télécharger")
-	fmt.Println("Nom du jeu:", game, " plateforme:", platform, " release:", release, " version:", version)
+// fansOut indique que plusieurs couples plateforme, release sont demandés
+func (v *versionFlags) fansOut() bool {
+	return strings.ToLower(v.platform) == "all" || strings.ToLower(v.release) == "all"
+}
 
-	if strings.HasPrefix(version, "6.0_") {
-		if err := cytrus6.Cytrus6Downloader(manifestFile, game, release, platform, version, outDownload); err != nil {
-			fmt.Println(err)
-			return
+// allOptions résout chaque couple plateforme, release proposé par le catalogue pour -platform all et -release all
+// deux releases publiant la même version d'une plateforme ne sont téléchargées qu'une fois
+func (v *versionFlags) allOptions() ([]cytrus.Options, error) {
+	game := strings.ToLower(v.game)
+	platform := strings.ToLower(v.platform)
+	release := strings.ToLower(v.release)
+	if v.layout != cytrus.LayoutFlat && v.layout != cytrus.LayoutVersioned {
+		return nil, errors.New("Erreur, l'organisation " + v.layout + " n'existe pas [flat|versioned]")
+	}
+	if v.version != "latest" || v.manifestFile != "" {
+		return nil, errors.New("Erreur, -platform all et -release all téléchargent la dernière version de chaque release, -version et -manifest-file ne peuvent pas être utilisés")
+	}
+	if v.assets {
+		platform = "meta"
+	}
+	v.catalog.useCDN(v.cdnURL)
+
+	catalog, err := loadCatalog(v.catalog)
+	if err != nil {
+		return nil, errors.New("Erreur, lors de la récupération du catalogue des jeux\n[ERREUR]: " + err.Error())
+	}
+	if game == "" {
+		return nil, errors.New("Erreur, veuillez indiquer un jeu, liste des jeux disponibles: " + strings.Join(catalog.GameList(), ", "))
+	}
+	if !catalog.IsGameAvalaible(game) {
+		return nil, errors.New("Le nom du jeu saisi n'existe pas")
+	}
+	releases, err := catalog.ReleasesOfGame(game, platform, release, v.generation)
+	if err != nil {
+		return nil, err
+	}
+
+	allOptions := []cytrus.Options{}
+	downloaded := map[string]string{}
+	for _, catalogRelease := range releases {
+		key := catalogRelease.Platform + "/" + catalogRelease.Version
+		if otherRelease, exists := downloaded[key]; exists {
+			fmt.Println("La release", catalogRelease.Release, "de", catalogRelease.Platform, "est la même version que la release", otherRelease, "("+catalogRelease.Version+")")
+			continue
 		}
-		fmt.Println("Le téléchargement s'est correctement terminé")
-	} else if strings.HasPrefix(version, "5.0_") {
-		fmt.Println("Téléchargement depuis cytrus 5")
-		if err := cytrus5.Cytrus5Downloader(manifestFile, game, release, platform, version, outDownload); err != nil {
-			fmt.Println(err)
-			return
+		downloaded[key] = catalogRelease.Release
+		allOptions = append(allOptions, cytrus.Options{Game: game, Release: catalogRelease.Release, Platform: catalogRelease.Platform, Version: catalogRelease.Version, OutputDir: v.outDownload, Fragments: v.fragments, Layout: v.layout, CDNURL: v.cdnURL, OnManifest: manifestRecorder(v.catalog.cacheDir)})
+	}
+	return allOptions, nil
+}
+
+// pruneFlags regroupe les options de suppression des fichiers qui ne font plus partie du manifest
+type pruneFlags struct {
+	quarantine string
+	keep       stringList
+}
+
+func addPruneFlags(flags *flag.FlagSet) *pruneFlags {
+	p := &pruneFlags{}
+	flags.StringVar(&p.quarantine, "quarantine", "", "Déplace les fichiers retirés dans ce dossier au lieu de les supprimer")
+	flags.Var(&p.keep, "keep", "Motifs des fichiers utilisateur à conserver séparés par des virgules, par exemple *.log,*.ini,logs/")
+	return p
+}
+
+func (p *pruneFlags) options() *cytrus.PruneOptions {
+	return &cytrus.PruneOptions{Quarantine: p.quarantine, Keep: p.keep}
+}
+
+// downloadFlags regroupe les options de téléchargement communes à la commande principale et à la commande plan
+type downloadFlags struct {
+	*versionFlags
+	useStore   bool
+	linkMode   string
+	seedDirs   stringList
+	prune      bool
+	pruneFlags *pruneFlags
+}
+
+func addDownloadFlags(flags *flag.FlagSet) *downloadFlags {
+	d := &downloadFlags{versionFlags: addVersionFlags(flags)}
+	flags.BoolVar(&d.useStore, "store", false, "Utilise le dépôt local de chunks du dossier de cache pour ne télécharger que les données absentes")
+	flags.StringVar(&d.linkMode, "link", "", "Remplace les fichiers identiques entre les versions installées par des liens vers une copie partagée, auto par défaut pour une installation versionnée, none sinon [none|hardlink|reflink|auto]")
+	flags.Var(&d.seedDirs, "seed", "Dossier d'une autre version ou plateforme déjà installée (<outdir><jeu>/<version>/<plateforme>) dont les fichiers identiques sont copiés au lieu d'être téléchargés, peut être répété")
+	flags.BoolVar(&d.prune, "prune", false, "Supprime les fichiers des fragments qui ne font plus partie du manifest")
+	d.pruneFlags = addPruneFlags(flags)
+	return d
+}
+
+// options résout la version demandée et prépare les options du téléchargement
+func (d *downloadFlags) options() (cytrus.Options, error) {
+	options, err := d.versionFlags.options()
+	if err != nil {
+		return options, err
+	}
+	if d.useStore {
+		if options.Store, err = openStore(d.catalog.cacheDir); err != nil {
+			return options, err
+		}
+	}
+	if d.linkMode == "" && options.Layout == cytrus.LayoutVersioned {
+		// les versions d'une installation versionnée partagent leurs fichiers identiques
+		d.linkMode = string(dedupe.ModeAuto)
+	}
+	if options.Pool, err = openPool(d.outDownload, d.linkMode); err != nil {
+		return options, err
+	}
+	if len(d.seedDirs) > 0 {
+		if options.Seed, err = openSeed(d.seedDirs, d.catalog.cacheDir); err != nil {
+			return options, err
 		}
-		fmt.Println("Le téléchargement s'est correctement terminé")
-	} else {
-		fmt.Println("La version de cytrus indiquée est invalide")
 	}
+	if options.Layout == cytrus.LayoutVersioned {
+		prepareVersioned(&options, d.catalog.cacheDir)
+	}
+	if d.prune {
+		options.Prune = d.pruneFlags.options()
+	}
+	return options, nil
+}
+
+// downloadAll télécharge chaque couple plateforme, release demandé avec -platform all ou -release all
+// les fichiers identiques entre les plateformes sont partagés par des liens et les versions déjà installées servent de dossiers d'amorçage
+func downloadAll(d *downloadFlags) error {
+	allOptions, err := d.allOptions()
+	if err != nil {
+		return err
+	}
+	var objectStore *store.Store
+	if d.useStore {
+		if objectStore, err = openStore(d.catalog.cacheDir); err != nil {
+			return err
+		}
+	}
+	if d.linkMode == "" {
+		// la plupart des fichiers sont communs aux plateformes
+		d.linkMode = string(dedupe.ModeAuto)
+	}
+	pool, err := openPool(d.outDownload, d.linkMode)
+	if err != nil {
+		return err
+	}
+
+	seedDirs := append([]string{}, d.seedDirs...)
+	failed := 0
+	for _, options := range allOptions {
+		fmt.Println("Nom du jeu:", options.Game, " plateforme:", options.Platform, " release:", options.Release, " version:", options.Version)
+		options.Store = objectStore
+		options.Pool = pool
+		if len(seedDirs) > 0 {
+			if options.Seed, err = openSeed(seedDirs, d.catalog.cacheDir); err != nil {
+				return err
+			}
+		}
+		if options.Layout == cytrus.LayoutVersioned {
+			prepareVersioned(&options, d.catalog.cacheDir)
+		}
+		if d.prune {
+			options.Prune = d.pruneFlags.options()
+		}
+		if err := installVersion(options); err != nil {
+			fmt.Println("Erreur lors du téléchargement de", options.Platform, options.Release, "\n[ERREUR]:", err)
+			failed++
+			continue
+		}
+		seedDirs = append(seedDirs, options.ContentDestination())
+	}
+	if failed > 0 {
+		return errors.New("Erreur, " + strconv.Itoa(failed) + " téléchargements sur " + strconv.Itoa(len(allOptions)) + " ont échoué")
+	}
+	return nil
+}
+
+// generation regroupe les fonctions propres à une version de cytrus
+type generation struct {
+	name            string
+	download        func(options cytrus.Options) error
+	loadManifest    func(options cytrus.Options) ([]byte, error)
+	manifestPath    func(options cytrus.Options) string
+	source          func(options cytrus.Options) cytrus.Source
+	requiredObjects func(manifestData []byte, options cytrus.Options) ([]string, error)
+	listing         func(manifestData []byte, options cytrus.Options) (cytrus.Listing, error)
+	entries         func(manifestData []byte, options cytrus.Options) ([]cytrus.Entry, error)
+	plan            func(options cytrus.Options) (cytrus.Plan, error)
+	apply           func(plan cytrus.Plan, options cytrus.Options) error
+}
+
+// generations contient les versions de cytrus supportées, indexées par leur numéro de génération
+var generations = map[int]generation{}
+
+// registerGeneration ajoute une version de cytrus, les versions publiées avec le préfixe <numéro>.0_ lui sont confiées
+func registerGeneration(number int, cytrusGeneration generation) {
+	generations[number] = cytrusGeneration
+}
+
+func init() {
+	registerGeneration(cytrus6.Generation, generation{
+		name:         "cytrus 6",
+		download:     cytrus6.Cytrus6Downloader,
+		loadManifest: cytrus6.LoadManifestData,
+		manifestPath: cytrus6.ManifestPath,
+		source:       cytrus6.Source,
+		requiredObjects: func(manifestData []byte, options cytrus.Options) ([]string, error) {
+			return cytrus6.RequiredObjects(manifestData, options), nil
+		},
+		listing: cytrus6.Listing,
+		entries: cytrus6.Entries,
+		plan:    cytrus6.Plan,
+		apply:   cytrus6.Apply,
+	})
+	registerGeneration(cytrus5.Generation, generation{
+		name:            "cytrus 5",
+		download:        cytrus5.Cytrus5Downloader,
+		loadManifest:    cytrus5.LoadManifestData,
+		manifestPath:    cytrus5.ManifestPath,
+		source:          cytrus5.Source,
+		requiredObjects: cytrus5.RequiredObjects,
+		listing:         cytrus5.Listing,
+		entries:         cytrus5.Entries,
+		plan:            cytrus5.Plan,
+		apply:           cytrus5.Apply,
+	})
+}
+
+// generationOf choisit la version de cytrus en fonction du préfixe de la version
+func generationOf(version string) (generation, error) {
+	parsed, err := cytrus.ParseVersion(version)
+	if err != nil {
+		return generation{}, err
+	}
+	cytrusGeneration, exists := generations[parsed.Generation]
+	if !exists {
+		supported := []string{}
+		for number := range generations {
+			supported = append(supported, strconv.Itoa(number))
+		}
+		sort.Strings(supported)
+		return generation{}, errors.New("Erreur, la version " + version + " a été publiée par cytrus " + strconv.Itoa(parsed.Generation) + " qui n'est pas supporté, versions de cytrus supportées: " + strings.Join(supported, ", "))
+	}
+	return cytrusGeneration, nil
+}
+
+// downloadVersion choisit le téléchargeur en fonction de la version de cytrus
+func downloadVersion(options cytrus.Options) error {
+	if err := checkSeed(options); err != nil {
+		return err
+	}
+	cytrusGeneration, err := generationOf(options.Version)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Téléchargement depuis", cytrusGeneration.name)
+	return cytrusGeneration.download(options)
+}
+
+// checkSeed refuse un dossier d'amorçage qui serait aussi la destination du téléchargement
+func checkSeed(options cytrus.Options) error {
+	if destination, isDir := sink.Dir(options.Output()); isDir && options.Seed != nil && options.Seed.Contains(destination) {
+		return errors.New("Erreur, le dossier de destination ne peut pas être utilisé comme dossier d'amorçage")
+	}
+	return nil
+}
 
+// openSeed analyse les dossiers d'amorçage, les hash calculés sont conservés dans le dossier de cache
+func openSeed(seedDirs []string, cacheDir string) (*seed.Index, error) {
+	return seed.Build(seedDirs, filepath.Join(cacheDir, "seed-hashes.json"))
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus5"
+	"cytrusdownloader/cytrus6"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const (
+	// manifest cytrus 6 tel que publié sur le cdn
+	manifestFlatbuffer = "flatbuffer"
+	// manifest cytrus 6 au format json lisible
+	manifestJSON = "json"
+	// manifest json de cytrus 5
+	manifestCytrus5 = "cytrus5"
+)
+
+func init() {
+	commands["manifest"] = command{description: "Manipule les fichiers manifest [convert]", run: manifestCommand}
+}
+
+func manifestCommand(args []string) error {
+	if len(args) == 0 || args[0] != "convert" {
+		return errors.New("Erreur, veuillez indiquer une action [convert]")
+	}
+
+	var from string
+	var to string
+	var output string
+
+	flags := flag.NewFlagSet("manifest convert", flag.ExitOnError)
+	flags.StringVar(&from, "from", "auto", "Format du manifest lu, détecté à partir de son contenu par défaut [auto|flatbuffer|json|cytrus5]")
+	flags.StringVar(&to, "to", manifestJSON, "Format du manifest écrit [flatbuffer|json|cytrus5]")
+	flags.StringVar(&output, "o", "", "Fichier dans lequel écrire le manifest converti, la sortie standard par défaut")
+	flags.Parse(args[1:])
+
+	if flags.NArg() != 1 {
+		return errors.New("Erreur, veuillez indiquer le manifest à convertir")
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return errors.New("Impossible de lire le manifest " + flags.Arg(0) + "\n[ERREUR]:" + err.Error())
+	}
+	if from == "auto" {
+		from = detectManifestFormat(data)
+	}
+
+	converted, err := convertManifest(data, from, to)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		_, err := os.Stdout.Write(converted)
+		return err
+	}
+	if err := os.WriteFile(output, converted, 0644); err != nil {
+		return errors.New("Impossible d'écrire le manifest " + output + "\n[ERREUR]:" + err.Error())
+	}
+	fmt.Println("Manifest", from, "converti en", to, "dans", output)
+	return nil
+}
+
+// detectManifestFormat distingue un manifest json lisible, dont les fragments sont une liste, d'un manifest cytrus 5 dont les fragments sont indexés par nom
+func detectManifestFormat(data []byte) string {
+	if !json.Valid(data) {
+		return manifestFlatbuffer
+	}
+	probe := struct {
+		Fragments json.RawMessage `json:"fragments"`
+	}{}
+	if err := json.Unmarshal(data, &probe); err == nil && len(probe.Fragments) > 0 && probe.Fragments[0] == '[' {
+		return manifestJSON
+	}
+	return manifestCytrus5
+}
+
+func convertManifest(data []byte, from string, to string) ([]byte, error) {
+	if to != manifestFlatbuffer && to != manifestJSON && to != manifestCytrus5 {
+		return nil, errors.New("Erreur, le format " + to + " n'existe pas [flatbuffer|json|cytrus5]")
+	}
+
+	var manifest cytrus6.Manifest
+	switch from {
+	case manifestFlatbuffer:
+		manifest = cytrus6.ParseManifest(data)
+	case manifestJSON:
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, errors.New("Erreur lors de la lecture du manifest json\n[ERREUR]:" + err.Error())
+		}
+	case manifestCytrus5:
+		fragments, err := cytrus5.ParseManifest(data)
+		if err != nil {
+			return nil, err
+		}
+		if to == manifestCytrus5 {
+			return json.Marshal(fragments)
+		}
+		var packed int
+		manifest, packed = cytrus6.FromCytrus5(fragments)
+		if packed > 0 {
+			fmt.Fprintln(os.Stderr, packed, "fichiers distribués dans des packs n'ont pas de bundle dans le manifest converti")
+		}
+	default:
+		return nil, errors.New("Erreur, le format " + from + " n'existe pas [auto|flatbuffer|json|cytrus5]")
+	}
+
+	switch to {
+	case manifestFlatbuffer:
+		return cytrus6.WriteManifest(manifest)
+	case manifestJSON:
+		return json.MarshalIndent(manifest, "", "  ")
+	}
+	fragments, skipped := manifest.ToCytrus5()
+	if skipped > 0 {
+		fmt.Fprintln(os.Stderr, skipped, "liens symboliques ne peuvent pas être décrits par cytrus 5 et ont été ignorés")
+	}
+	return json.Marshal(fragments)
+}
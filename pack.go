@@ -0,0 +1,187 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus5"
+	"cytrusdownloader/cytrus6"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	commands["pack"] = command{description: "Publie le contenu d'un dossier au format cytrus 6 (bundles et manifest) ou cytrus 5 (fichiers, packs et manifest json) dans un cdn local", run: packCommand}
+}
+
+func packCommand(args []string) error {
+	var game string
+	var platform string
+	var release string
+	var version string
+	var cdnDir string
+	var fragment string
+	var generation int
+	var chunkSize int64
+	var bundleSize int64
+	var packThreshold int64
+	var packSize int64
+
+	flags := flag.NewFlagSet("pack", flag.ExitOnError)
+	flags.StringVar(&game, "game", "", "Nom du jeu publié")
+	flags.StringVar(&platform, "platform", runtime.GOOS, "Plateforme de la version publiée [windows,linux,darwin,meta]")
+	flags.StringVar(&release, "release", "main", "Release de la version publiée")
+	flags.StringVar(&version, "version", "", "Version publiée, le préfixe 6.0_ ou 5.0_ est ajouté s'il est absent")
+	flags.StringVar(&cdnDir, "cdn-dir", "cdn/", "Racine du cdn dans lequel publier la version")
+	flags.StringVar(&fragment, "fragment", "", "Place tout le dossier dans ce fragment, par défaut chaque sous-dossier est un fragment")
+	flags.IntVar(&generation, "generation", 6, "Format de la version publiée [5|6]")
+	flags.Int64Var(&chunkSize, "chunk-size", cytrus6.DefaultChunkSize, "Taille des chunks en octets (cytrus 6)")
+	flags.Int64Var(&bundleSize, "bundle-size", cytrus6.DefaultBundleSize, "Taille visée des bundles en octets (cytrus 6)")
+	flags.Int64Var(&packThreshold, "pack-threshold", cytrus5.DefaultPackThreshold, "Taille en octets en dessous de laquelle les fichiers sont regroupés dans des packs (cytrus 5)")
+	flags.Int64Var(&packSize, "pack-size", cytrus5.DefaultPackSize, "Taille visée des packs en octets (cytrus 5)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Erreur, veuillez indiquer le dossier à publier")
+	}
+	if game == "" || version == "" {
+		return errors.New("Erreur, veuillez indiquer le jeu et la version publiée")
+	}
+	game = strings.ToLower(game)
+	release = strings.ToLower(release)
+	platform = strings.ToLower(platform)
+	// le catalogue est vérifié avant la publication, pour ne pas laisser de fichiers publiés sans version dans le catalogue
+	if err := checkPublishTarget(game, platform, release, version); err != nil {
+		return err
+	}
+	catalog, err := readPublishCatalog(cdnDir)
+	if err != nil {
+		return err
+	}
+
+	switch generation {
+	case 6:
+		options := cytrus6.PublishOptions{
+			Game:       game,
+			Release:    release,
+			Platform:   platform,
+			Version:    cytrus6.PublishedVersion(version),
+			OutputDir:  cdnDir,
+			Fragment:   fragment,
+			ChunkSize:  chunkSize,
+			BundleSize: bundleSize,
+		}
+		result, err := cytrus6.Publish(flags.Arg(0), options)
+		if err != nil {
+			return err
+		}
+		if err := publishToCatalog(cdnDir, catalog, game, platform, release, options.Version); err != nil {
+			return err
+		}
+		fmt.Println("Version", options.Version, "publiée dans", result.ManifestPath)
+		fmt.Println(result.Fragments, "fragments,", result.Files, "fichiers,", result.Chunks, "chunks dont", result.DuplicateChunks, "en double,", result.Bundles, "bundles,", formatSize(result.BundlesSize))
+	case 5:
+		options := cytrus5.PublishOptions{
+			Game:          game,
+			Release:       release,
+			Platform:      platform,
+			Version:       cytrus5.PublishedVersion(version),
+			OutputDir:     cdnDir,
+			Fragment:      fragment,
+			PackThreshold: packThreshold,
+			PackSize:      packSize,
+		}
+		result, err := cytrus5.Publish(flags.Arg(0), options)
+		if err != nil {
+			return err
+		}
+		if err := publishToCatalog(cdnDir, catalog, game, platform, release, options.Version); err != nil {
+			return err
+		}
+		fmt.Println("Version", options.Version, "publiée dans", result.ManifestPath)
+		fmt.Println(result.Fragments, "fragments,", result.Files, "fichiers dont", result.DuplicateFiles, "en double,", result.Objects, "fichiers seuls,", result.Packs, "packs,", formatSize(result.ObjectsSize))
+	default:
+		return errors.New("Erreur, la génération " + strconv.Itoa(generation) + " n'existe pas [5|6]")
+	}
+	return nil
+}
+
+// checkPublishTarget vérifie que la version peut être ajoutée au catalogue et que ses noms sont utilisables comme chemins du cdn
+func checkPublishTarget(game string, platform string, release string, version string) error {
+	for _, value := range []string{game, release, version} {
+		if !isPlainName(value) {
+			return errors.New("Erreur, " + strconv.Quote(value) + " n'est pas un nom de jeu, de release ou de version valide")
+		}
+	}
+	switch platform {
+	case "windows", "linux", "darwin":
+	case "meta":
+		if release != "main" && release != "beta" {
+			return errors.New("Erreur, les assets ne peuvent être publiés que dans les releases main et beta")
+		}
+	default:
+		return errors.New("Erreur, la plateforme " + platform + " n'existe pas [windows,linux,darwin,meta]")
+	}
+	return nil
+}
+
+// readPublishCatalog lit le catalogue cytrus.json du cdn, un catalogue vide est créé s'il n'existe pas encore
+func readPublishCatalog(cdnDir string) (Cytrus, error) {
+	catalogPath := filepath.Join(cdnDir, "cytrus.json")
+	catalog := Cytrus{Version: 6, Name: "production", Games: map[string]Game{}}
+	if data, err := os.ReadFile(catalogPath); err == nil {
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return Cytrus{}, errors.New("Erreur lors de la lecture du catalogue " + catalogPath + "\n[ERREUR]:" + err.Error())
+		}
+		if catalog.Games == nil {
+			catalog.Games = map[string]Game{}
+		}
+	}
+	return catalog, nil
+}
+
+// publishToCatalog ajoute la version au catalogue cytrus.json du cdn, pour qu'elle soit la dernière version de sa release
+// le catalogue est lu par readPublishCatalog et la cible vérifiée par checkPublishTarget avant la publication
+func publishToCatalog(cdnDir string, catalog Cytrus, game string, platform string, release string, version string) error {
+	catalogPath := filepath.Join(cdnDir, "cytrus.json")
+
+	gameInfo, exists := catalog.Games[game]
+	if !exists {
+		gameInfo = Game{Name: game, Order: int64(len(catalog.Games))}
+	}
+	setRelease := func(releases map[string]string) map[string]string {
+		if releases == nil {
+			releases = map[string]string{}
+		}
+		releases[release] = version
+		return releases
+	}
+	switch platform {
+	case "windows":
+		gameInfo.Platforms.Windows = setRelease(gameInfo.Platforms.Windows)
+	case "linux":
+		gameInfo.Platforms.Linux = setRelease(gameInfo.Platforms.Linux)
+	case "darwin":
+		gameInfo.Platforms.Darwin = setRelease(gameInfo.Platforms.Darwin)
+	case "meta":
+		if release == "beta" {
+			gameInfo.Assets.Metas.Beta = version
+		} else {
+			gameInfo.Assets.Metas.Main = version
+		}
+	}
+	catalog.Games[game] = gameInfo
+
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(catalogPath, data, 0644); err != nil {
+		return errors.New("Impossible d'écrire le catalogue " + catalogPath + "\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackRejectsTargetBeforePublishing(t *testing.T) {
+	inputDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(inputDir, "main"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "main", "config.xml"), []byte("<config/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string][]string{
+		"plateforme":        {"-platform", "foo"},
+		"release des metas": {"-platform", "meta", "-release", "test"},
+		"jeu":               {"-game", "../jeu"},
+		"release":           {"-release", "main/../.."},
+	}
+	for name, flags := range invalid {
+		for _, generation := range []string{"5", "6"} {
+			cdnDir := t.TempDir()
+			args := append([]string{"-game", "monmod", "-platform", "windows", "-version", "1.0", "-generation", generation, "-cdn-dir", cdnDir}, flags...)
+			if err := packCommand(append(args, inputDir)); err == nil {
+				t.Errorf("%s (cytrus %s): la publication doit être refusée", name, generation)
+			}
+			if published, _ := os.ReadDir(cdnDir); len(published) > 0 {
+				t.Errorf("%s (cytrus %s): %d fichiers publiés malgré l'erreur", name, generation, len(published))
+			}
+		}
+	}
+}
+
+func TestPackRejectsInvalidCatalogBeforePublishing(t *testing.T) {
+	inputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "config.xml"), []byte("<config/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cdnDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(cdnDir, "cytrus.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := packCommand([]string{"-game", "monmod", "-version", "1.0", "-fragment", "main", "-cdn-dir", cdnDir, inputDir}); err == nil {
+		t.Fatal("un catalogue illisible doit être signalé")
+	}
+	if published, _ := os.ReadDir(cdnDir); len(published) != 1 {
+		t.Errorf("%d fichiers dans le cdn, seul le catalogue doit y être", len(published))
+	}
+}
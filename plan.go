@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/store"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["plan"] = command{description: "Calcule les opérations d'un téléchargement sans rien modifier", run: planCommand}
+	commands["apply"] = command{description: "Exécute un plan calculé par la commande plan", run: applyCommand}
+}
+
+func planCommand(args []string) error {
+	var output string
+	var format string
+
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	downloadOpts := addDownloadFlags(flags)
+	flags.StringVar(&output, "o", "", "Enregistre le plan en json dans ce fichier, pour l'exécuter avec apply")
+	flags.StringVar(&format, "format", "text", "Format d'affichage du plan [text|json]")
+	flags.Parse(args)
+
+	if format != "text" && format != "json" {
+		return errors.New("Erreur, le format " + format + " n'existe pas")
+	}
+	options, err := downloadOpts.options()
+	if err != nil {
+		return err
+	}
+	if err := checkSeed(options); err != nil {
+		return err
+	}
+	cytrusGeneration, err := generationOf(options.Version)
+	if err != nil {
+		return err
+	}
+	plan, err := cytrusGeneration.plan(options)
+	if err != nil {
+		return err
+	}
+	// le plan conserve les dossiers locaux à utiliser pour qu'apply fasse exactement les mêmes opérations
+	if options.Store != nil {
+		plan.StoreDir = options.Store.Dir()
+	}
+	if options.Seed != nil {
+		plan.SeedDirs = options.Seed.Dirs()
+	}
+	if options.Pool != nil {
+		plan.Link = downloadOpts.linkMode
+	}
+
+	planData, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	if output != "" {
+		if err := os.WriteFile(output, planData, 0644); err != nil {
+			return errors.New("Impossible d'enregistrer le plan dans " + output + "\n[ERREUR]:" + err.Error())
+		}
+	}
+	if format == "json" {
+		fmt.Println(string(planData))
+		return nil
+	}
+	printPlan(plan)
+	if output != "" {
+		fmt.Println("Plan enregistré dans", output, ", exécutez le avec: apply -plan", output)
+	}
+	return nil
+}
+
+func printPlan(plan cytrus.Plan) {
+	fmt.Println("Plan de téléchargement de", plan.Game, " plateforme:", plan.Platform, " release:", plan.Release, " version:", plan.Version)
+	created := 0
+	for _, file := range plan.Files {
+		if file.Action == cytrus.ActionCreate {
+			created++
+		}
+	}
+	fmt.Println("Fichiers créés:", created, " mis à jour:", len(plan.Files)-created, " supprimés:", len(plan.Deleted), " inchangés:", plan.Unchanged)
+	fmt.Println("Objets à télécharger:", len(plan.Fetches), "(", formatSize(plan.DownloadSize), ")")
+	fmt.Println("Espace disque nécessaire:", formatSize(plan.DiskSize))
+
+	for _, fetch := range plan.Fetches {
+		if len(fetch.Ranges) > 0 {
+			fmt.Printf("  telecharge %s (%d parties, %s)\n", fetch.Path, len(fetch.Ranges), formatSize(fetch.Size))
+		} else {
+			fmt.Printf("  telecharge %s (%s)\n", fetch.Path, formatSize(fetch.Size))
+		}
+	}
+	for _, file := range plan.Files {
+		symbol := "+"
+		if file.Action == cytrus.ActionUpdate {
+			symbol = "~"
+		}
+		fmt.Printf("  %s %s (%s, %s)\n", symbol, file.Name, formatSize(file.Size), file.Source)
+	}
+	for _, name := range plan.Deleted {
+		fmt.Printf("  - %s\n", name)
+	}
+	for _, dir := range plan.DeletedDirs {
+		fmt.Printf("  - %s/\n", dir)
+	}
+	if len(plan.Deleted) > 0 && plan.Quarantine != "" {
+		fmt.Println("Les fichiers supprimés seront déplacés dans", plan.Quarantine)
+	}
+}
+
+func applyCommand(args []string) error {
+	var planFile string
+	var cacheDir string
+
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	flags.StringVar(&planFile, "plan", "", "Fichier json du plan à exécuter, créé par plan -o")
+	flags.StringVar(&cacheDir, "cache-dir", defaultCacheDir(), "Dossier de cache local (hash des dossiers d'amorçage)")
+	flags.Parse(args)
+
+	if planFile == "" {
+		return errors.New("Erreur, veuillez indiquer le plan à exécuter avec -plan")
+	}
+	planData, err := os.ReadFile(planFile)
+	if err != nil {
+		return errors.New("Impossible de lire le plan " + planFile + "\n[ERREUR]:" + err.Error())
+	}
+	plan := cytrus.Plan{}
+	if err := json.Unmarshal(planData, &plan); err != nil {
+		return errors.New("Erreur lors de la lecture du plan " + planFile + "\n[ERREUR]:" + err.Error())
+	}
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+
+	options := cytrus.Options{
+		ManifestFile: plan.ManifestFile,
+		Game:         plan.Game,
+		Release:      plan.Release,
+		Platform:     plan.Platform,
+		Version:      plan.Version,
+		OutputDir:    plan.OutputDir,
+		Fragments:    plan.Fragments,
+		Layout:       plan.Layout,
+		CDNURL:       plan.CDNURL,
+		// une installation versionnée n'est activée qu'une fois vérifiée
+		Verify: plan.Layout == cytrus.LayoutVersioned,
+	}
+	if plan.StoreDir != "" {
+		if options.Store, err = store.Open(plan.StoreDir); err != nil {
+			return err
+		}
+	}
+	if len(plan.SeedDirs) > 0 {
+		if options.Seed, err = openSeed(plan.SeedDirs, cacheDir); err != nil {
+			return err
+		}
+	}
+	if plan.Link != "" {
+		if options.Pool, err = openPool(plan.OutputDir, plan.Link); err != nil {
+			return err
+		}
+	}
+	if err := checkSeed(options); err != nil {
+		return err
+	}
+	cytrusGeneration, err := generationOf(plan.Version)
+	if err != nil {
+		return err
+	}
+
+	// le plan est exécuté tel quel, il est refusé si l'état local ne permet plus de faire les mêmes opérations
+	current, err := cytrusGeneration.plan(options)
+	if err != nil {
+		return err
+	}
+	if err := plan.Matches(current); err != nil {
+		return err
+	}
+
+	fmt.Println("Exécution du plan de", plan.Game, " plateforme:", plan.Platform, " release:", plan.Release, " version:", plan.Version)
+	if err := cytrusGeneration.apply(plan, options); err != nil {
+		return err
+	}
+	if options.Layout == cytrus.LayoutVersioned {
+		if err := activateVersion(options); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Le plan s'est correctement exécuté dans", options.ContentDestination())
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"flag"
+	"fmt"
+)
+
+func init() {
+	commands["prune"] = command{description: "Supprime les fichiers d'une installation qui ne font plus partie du manifest", run: pruneCommand}
+}
+
+func pruneCommand(args []string) error {
+	var dryRun bool
+
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	versionOpts := addVersionFlags(flags)
+	pruneOpts := addPruneFlags(flags)
+	flags.BoolVar(&dryRun, "dry-run", false, "Affiche les fichiers et dossiers qui seraient supprimés sans rien modifier")
+	flags.Parse(args)
+
+	options, err := versionOpts.options()
+	if err != nil {
+		return err
+	}
+	cytrusGeneration, err := generationOf(options.Version)
+	if err != nil {
+		return err
+	}
+	manifestData, err := cytrusGeneration.loadManifest(options)
+	if err != nil {
+		return err
+	}
+	listing, err := cytrusGeneration.listing(manifestData, options)
+	if err != nil {
+		return err
+	}
+
+	destination := options.ContentDestination()
+	orphans, err := cytrus.Orphans(destination, listing, *pruneOpts.options())
+	if err != nil {
+		return err
+	}
+	emptyDirs := cytrus.EmptyDirs(destination, listing, orphans, *pruneOpts.options())
+
+	action := "Suppression de"
+	if dryRun {
+		action = "Supprimerait"
+	} else if pruneOpts.quarantine != "" {
+		action = "Quarantaine de"
+	}
+	for _, name := range orphans {
+		fmt.Println(action, name)
+	}
+	for _, dir := range emptyDirs {
+		fmt.Println(action, dir+"/")
+	}
+	if dryRun {
+		fmt.Println(len(orphans), "fichiers et", len(emptyDirs), "dossiers ne font pas partie du manifest de", destination)
+		return nil
+	}
+	if err := cytrus.Prune(destination, orphans, emptyDirs, pruneOpts.quarantine); err != nil {
+		return err
+	}
+	fmt.Println(len(orphans), "fichiers et", len(emptyDirs), "dossiers retirés de", destination)
+	return nil
+}
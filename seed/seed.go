@@ -0,0 +1,150 @@
+package seed
+
+import (
+	"cytrusdownloader/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Index référence le contenu des dossiers d'amorçage: d'autres versions ou plateformes déjà installées
+// les fichiers dont le hash correspond au manifest sont copiés au lieu d'être téléchargés
+type Index struct {
+	dirs  []string
+	files map[string]string // hash -> chemin d'un fichier ayant ce contenu
+}
+
+// entrée du cache des hash, le hash est recalculé si la taille ou la date de modification change
+type cachedHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+var hashCacheMutex sync.Mutex
+
+// Build calcule le hash de tous les fichiers des dossiers, les hash déjà calculés sont lus depuis hashCachePath
+func Build(dirs []string, hashCachePath string) (*Index, error) {
+	hashCacheMutex.Lock()
+	defer hashCacheMutex.Unlock()
+
+	hashCache := map[string]cachedHash{}
+	if hashCachePath != "" {
+		if data, err := os.ReadFile(hashCachePath); err == nil {
+			json.Unmarshal(data, &hashCache)
+		}
+	}
+
+	index := &Index{files: make(map[string]string)}
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(absDir); err != nil {
+			return nil, errors.New("Le dossier d'amorçage " + dir + " n'existe pas")
+		}
+		index.dirs = append(index.dirs, absDir)
+
+		err = filepath.WalkDir(absDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			cached, exists := hashCache[path]
+			if !exists || cached.Size != info.Size() || !cached.ModTime.Equal(info.ModTime()) {
+				hash, err := store.HashFile(path)
+				if err != nil {
+					return err
+				}
+				cached = cachedHash{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+				hashCache[path] = cached
+			}
+			if _, exists := index.files[cached.Hash]; !exists {
+				index.files[cached.Hash] = path
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.New("Erreur lors de l'analyse du dossier d'amorçage " + dir + "\n[ERREUR]:" + err.Error())
+		}
+	}
+
+	if hashCachePath != "" {
+		if data, err := json.Marshal(hashCache); err == nil {
+			os.MkdirAll(filepath.Dir(hashCachePath), os.ModePerm)
+			os.WriteFile(hashCachePath, data, 0644)
+		}
+	}
+	fmt.Println(len(index.files), "contenus différents trouvés dans les dossiers d'amorçage")
+	return index, nil
+}
+
+// Dirs renvoie les chemins absolus des dossiers d'amorçage
+func (i *Index) Dirs() []string {
+	return i.dirs
+}
+
+// Contains indique si le dossier fait partie des dossiers d'amorçage
+func (i *Index) Contains(dir string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, seedDir := range i.dirs {
+		if seedDir == absDir {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Index) Lookup(hash string) (string, bool) {
+	path, exists := i.files[hash]
+	return path, exists
+}
+
+// Open ouvre un fichier dont le contenu correspond à hash
+func (i *Index) Open(hash string) (*os.File, bool, error) {
+	sourcePath, exists := i.files[hash]
+	if !exists {
+		return nil, false, nil
+	}
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, false, errors.New("Impossible d'ouvrir le fichier d'amorçage " + sourcePath + "\n[ERREUR]:" + err.Error())
+	}
+	return source, true, nil
+}
+
+// ReadChunk cherche un chunk dans le fichier de même nom des dossiers d'amorçage, à la même position
+// cela permet de réutiliser les parties inchangées d'un fichier modifié entre deux versions
+func (i *Index) ReadChunk(relativePath string, hash string, offset int64, size int64) ([]byte, bool) {
+	for _, seedDir := range i.dirs {
+		file, err := os.Open(filepath.Join(seedDir, relativePath))
+		if err != nil {
+			continue
+		}
+		chunkContent := make([]byte, size)
+		_, errRead := file.ReadAt(chunkContent, offset)
+		file.Close()
+		if errRead != nil {
+			continue
+		}
+		if store.HashData(hash, chunkContent) == hash {
+			return chunkContent, true
+		}
+	}
+	return []byte{}, false
+}
@@ -0,0 +1,212 @@
+package sink
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// emitFunc envoie un fichier complet vers la sortie, elle n'est jamais appelée en parallèle
+type emitFunc func(name string, content *os.File, size int64, executable bool) error
+
+// streamSink conserve chaque fichier dans un fichier temporaire jusqu'à ce que toutes ses données soient écrites,
+// il est ensuite envoyé en une fois, ce qui permet d'écrire les fichiers dans une archive ou un stockage distant
+type streamSink struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingFile
+	done    map[string]bool
+	emit    emitFunc
+	finish  func() error
+}
+
+type pendingFile struct {
+	name       string
+	tmpFile    *os.File
+	size       int64
+	executable bool
+	// parties écrites, indexées par leur position, une partie écrite deux fois n'est comptée qu'une fois
+	written map[int64]int64
+	refs    int
+}
+
+type streamFile struct {
+	sink    *streamSink
+	pending *pendingFile
+}
+
+func newStreamSink(emit emitFunc, finish func() error) *streamSink {
+	return &streamSink{pending: make(map[string]*pendingFile), done: make(map[string]bool), emit: emit, finish: finish}
+}
+
+func (s *streamSink) OpenFile(name string, size int64, executable bool) (File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.done[name] {
+		// le fichier a déjà été envoyé, les nouvelles écritures contiennent les mêmes données
+		return discardFile{}, nil
+	}
+	pending, exists := s.pending[name]
+	if !exists {
+		tmpFile, err := os.CreateTemp("", "cytrus-sink-*")
+		if err != nil {
+			return nil, errors.New("Impossible de crée un fichier temporaire\n[ERREUR]:" + err.Error())
+		}
+		pending = &pendingFile{name: name, tmpFile: tmpFile, size: size, executable: executable, written: make(map[int64]int64)}
+		s.pending[name] = pending
+	}
+	pending.refs++
+	return &streamFile{sink: s, pending: pending}, nil
+}
+
+func (f *streamFile) WriteAt(data []byte, offset int64) (int, error) {
+	n, err := f.pending.tmpFile.WriteAt(data, offset)
+	f.sink.mutex.Lock()
+	if int64(n) > f.pending.written[offset] {
+		f.pending.written[offset] = int64(n)
+	}
+	f.sink.mutex.Unlock()
+	return n, err
+}
+
+func (f *streamFile) Close() error {
+	f.sink.mutex.Lock()
+	defer f.sink.mutex.Unlock()
+
+	f.pending.refs--
+	if f.pending.refs > 0 || f.pending.writtenSize() < f.pending.size {
+		return nil
+	}
+	return f.sink.flush(f.pending)
+}
+
+// flush envoie un fichier complet, le verrou doit être pris
+func (s *streamSink) flush(pending *pendingFile) error {
+	delete(s.pending, pending.name)
+	s.done[pending.name] = true
+	defer os.Remove(pending.tmpFile.Name())
+	defer pending.tmpFile.Close()
+
+	if _, err := pending.tmpFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.emit(pending.name, pending.tmpFile, pending.size, pending.executable); err != nil {
+		return errors.New("Erreur lors de l'envoi du fichier " + pending.name + "\n[ERREUR]: " + err.Error())
+	}
+	return nil
+}
+
+func (s *streamSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// les fichiers incomplets ne sont pas envoyés
+	incomplete := []string{}
+	for name, pending := range s.pending {
+		incomplete = append(incomplete, name)
+		pending.tmpFile.Close()
+		os.Remove(pending.tmpFile.Name())
+	}
+	s.pending = make(map[string]*pendingFile)
+
+	errFinish := s.finish()
+	if len(incomplete) > 0 {
+		sort.Strings(incomplete)
+		return errors.New("Erreur, des fichiers incomplets n'ont pas été écrits dans la sortie: " + strings.Join(incomplete, ", "))
+	}
+	return errFinish
+}
+
+func (p *pendingFile) writtenSize() int64 {
+	total := int64(0)
+	for _, size := range p.written {
+		total += size
+	}
+	return total
+}
+
+type discardFile struct{}
+
+func (discardFile) WriteAt(data []byte, offset int64) (int, error) {
+	return len(data), nil
+}
+
+func (discardFile) Close() error {
+	return nil
+}
+
+func fileMode(executable bool) int64 {
+	if executable {
+		return 0755
+	}
+	return 0644
+}
+
+// NewTar écris les fichiers dans une archive tar, compressée avec zstd si compress est vrai
+func NewTar(output string, compress bool) (Sink, error) {
+	archiveFile, err := os.Create(output)
+	if err != nil {
+		return nil, errors.New("Impossible de crée l'archive " + output + "\n[ERREUR]:" + err.Error())
+	}
+	var writer io.Writer = archiveFile
+	var encoder *zstd.Encoder
+	if compress {
+		encoder, err = zstd.NewWriter(archiveFile)
+		if err != nil {
+			archiveFile.Close()
+			return nil, err
+		}
+		writer = encoder
+	}
+	tarWriter := tar.NewWriter(writer)
+
+	emit := func(name string, content *os.File, size int64, executable bool) error {
+		header := &tar.Header{Name: name, Mode: fileMode(executable), Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.CopyN(tarWriter, content, size)
+		return err
+	}
+	finish := func() error {
+		errs := []error{tarWriter.Close()}
+		if encoder != nil {
+			errs = append(errs, encoder.Close())
+		}
+		errs = append(errs, archiveFile.Close())
+		return errors.Join(errs...)
+	}
+	return newStreamSink(emit, finish), nil
+}
+
+// NewZip écris les fichiers dans une archive zip
+func NewZip(output string) (Sink, error) {
+	archiveFile, err := os.Create(output)
+	if err != nil {
+		return nil, errors.New("Impossible de crée l'archive " + output + "\n[ERREUR]:" + err.Error())
+	}
+	zipWriter := zip.NewWriter(archiveFile)
+
+	emit := func(name string, content *os.File, size int64, executable bool) error {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+		header.SetMode(os.FileMode(fileMode(executable)))
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(writer, content, size)
+		return err
+	}
+	finish := func() error {
+		return errors.Join(zipWriter.Close(), archiveFile.Close())
+	}
+	return newStreamSink(emit, finish), nil
+}
@@ -0,0 +1,159 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Client envoie des fichiers vers un stockage compatible S3 avec des requêtes PUT en adressage par chemin,
+// les identifiants sont lus dans AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY et AWS_REGION,
+// sans identifiants les requêtes ne sont pas signées
+type s3Client struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3 envoie chaque fichier complet dans le bucket de output (s3://<bucket>/<préfixe>),
+// endpoint vaut par défaut AWS_ENDPOINT_URL puis le service S3 d'AWS
+func NewS3(output string, endpoint string) (Sink, error) {
+	location := strings.TrimPrefix(output, "s3://")
+	bucket, prefix, _ := strings.Cut(location, "/")
+	if bucket == "" {
+		return nil, errors.New("Erreur, la sortie " + output + " ne contient pas de bucket")
+	}
+
+	client := &s3Client{
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{},
+	}
+	if client.region == "" {
+		client.region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + client.region + ".amazonaws.com"
+	}
+	client.endpoint = strings.TrimSuffix(endpoint, "/")
+
+	return newStreamSink(client.put, func() error { return nil }), nil
+}
+
+func (c *s3Client) put(name string, content *os.File, size int64, executable bool) error {
+	key := name
+	if c.prefix != "" {
+		key = c.prefix + "/" + name
+	}
+	objectURL, err := url.Parse(c.endpoint)
+	if err != nil {
+		return err
+	}
+	// le chemin envoyé est exactement celui qui est signé, chaque segment est encodé comme l'exige la signature v4
+	objectPath := "/" + c.bucket + "/" + key
+	canonicalURI := objectURL.EscapedPath() + uriEncodePath(objectPath)
+	objectURL.Path += objectPath
+	objectURL.RawPath = canonicalURI
+
+	// le hash du contenu fait partie de la signature
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, content, size); err != nil {
+		return err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, objectURL.String(), io.NopCloser(io.LimitReader(content, size)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hasher.Sum(nil)))
+	if c.accessKey != "" {
+		c.sign(req, canonicalURI, time.Now().UTC())
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.New("Le stockage a répondu " + res.Status + " pour " + key + ": " + string(body))
+	}
+	return nil
+}
+
+// sign ajoute la signature AWS v4 à la requête, canonicalURI est le chemin encodé de la requête
+func (c *s3Client) sign(req *http.Request, canonicalURI string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256") + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// uriEncodePath encode tous les octets du chemin sauf les caractères non réservés (A-Z, a-z, 0-9, -, ., _, ~) et les /
+func uriEncodePath(path string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,107 @@
+package sink
+
+import (
+	"cytrusdownloader/dedupe"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Sink reçoit les fichiers extraits d'une version, les noms sont relatifs à la racine de la version: <fragment>/<fichier>
+type Sink interface {
+	// OpenFile ouvre un fichier dont la taille finale est size, les données peuvent être écrites dans n'importe quel ordre
+	// et le fichier peut être ouvert plusieurs fois, par exemple une fois par chunk
+	OpenFile(name string, size int64, executable bool) (File, error)
+	// Close termine la sortie: fin de l'archive, fin de l'envoi
+	Close() error
+}
+
+type File interface {
+	io.WriterAt
+	io.Closer
+}
+
+// Open choisis la sortie en fonction de sa description:
+// vide pour le dossier dir, <fichier>.tar, <fichier>.tar.zst, <fichier>.zip, ou s3://<bucket>/<préfixe>
+func Open(output string, dir string, s3Endpoint string) (Sink, error) {
+	switch {
+	case output == "":
+		return NewDir(dir), nil
+	case strings.HasPrefix(output, "s3://"):
+		return NewS3(output, s3Endpoint)
+	case strings.HasSuffix(output, ".tar.zst"):
+		return NewTar(output, true)
+	case strings.HasSuffix(output, ".tar"):
+		return NewTar(output, false)
+	case strings.HasSuffix(output, ".zip"):
+		return NewZip(output)
+	}
+	return nil, errors.New("Erreur, la sortie " + output + " n'est pas supportée [<fichier>.tar|<fichier>.tar.zst|<fichier>.zip|s3://<bucket>/<préfixe>]")
+}
+
+// Dir renvoie le dossier de la sortie si elle écrit directement les fichiers sur le disque
+func Dir(output Sink) (string, bool) {
+	dirSink, isDir := output.(*DirSink)
+	if !isDir {
+		return "", false
+	}
+	return dirSink.root, true
+}
+
+// WriteFile écris un fichier complet dans la sortie
+func WriteFile(output Sink, name string, size int64, executable bool, content io.Reader) error {
+	file, err := output.OpenFile(name, size, executable)
+	if err != nil {
+		return err
+	}
+	_, errCopy := io.Copy(io.NewOffsetWriter(file, 0), content)
+	errClose := file.Close()
+	if errCopy != nil {
+		return errors.New("Erreur lors de l'écriture du fichier " + name + "\n[ERREUR]: " + errCopy.Error())
+	}
+	return errClose
+}
+
+// DirSink écris les fichiers dans un dossier, c'est la sortie par défaut
+type DirSink struct {
+	root   string
+	mutex  sync.Mutex
+	opened map[string]bool
+}
+
+func NewDir(root string) *DirSink {
+	return &DirSink{root: root, opened: make(map[string]bool)}
+}
+
+func (s *DirSink) OpenFile(name string, size int64, executable bool) (File, error) {
+	destinationFile := filepath.Join(s.root, filepath.FromSlash(name))
+	// crée le path du fichier
+	if err := os.MkdirAll(filepath.Dir(destinationFile), os.ModePerm); err != nil {
+		return nil, errors.New("Erreur lors de la création du répertoire " + filepath.Dir(destinationFile))
+	}
+
+	// à la première ouverture, le fichier existant est supprimé plutôt que tronqué:
+	// il peut s'agir d'un lien vers une copie partagée avec une autre version
+	s.mutex.Lock()
+	if !s.opened[name] {
+		s.opened[name] = true
+		if err := dedupe.BreakLink(destinationFile); err != nil {
+			s.mutex.Unlock()
+			return nil, err
+		}
+	}
+	s.mutex.Unlock()
+
+	file, err := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return nil, errors.New("Erreur lors de la création ou création du fichier " + destinationFile)
+	}
+	return file, nil
+}
+
+func (s *DirSink) Close() error {
+	return nil
+}
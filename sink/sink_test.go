@@ -0,0 +1,417 @@
+package sink
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// sinkTestFile est un fichier écrit par writeTestFiles
+type sinkTestFile struct {
+	content    string
+	executable bool
+}
+
+var sinkTestFiles = map[string]sinkTestFile{
+	"main/game.exe":        {content: "exécutable du jeu", executable: true},
+	"main/data/config.xml": {content: "<config>valeur</config>"},
+	"assets/ui/image.png":  {content: strings.Repeat("pixels ", 200)},
+}
+
+// writeTestFiles écris chaque fichier en deux parties, dans le désordre et par deux ouvertures, comme le font les chunks
+func writeTestFiles(t *testing.T, output Sink) {
+	t.Helper()
+	for name, file := range sinkTestFiles {
+		data := []byte(file.content)
+		middle := int64(len(data) / 2)
+		first, err := output.OpenFile(name, int64(len(data)), file.executable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := output.OpenFile(name, int64(len(data)), file.executable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := second.WriteAt(data[middle:], middle); err != nil {
+			t.Fatal(err)
+		}
+		if err := second.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := first.WriteAt(data[:middle], 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := first.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTestFiles compare les fichiers lus dans la sortie à ceux écrits
+func checkTestFiles(t *testing.T, files map[string]sinkTestFile) {
+	t.Helper()
+	if len(files) != len(sinkTestFiles) {
+		t.Errorf("%d fichiers dans la sortie, %d attendus", len(files), len(sinkTestFiles))
+	}
+	for name, expected := range sinkTestFiles {
+		file, exists := files[name]
+		if !exists {
+			t.Errorf("le fichier %s est absent de la sortie", name)
+			continue
+		}
+		if file.content != expected.content {
+			t.Errorf("contenu de %s: %q, attendu %q", name, file.content, expected.content)
+		}
+		if file.executable != expected.executable {
+			t.Errorf("%s exécutable: %v, attendu %v", name, file.executable, expected.executable)
+		}
+	}
+}
+
+func TestDirSink(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, NewDir(root))
+
+	files := map[string]sinkTestFile{}
+	for name := range sinkTestFiles {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// le mode des fichiers n'est pas changé dans un dossier, seul le contenu est vérifié
+		files[name] = sinkTestFile{content: string(data), executable: sinkTestFiles[name].executable}
+	}
+	checkTestFiles(t, files)
+}
+
+func readTarFiles(t *testing.T, reader io.Reader) map[string]sinkTestFile {
+	t.Helper()
+	files := map[string]sinkTestFile{}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = sinkTestFile{content: string(data), executable: header.Mode&0111 != 0}
+	}
+}
+
+func TestTarSink(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "version.tar")
+	tarSink, err := Open(output, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, tarSink)
+
+	archiveFile, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archiveFile.Close()
+	checkTestFiles(t, readTarFiles(t, archiveFile))
+}
+
+func TestTarZstdSink(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "version.tar.zst")
+	tarSink, err := Open(output, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, tarSink)
+
+	archiveFile, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archiveFile.Close()
+	decoder, err := zstd.NewReader(archiveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	checkTestFiles(t, readTarFiles(t, decoder))
+}
+
+func TestZipSink(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "version.zip")
+	zipSink, err := Open(output, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, zipSink)
+
+	zipReader, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipReader.Close()
+	files := map[string]sinkTestFile{}
+	for _, zipFile := range zipReader.File {
+		reader, err := zipFile.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[zipFile.Name] = sinkTestFile{content: string(data), executable: zipFile.Mode()&0111 != 0}
+	}
+	checkTestFiles(t, files)
+}
+
+func TestSinkIncompleteFile(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "version.tar")
+	tarSink, err := Open(output, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := tarSink.OpenFile("main/partiel.bin", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("12345"), 0)
+	file.Close()
+	if err := tarSink.Close(); err == nil || !strings.Contains(err.Error(), "main/partiel.bin") {
+		t.Fatalf("un fichier incomplet doit être signalé, erreur: %v", err)
+	}
+}
+
+// fakeS3 vérifie la signature AWS v4 de chaque requête et conserve les objets reçus
+type fakeS3 struct {
+	t         *testing.T
+	accessKey string
+	secretKey string
+	region    string
+	mutex     sync.Mutex
+	objects   map[string][]byte
+}
+
+var authorizationPattern = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.t.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPut {
+		s.t.Errorf("méthode %s, PUT attendu", r.Method)
+	}
+	if err := s.verify(r, body); err != "" {
+		s.t.Errorf("%s: %s", r.URL.Path, err)
+		http.Error(w, err, http.StatusForbidden)
+		return
+	}
+	s.mutex.Lock()
+	s.objects[r.URL.Path] = body
+	s.mutex.Unlock()
+}
+
+// verify recalcule la signature de la requête à partir de ce que le serveur a reçu
+func (s *fakeS3) verify(r *http.Request, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(bodyHash[:]) {
+		return "le hash X-Amz-Content-Sha256 ne correspond pas au contenu reçu"
+	}
+	match := authorizationPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return "entête Authorization invalide: " + r.Header.Get("Authorization")
+	}
+	accessKey, day, region, signedHeaders, signature := match[1], match[2], match[3], match[4], match[5]
+	amzDate := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return "entête X-Amz-Date invalide: " + amzDate
+	}
+	if accessKey != s.accessKey || region != s.region || day != requestTime.Format("20060102") {
+		return "portée de la signature invalide: " + match[0]
+	}
+	if time.Since(requestTime).Abs() > 15*time.Minute {
+		return "la date de la requête est trop éloignée"
+	}
+
+	canonicalHeaders := ""
+	for _, header := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(header)
+		if header == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += header + ":" + strings.TrimSpace(value) + "\n"
+	}
+	// comme S3, le chemin reçu est décodé puis encodé à nouveau pour la signature
+	canonicalRequest := r.Method + "\n" + sigV4EncodePath(r.URL.Path) + "\n" + r.URL.RawQuery + "\n" + canonicalHeaders + "\n" + signedHeaders + "\n" + r.Header.Get("X-Amz-Content-Sha256")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	if expected := hex.EncodeToString(hmacSHA256(key, stringToSign)); expected != signature {
+		return "signature " + signature + ", attendue " + expected
+	}
+	return ""
+}
+
+// sigV4EncodePath encode le chemin pour la requête canonique de la signature v4: chaque octet autre qu'un caractère
+// non réservé ou un / est remplacé par %XX en majuscules
+func sigV4EncodePath(path string) string {
+	const unreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~/"
+	encoded := ""
+	for _, b := range []byte(path) {
+		if strings.IndexByte(unreserved, b) >= 0 {
+			encoded += string(b)
+		} else {
+			encoded += "%" + strings.ToUpper(hex.EncodeToString([]byte{b}))
+		}
+	}
+	return encoded
+}
+
+func TestS3Sink(t *testing.T) {
+	fake := &fakeS3{t: t, accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", region: "eu-west-3", objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", fake.accessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", fake.secretKey)
+	t.Setenv("AWS_REGION", fake.region)
+
+	s3Sink, err := Open("s3://jeux/dofus/6.0_3.0.1/", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, s3Sink)
+
+	files := map[string]sinkTestFile{}
+	for path, data := range fake.objects {
+		name, found := strings.CutPrefix(path, "/jeux/dofus/6.0_3.0.1/")
+		if !found {
+			t.Errorf("objet envoyé hors du préfixe: %s", path)
+			continue
+		}
+		// S3 ne conserve pas le mode des fichiers
+		files[name] = sinkTestFile{content: string(data), executable: sinkTestFiles[name].executable}
+	}
+	checkTestFiles(t, files)
+}
+
+func TestS3SinkWithoutCredentials(t *testing.T) {
+	received := map[string]string{}
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("une requête sans identifiants ne doit pas être signée")
+		}
+		received[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	s3Sink, err := NewS3("s3://jeux", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := s3Sink.OpenFile("main/a.txt", 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("abc"), 0)
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte(received["/jeux/main/a.txt"]), []byte("abc")) {
+		t.Errorf("objets reçus: %v", received)
+	}
+}
+
+func TestS3SinkReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+
+	s3Sink, err := NewS3("s3://jeux", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := s3Sink.OpenFile("main/a.txt", 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("abc"), 0)
+	if err := file.Close(); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("l'erreur du stockage doit être renvoyée: %v", err)
+	}
+}
+
+func TestS3SinkEncodesKeys(t *testing.T) {
+	fake := &fakeS3{t: t, accessKey: "AKIDEXAMPLE", secretKey: "secret", region: "us-east-1", objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", fake.accessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", fake.secretKey)
+	t.Setenv("AWS_REGION", fake.region)
+
+	s3Sink, err := NewS3("s3://jeux/dofus", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"main/mon fichier+1.txt", "main/notes #2?.txt", "main/100% (copie),v=1;a:b@c$d&e!f*g'h.txt", "main/été.txt"}
+	for _, name := range names {
+		file, err := s3Sink.OpenFile(name, int64(len(name)), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteAt([]byte(name), 0)
+		if err := file.Close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if err := s3Sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if content := string(fake.objects["/jeux/dofus/"+name]); content != name {
+			t.Errorf("%s: objet absent ou différent (%q)", name, content)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Store est un dépôt local de chunks (cytrus 6) et d'objets (cytrus 5) rangés par hash: <dossier>/<2 premiers caractères>/<hash>
+// il est partagé entre les versions et les jeux, la date de modification des fichiers sert de date de dernière utilisation
+type Store struct {
+	dir string
+}
+
+type Stats struct {
+	Objects int64
+	Size    int64
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+type PruneResult struct {
+	Removed int64
+	Freed   int64
+}
+
+type object struct {
+	hash    string
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.New("Impossible de crée le dossier du dépôt local " + dir + "\n[ERREUR]:" + err.Error())
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) Path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.dir, hash)
+	}
+	return filepath.Join(s.dir, hash[0:2], hash)
+}
+
+func (s *Store) Has(hash string) bool {
+	_, err := os.Stat(s.Path(hash))
+	return err == nil
+}
+
+// Read renvoie le contenu d'un objet et met à jour sa date d'utilisation
+func (s *Store) Read(hash string) ([]byte, error) {
+	data, err := os.ReadFile(s.Path(hash))
+	if err != nil {
+		return []byte{}, errors.New("Impossible de lire l'objet " + hash + " du dépôt local\n[ERREUR]:" + err.Error())
+	}
+	s.touch(hash)
+	return data, nil
+}
+
+// Open ouvre un objet en lecture et met à jour sa date d'utilisation
+func (s *Store) Open(hash string) (*os.File, error) {
+	objectFile, err := os.Open(s.Path(hash))
+	if err != nil {
+		return nil, errors.New("Impossible de lire l'objet " + hash + " du dépôt local\n[ERREUR]:" + err.Error())
+	}
+	s.touch(hash)
+	return objectFile, nil
+}
+
+func (s *Store) Put(hash string, data []byte) error {
+	if s.Has(hash) {
+		s.touch(hash)
+		return nil
+	}
+	return s.PutReader(hash, bytes.NewReader(data))
+}
+
+// PutReader ajoute un objet au dépôt, son contenu est vérifié avec son hash avant d'être rendu disponible
+func (s *Store) PutReader(hash string, reader io.Reader) error {
+	objectPath := s.Path(hash)
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		return errors.New("Impossible de crée le dossier " + filepath.Dir(objectPath) + "\n[ERREUR]:" + err.Error())
+	}
+
+	// le fichier est écrit à côté puis renommé pour qu'un objet incomplet ne soit jamais visible
+	tmpFile, err := os.CreateTemp(filepath.Dir(objectPath), hash+".*.tmp")
+	if err != nil {
+		return errors.New("Impossible de crée un fichier dans le dépôt local\n[ERREUR]:" + err.Error())
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hasher := newHasher(hash)
+	var writer io.Writer = tmpFile
+	if hasher != nil {
+		writer = io.MultiWriter(tmpFile, hasher)
+	}
+	_, errCopy := io.Copy(writer, reader)
+	errClose := tmpFile.Close()
+	if errCopy != nil || errClose != nil {
+		return errors.New("Erreur lors de l'écriture de l'objet " + hash + " dans le dépôt local")
+	}
+	if hasher != nil && hex.EncodeToString(hasher.Sum(nil)) != hash {
+		return errors.New("Le contenu de l'objet ne correspond pas à son hash " + hash)
+	}
+
+	if err := os.Rename(tmpFile.Name(), objectPath); err != nil {
+		return errors.New("Erreur lors de l'ajout de l'objet " + hash + " dans le dépôt local\n[ERREUR]:" + err.Error())
+	}
+	return nil
+}
+
+func (s *Store) Stats() (Stats, error) {
+	objects, err := s.objects()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{Objects: int64(len(objects))}
+	for _, obj := range objects {
+		stats.Size += obj.size
+		if stats.Oldest.IsZero() || obj.lastUse.Before(stats.Oldest) {
+			stats.Oldest = obj.lastUse
+		}
+		if obj.lastUse.After(stats.Newest) {
+			stats.Newest = obj.lastUse
+		}
+	}
+	return stats, nil
+}
+
+// Prune supprime les objets inutilisés depuis plus de maxAge, puis les moins récemment utilisés
+// jusqu'à ce que le dépôt fasse moins de maxSize octets, une valeur nulle désactive le critère
+func (s *Store) Prune(maxSize int64, maxAge time.Duration) (PruneResult, error) {
+	objects, err := s.objects()
+	if err != nil {
+		return PruneResult{}, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].lastUse.Before(objects[j].lastUse)
+	})
+
+	totalSize := int64(0)
+	for _, obj := range objects {
+		totalSize += obj.size
+	}
+
+	result := PruneResult{}
+	for _, obj := range objects {
+		tooOld := maxAge > 0 && time.Since(obj.lastUse) > maxAge
+		tooBig := maxSize > 0 && totalSize > maxSize
+		if !tooOld && !tooBig {
+			continue
+		}
+		if err := os.Remove(obj.path); err != nil {
+			return result, errors.New("Impossible de supprimer l'objet " + obj.hash + "\n[ERREUR]:" + err.Error())
+		}
+		totalSize -= obj.size
+		result.Removed++
+		result.Freed += obj.size
+	}
+	return result, nil
+}
+
+// Verify recalcule le hash de chaque objet et renvoie la liste des objets corrompus, ils sont supprimés si remove est vrai
+func (s *Store) Verify(remove bool) ([]string, error) {
+	objects, err := s.objects()
+	if err != nil {
+		return []string{}, err
+	}
+
+	corrupted := []string{}
+	for _, obj := range objects {
+		hasher := newHasher(obj.hash)
+		if hasher == nil {
+			continue
+		}
+		file, err := os.Open(obj.path)
+		if err != nil {
+			return corrupted, errors.New("Impossible de lire l'objet " + obj.hash + "\n[ERREUR]:" + err.Error())
+		}
+		_, errCopy := io.Copy(hasher, file)
+		file.Close()
+		if errCopy == nil && hex.EncodeToString(hasher.Sum(nil)) == obj.hash {
+			continue
+		}
+		corrupted = append(corrupted, obj.hash)
+		if remove {
+			os.Remove(obj.path)
+		}
+	}
+	return corrupted, nil
+}
+
+func (s *Store) objects() ([]object, error) {
+	objects := []object{}
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) == ".tmp" {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, object{hash: entry.Name(), path: path, size: info.Size(), lastUse: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return []object{}, errors.New("Erreur lors du parcours du dépôt local " + s.dir + "\n[ERREUR]:" + err.Error())
+	}
+	return objects, nil
+}
+
+func (s *Store) touch(hash string) {
+	now := time.Now()
+	os.Chtimes(s.Path(hash), now, now)
+}
+
+// HashFile calcule le hash sha1 d'un fichier, le même algorithme que celui des manifests cytrus
+func HashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HashData calcule le hash d'un contenu avec l'algorithme correspondant à la longueur de expectedHash
+func HashData(expectedHash string, data []byte) string {
+	hasher := NewHasher(expectedHash)
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// NewHasher renvoie l'algorithme correspondant à la longueur de expectedHash, sha1 par défaut
+func NewHasher(expectedHash string) hash.Hash {
+	if hasher := newHasher(expectedHash); hasher != nil {
+		return hasher
+	}
+	return sha1.New()
+}
+
+// newHasher renvoie l'algorithme correspondant à la longueur du hash, nil s'il n'est pas connu
+func newHasher(objectHash string) hash.Hash {
+	switch len(objectHash) {
+	case 40:
+		return sha1.New()
+	case 64:
+		return sha256.New()
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/dedupe"
+	"cytrusdownloader/store"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	commands["sync"] = command{description: "Télécharge toutes les versions décrites dans un fichier de configuration yaml, toml ou json", run: syncCommand}
+}
+
+// syncConfig est le fichier de configuration de la commande sync
+type syncConfig struct {
+	OutDir     string `json:"outdir" yaml:"outdir" toml:"outdir"`
+	CacheDir   string `json:"cache-dir" yaml:"cache-dir" toml:"cache-dir"`
+	CatalogURL string `json:"catalog-url" yaml:"catalog-url" toml:"catalog-url"`
+	CDNURL     string `json:"cdn-url" yaml:"cdn-url" toml:"cdn-url"`
+	// nombre de versions téléchargées en même temps
+	Concurrency int  `json:"concurrency" yaml:"concurrency" toml:"concurrency"`
+	Store       bool `json:"store" yaml:"store" toml:"store"`
+	// déduplication entre les versions installées [none|hardlink|reflink|auto]
+	Link    string       `json:"link" yaml:"link" toml:"link"`
+	Targets []syncTarget `json:"targets" yaml:"targets" toml:"targets"`
+}
+
+// syncTarget décrit un jeu à télécharger pour chaque couple plateforme, release
+type syncTarget struct {
+	Game      string   `json:"game" yaml:"game" toml:"game"`
+	Platforms []string `json:"platforms" yaml:"platforms" toml:"platforms"`
+	Releases  []string `json:"releases" yaml:"releases" toml:"releases"`
+	// version précise à télécharger, la dernière version par défaut
+	Version string `json:"version" yaml:"version" toml:"version"`
+	// version de cytrus de la dernière version, 5 pour les versions publiées par cytrus 5, la plus récente par défaut
+	Generation int      `json:"generation" yaml:"generation" toml:"generation"`
+	Fragments  []string `json:"fragments" yaml:"fragments" toml:"fragments"`
+	Layout     string   `json:"layout" yaml:"layout" toml:"layout"`
+	OutDir     string   `json:"outdir" yaml:"outdir" toml:"outdir"`
+	Prune      bool     `json:"prune" yaml:"prune" toml:"prune"`
+	Keep       []string `json:"keep" yaml:"keep" toml:"keep"`
+}
+
+// syncJob est un téléchargement d'un couple jeu, plateforme, release
+type syncJob struct {
+	target   syncTarget
+	platform string
+	release  string
+	version  string
+	// autres couples dont la version est installée dans le même dossier, ils ne sont pas téléchargés une seconde fois
+	shared []string
+}
+
+func (j syncJob) key() string {
+	return j.target.Game + "/" + j.platform + "/" + j.release
+}
+
+// keys renvoie le couple du téléchargement suivi des couples qui partagent son dossier
+func (j syncJob) keys() string {
+	return strings.Join(append([]string{j.key()}, j.shared...), ", ")
+}
+
+func (j syncJob) options() cytrus.Options {
+	return cytrus.Options{Game: j.target.Game, Release: j.release, Platform: j.platform, Version: j.version, OutputDir: j.target.OutDir, Fragments: j.target.Fragments, Layout: j.target.Layout}
+}
+
+// installRoot renvoie le dossier modifié par le téléchargement: le dossier de la version ou,
+// pour une installation versionnée, le dossier de la plateforme dont le lien current et l'historique sont partagés par toutes les releases
+func (j syncJob) installRoot() string {
+	options := j.options()
+	if options.Layout == cytrus.LayoutVersioned {
+		return options.InstallRoot()
+	}
+	return options.ContentDestination()
+}
+
+// sameContent indique si les deux téléchargements installent les mêmes fichiers dans le même dossier
+// le dossier ne contient pas la release, main et beta partagent souvent la même version
+func (j syncJob) sameContent(other syncJob) bool {
+	return j.options().ContentDestination() == other.options().ContentDestination() &&
+		strings.Join(j.target.Fragments, ",") == strings.Join(other.target.Fragments, ",") &&
+		j.target.Prune == other.target.Prune && strings.Join(j.target.Keep, ",") == strings.Join(other.target.Keep, ",")
+}
+
+type syncResult struct {
+	job      syncJob
+	duration time.Duration
+	err      error
+}
+
+func syncCommand(args []string) error {
+	var concurrency int
+	var dryRun bool
+
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	flags.IntVar(&concurrency, "concurrency", 0, "Nombre de versions téléchargées en même temps, remplace la valeur du fichier de configuration")
+	flags.BoolVar(&dryRun, "dry-run", false, "Affiche les versions qui seraient téléchargées sans rien télécharger")
+	catalogOpts := addCatalogFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Erreur, veuillez indiquer le fichier de configuration")
+	}
+	config, err := loadSyncConfig(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if concurrency > 0 {
+		config.Concurrency = concurrency
+	}
+	if config.CacheDir != "" {
+		catalogOpts.cacheDir = config.CacheDir
+	}
+	if config.CatalogURL != "" {
+		catalogOpts.url = config.CatalogURL
+	}
+	catalogOpts.useCDN(config.CDNURL)
+
+	jobs, err := resolveSyncJobs(config, catalogOpts)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		for _, job := range jobs {
+			fmt.Println(job.keys(), job.version)
+		}
+		return nil
+	}
+
+	results := runSyncJobs(config, catalogOpts, jobs)
+	printSyncResults(results)
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.New("Erreur, " + strconv.Itoa(failed) + " téléchargements sur " + strconv.Itoa(len(results)) + " ont échoué")
+	}
+	return nil
+}
+
+// loadSyncConfig lis la configuration au format json, yaml ou toml suivant l'extension du fichier
+func loadSyncConfig(configPath string) (syncConfig, error) {
+	config := syncConfig{}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, errors.New("Impossible de lire le fichier de configuration " + configPath + "\n[ERREUR]:" + err.Error())
+	}
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+		err = json.Unmarshal(data, &config)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	default:
+		return config, errors.New("Erreur, le format du fichier de configuration " + configPath + " n'est pas supporté [.json|.yaml|.yml|.toml]")
+	}
+	if err != nil {
+		return config, errors.New("Erreur lors de la lecture du fichier de configuration " + configPath + "\n[ERREUR]:" + err.Error())
+	}
+
+	if config.OutDir == "" {
+		config.OutDir = "out/"
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if len(config.Targets) == 0 {
+		return config, errors.New("Erreur, le fichier de configuration ne contient aucune cible")
+	}
+	for i, target := range config.Targets {
+		if target.Game == "" {
+			return config, errors.New("Erreur, la cible " + strconv.Itoa(i+1) + " n'indique pas de jeu")
+		}
+		if target.Layout == "" {
+			target.Layout = cytrus.LayoutFlat
+		}
+		if target.Layout != cytrus.LayoutFlat && target.Layout != cytrus.LayoutVersioned {
+			return config, errors.New("Erreur, l'organisation " + target.Layout + " de la cible " + target.Game + " n'existe pas [flat|versioned]")
+		}
+		if len(target.Platforms) == 0 {
+			return config, errors.New("Erreur, la cible " + target.Game + " n'indique pas de plateforme")
+		}
+		if len(target.Releases) == 0 {
+			target.Releases = []string{"main"}
+		}
+		if target.OutDir == "" {
+			target.OutDir = config.OutDir
+		}
+		// le jeu est ajouté à la suite du dossier de sortie
+		if !strings.HasSuffix(target.OutDir, "/") {
+			target.OutDir += "/"
+		}
+		target.Game = strings.ToLower(target.Game)
+		config.Targets[i] = target
+	}
+	return config, nil
+}
+
+// resolveSyncJobs détaille chaque cible par plateforme et release et résout les dernières versions avec un seul catalogue
+// les couples qui installent la même version dans le même dossier ne forment qu'un téléchargement
+func resolveSyncJobs(config syncConfig, catalogOpts *catalogOptions) ([]syncJob, error) {
+	var catalog *Catalog
+	jobs := []syncJob{}
+	for _, target := range config.Targets {
+		for _, platform := range target.Platforms {
+			for _, release := range target.Releases {
+				job := syncJob{target: target, platform: strings.ToLower(platform), release: strings.ToLower(release), version: target.Version}
+				if job.version == "" || job.version == "latest" {
+					if catalog == nil {
+						var err error
+						if catalog, err = loadCatalog(catalogOpts); err != nil {
+							return nil, errors.New("Erreur, lors de la récupération du catalogue des jeux\n[ERREUR]: " + err.Error())
+						}
+					}
+					if !catalog.IsGameAvalaible(job.target.Game) {
+						return nil, errors.New("Le jeu " + job.target.Game + " n'existe pas dans le catalogue")
+					}
+					version, err := catalog.LastVersionOfGeneration(job.target.Game, job.platform, job.release, job.target.Generation)
+					if err != nil {
+						return nil, errors.New("Impossible de trouver la version de " + job.key() + "\n[ERREUR]: " + err.Error())
+					}
+					job.version = version
+				}
+				if i := slices.IndexFunc(jobs, job.sameContent); i >= 0 {
+					jobs[i].shared = append(jobs[i].shared, job.key())
+					continue
+				}
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// runSyncJobs télécharge les versions avec au plus config.Concurrency téléchargements en même temps
+// le dépôt local et les copies partagées de chaque dossier de sortie sont communs à toutes les cibles,
+// les téléchargements qui modifient le même dossier d'installation sont faits l'un après l'autre
+func runSyncJobs(config syncConfig, catalogOpts *catalogOptions, jobs []syncJob) []syncResult {
+	results := make([]syncResult, len(jobs))
+	pools := map[string]*dedupe.Pool{}
+	var poolsMutex sync.Mutex
+	rootLocks := map[string]*sync.Mutex{}
+	for _, job := range jobs {
+		if rootLocks[job.installRoot()] == nil {
+			rootLocks[job.installRoot()] = &sync.Mutex{}
+		}
+	}
+
+	openJobPool := func(job syncJob) (*dedupe.Pool, error) {
+		linkMode := config.Link
+		if linkMode == "" && job.target.Layout == cytrus.LayoutVersioned {
+			linkMode = string(dedupe.ModeAuto)
+		}
+		key := job.target.OutDir + "|" + linkMode
+		poolsMutex.Lock()
+		defer poolsMutex.Unlock()
+		if pool, exists := pools[key]; exists {
+			return pool, nil
+		}
+		pool, err := openPool(job.target.OutDir, linkMode)
+		if err != nil {
+			return nil, err
+		}
+		pools[key] = pool
+		return pool, nil
+	}
+
+	var objectStore *store.Store
+	var errStore error
+	if config.Store {
+		objectStore, errStore = openStore(catalogOpts.cacheDir)
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, config.Concurrency)
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rootLock := rootLocks[job.installRoot()]
+			rootLock.Lock()
+			defer rootLock.Unlock()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			fmt.Println("Téléchargement de", job.keys(), "version", job.version)
+			err := errStore
+			if err == nil {
+				var pool *dedupe.Pool
+				if pool, err = openJobPool(job); err == nil {
+					options := job.options()
+					options.CDNURL, options.Store, options.Pool, options.OnManifest = config.CDNURL, objectStore, pool, manifestRecorder(catalogOpts.cacheDir)
+					if job.target.Prune {
+						options.Prune = &cytrus.PruneOptions{Keep: job.target.Keep}
+					}
+					if options.Layout == cytrus.LayoutVersioned {
+						prepareVersioned(&options, catalogOpts.cacheDir)
+					}
+					err = installVersion(options)
+				}
+			}
+			results[i] = syncResult{job: job, duration: time.Since(start), err: err}
+			if err != nil {
+				fmt.Println("Erreur lors du téléchargement de", job.key(), "\n[ERREUR]:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func printSyncResults(results []syncResult) {
+	fmt.Println()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "CIBLE\tVERSION\tDURÉE\tRÉSULTAT")
+	for _, result := range results {
+		status := "ok"
+		if result.err != nil {
+			status = "échec: " + strings.ReplaceAll(result.err.Error(), "\n", " ")
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", result.job.keys(), result.job.version, result.duration.Round(time.Second), status)
+	}
+	writer.Flush()
+}
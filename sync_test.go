@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/cytrus6"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSyncConfigFormats(t *testing.T) {
+	configs := map[string]string{
+		"sync.json": `{"outdir": "jeux", "cache-dir": "cache", "concurrency": 2, "targets": [
+			{"game": "Dofus", "platforms": ["windows", "linux"], "releases": ["main", "beta"], "fragments": ["main"], "layout": "versioned", "prune": true, "keep": ["*.log"]},
+			{"game": "retro", "platforms": ["windows"], "generation": 5}]}`,
+		"sync.yaml": `outdir: jeux
+cache-dir: cache
+concurrency: 2
+targets:
+  - game: Dofus
+    platforms: [windows, linux]
+    releases: [main, beta]
+    fragments: [main]
+    layout: versioned
+    prune: true
+    keep: ["*.log"]
+  - game: retro
+    platforms: [windows]
+    generation: 5
+`,
+		"sync.toml": `outdir = "jeux"
+cache-dir = "cache"
+concurrency = 2
+
+[[targets]]
+game = "Dofus"
+platforms = ["windows", "linux"]
+releases = ["main", "beta"]
+fragments = ["main"]
+layout = "versioned"
+prune = true
+keep = ["*.log"]
+
+[[targets]]
+game = "retro"
+platforms = ["windows"]
+generation = 5
+`,
+	}
+	expected := syncConfig{OutDir: "jeux", CacheDir: "cache", Concurrency: 2, Targets: []syncTarget{
+		{Game: "dofus", Platforms: []string{"windows", "linux"}, Releases: []string{"main", "beta"}, Fragments: []string{"main"}, Layout: cytrus.LayoutVersioned, OutDir: "jeux/", Prune: true, Keep: []string{"*.log"}},
+		{Game: "retro", Platforms: []string{"windows"}, Releases: []string{"main"}, Generation: 5, Layout: cytrus.LayoutFlat, OutDir: "jeux/"},
+	}}
+
+	dir := t.TempDir()
+	for name, content := range configs {
+		configPath := filepath.Join(dir, name)
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadSyncConfig(configPath)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: configuration différente\n%+v\n%+v", name, config, expected)
+		}
+	}
+}
+
+func TestResolveSyncJobsMergesSharedDestination(t *testing.T) {
+	config := syncConfig{Targets: []syncTarget{
+		{Game: "dofus", Platforms: []string{"windows"}, Releases: []string{"main", "beta"}, Version: "6.0_1.0", Layout: cytrus.LayoutFlat, OutDir: "out/"},
+		{Game: "dofus", Platforms: []string{"linux"}, Releases: []string{"main"}, Version: "6.0_1.0", Layout: cytrus.LayoutFlat, OutDir: "out/"},
+	}}
+	jobs, err := resolveSyncJobs(config, &catalogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("%d téléchargements au lieu de 2: %+v", len(jobs), jobs)
+	}
+	if jobs[0].keys() != "dofus/windows/main, dofus/windows/beta" || jobs[1].keys() != "dofus/linux/main" {
+		t.Errorf("téléchargements %q et %q", jobs[0].keys(), jobs[1].keys())
+	}
+}
+
+// publishSyncVersion publie une version de dofus windows pour une release dans le cdn local
+func publishSyncVersion(t *testing.T, cdnDir string, release string, version string, content string) {
+	inputDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(inputDir, "main"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "main", "game.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := cytrus6.PublishOptions{Game: "dofus", Release: release, Platform: "windows", Version: version, OutputDir: cdnDir}
+	if _, err := cytrus6.Publish(inputDir, options); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunSyncJobsSharingAnInstallRoot(t *testing.T) {
+	cdnDir := t.TempDir()
+	publishSyncVersion(t, cdnDir, "main", "6.0_1.0", "version 1.0")
+	publishSyncVersion(t, cdnDir, "beta", "6.0_1.0", "version 1.0")
+	publishSyncVersion(t, cdnDir, "beta", "6.0_1.1", "version 1.1")
+
+	outDir := t.TempDir() + "/"
+	config := syncConfig{CDNURL: cdnDir, Concurrency: 4, Targets: []syncTarget{
+		{Game: "dofus", Platforms: []string{"windows"}, Releases: []string{"main", "beta"}, Version: "6.0_1.0", Layout: cytrus.LayoutFlat, OutDir: outDir, Prune: true},
+		{Game: "dofus", Platforms: []string{"windows"}, Releases: []string{"main"}, Version: "6.0_1.0", Layout: cytrus.LayoutVersioned, OutDir: outDir},
+		{Game: "dofus", Platforms: []string{"windows"}, Releases: []string{"beta"}, Version: "6.0_1.1", Layout: cytrus.LayoutVersioned, OutDir: outDir},
+	}}
+	catalogOpts := &catalogOptions{cacheDir: t.TempDir()}
+	jobs, err := resolveSyncJobs(config, catalogOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("%d téléchargements au lieu de 3", len(jobs))
+	}
+	for _, result := range runSyncJobs(config, catalogOpts, jobs) {
+		if result.err != nil {
+			t.Errorf("%s: %v", result.job.keys(), result.err)
+		}
+	}
+
+	expected := map[string]string{
+		"dofus/1.0/windows/main/game.txt":              "version 1.0",
+		"dofus/windows/versions/6.0_1.0/main/game.txt": "version 1.0",
+		"dofus/windows/versions/6.0_1.1/main/game.txt": "version 1.1",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s: %q, %v au lieu de %q", name, data, err, content)
+		}
+	}
+	current, err := os.Readlink(filepath.Join(outDir, "dofus", "windows", "current"))
+	if err != nil || (current != "versions/6.0_1.0" && current != "versions/6.0_1.1") {
+		t.Errorf("le lien current pointe vers %q (%v)", current, err)
+	}
+}
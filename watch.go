@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/dedupe"
+	"cytrusdownloader/store"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["watch"] = command{description: "Surveille le catalogue et télécharge automatiquement les nouvelles versions", run: watchCommand}
+}
+
+// watchTarget correspond à un couple jeu, plateforme, release surveillé
+type watchTarget struct {
+	game     string
+	platform string
+	release  string
+}
+
+func (t watchTarget) key() string {
+	return t.game + "/" + t.platform + "/" + t.release
+}
+
+// watchEvent est envoyé au webhook lors d'un changement de version
+type watchEvent struct {
+	Game       string `json:"game"`
+	Platform   string `json:"platform"`
+	Release    string `json:"release"`
+	OldVersion string `json:"oldVersion"`
+	NewVersion string `json:"newVersion"`
+	Directory  string `json:"directory,omitempty"`
+}
+
+type watchOptions struct {
+	outDownload string
+	download    bool
+	hook        string
+	webhook     string
+	statePath   string
+	objectStore *store.Store
+	pool        *dedupe.Pool
+	cacheDir    string
+	cdnURL      string
+}
+
+// watchState est conservé entre deux vérifications dans le fichier watch.json du dossier de cache
+type watchState struct {
+	// dernière version traitée de chaque couple jeu, plateforme, release
+	Versions map[string]string `json:"versions"`
+	// dossiers des versions dont le téléchargement s'est correctement terminé
+	Installed map[string]bool `json:"installed"`
+}
+
+// webhookClient limite la durée d'un appel au webhook pour ne pas bloquer la surveillance
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+func watchCommand(args []string) error {
+	var games stringList
+	var platforms stringList
+	var releases stringList
+	var interval time.Duration
+	var once bool
+	var useStore bool
+	var linkMode string
+	options := watchOptions{}
+
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.Var(&games, "game", "Jeux à surveiller, séparés par des virgules [dofus,retro,wakfu]")
+	flags.Var(&platforms, "platform", "Plateformes à surveiller, séparées par des virgules, par défaut celle du système d'exploitation [windows,linux,darwin,meta]")
+	flags.Var(&releases, "release", "Releases à surveiller, séparées par des virgules, main par défaut [main,beta]")
+	flags.DurationVar(&interval, "interval", 10*time.Minute, "Intervalle entre deux vérifications du catalogue")
+	flags.BoolVar(&once, "once", false, "Vérifie le catalogue une seule fois puis s'arrête")
+	flags.StringVar(&options.outDownload, "outdir", "out/", "Emplacement de sortie du téléchargement")
+	flags.BoolVar(&options.download, "download", true, "Télécharge les nouvelles versions détectées")
+	flags.StringVar(&options.hook, "hook", "", "Commande exécutée après chaque nouvelle version, les informations sont passées par les variables CYTRUS_*")
+	flags.StringVar(&options.webhook, "webhook", "", "Url appelée en POST avec l'ancienne et la nouvelle version au format json")
+	flags.BoolVar(&useStore, "store", false, "Utilise le dépôt local de chunks du dossier de cache pour ne télécharger que les données absentes")
+	flags.StringVar(&linkMode, "link", "none", "Remplace les fichiers identiques entre les versions installées par des liens vers une copie partagée [none|hardlink|reflink|auto]")
+	flags.StringVar(&options.cdnURL, "cdn-url", "", "Adresse d'un autre cdn, url http ou dossier local ayant l'arborescence du cdn (miroir, version publiée avec pack)")
+	catalogOpts := addCatalogFlags(flags)
+	flags.Parse(args)
+
+	if len(games) == 0 {
+		return errors.New("Erreur, veuillez indiquer au moins un jeu à surveiller")
+	}
+	if len(platforms) == 0 {
+		platforms = stringList{runtime.GOOS}
+	}
+	if len(releases) == 0 {
+		releases = stringList{"main"}
+	}
+	catalogOpts.useCDN(options.cdnURL)
+	if interval <= 0 {
+		return errors.New("Erreur, l'intervalle de vérification doit être positif")
+	}
+	options.statePath = filepath.Join(catalogOpts.cacheDir, "watch.json")
+	options.cacheDir = catalogOpts.cacheDir
+	if useStore {
+		var err error
+		if options.objectStore, err = openStore(catalogOpts.cacheDir); err != nil {
+			return err
+		}
+	}
+	pool, err := openPool(options.outDownload, linkMode)
+	if err != nil {
+		return err
+	}
+	options.pool = pool
+
+	targets := []watchTarget{}
+	for _, game := range games {
+		for _, platform := range platforms {
+			for _, release := range releases {
+				targets = append(targets, watchTarget{game: strings.ToLower(game), platform: strings.ToLower(platform), release: strings.ToLower(release)})
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for {
+		if err := watchPoll(catalogOpts, targets, options); err != nil {
+			fmt.Println("Erreur lors de la vérification du catalogue\n[ERREUR]:", err)
+		}
+		if once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Println("Arrêt de la surveillance")
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func watchPoll(catalogOpts *catalogOptions, targets []watchTarget, options watchOptions) error {
+	catalog, err := loadCatalog(catalogOpts)
+	if err != nil {
+		return err
+	}
+
+	state := loadWatchState(options.statePath)
+
+	for _, target := range targets {
+		if !catalog.IsGameAvalaible(target.game) {
+			fmt.Println("Le jeu", target.game, "n'existe pas dans le catalogue")
+			continue
+		}
+		version, err := catalog.LastVersionOfGame(target.game, target.platform, target.release)
+		if err != nil {
+			fmt.Println("Impossible de trouver la version de", target.key(), "\n[ERREUR]:", err)
+			continue
+		}
+		oldVersion := state.Versions[target.key()]
+		if oldVersion == version {
+			continue
+		}
+
+		fmt.Println("Nouvelle version détectée pour", target.key(), ":", oldVersion, "->", version)
+		if isOlderVersion(version, oldVersion) {
+			fmt.Println("Attention, la version publiée", version, "est plus ancienne que la version précédente", oldVersion)
+		}
+		event := watchEvent{Game: target.game, Platform: target.platform, Release: target.release, OldVersion: oldVersion, NewVersion: version}
+		if options.download {
+			downloadOptions := cytrus.Options{Game: target.game, Release: target.release, Platform: target.platform, Version: version, OutputDir: options.outDownload, CDNURL: options.cdnURL, Store: options.objectStore, Pool: options.pool, OnManifest: manifestRecorder(options.cacheDir)}
+			event.Directory = downloadOptions.ContentDestination()
+			// un dossier présent n'est pas forcément complet, seuls les téléchargements terminés sont considérés comme installés
+			if _, err := os.Stat(event.Directory); err == nil && state.Installed[event.Directory] {
+				fmt.Println("La version", version, "est déjà présente dans", event.Directory)
+			} else if err := downloadWatchVersion(downloadOptions, oldVersion, state, options.cacheDir); err != nil {
+				// l'état n'est pas mis à jour, le téléchargement sera retenté à la prochaine vérification
+				fmt.Println("Erreur lors du téléchargement de", target.key(), "\n[ERREUR]:", err)
+				continue
+			}
+			state.Installed[event.Directory] = true
+		}
+		if err := runWatchHook(options.hook, event); err != nil {
+			fmt.Println("Erreur lors de l'exécution de la commande", options.hook, "\n[ERREUR]:", err)
+		}
+		if err := postWatchWebhook(options.webhook, event); err != nil {
+			fmt.Println("Erreur lors de l'appel du webhook", options.webhook, "\n[ERREUR]:", err)
+		}
+
+		state.Versions[target.key()] = version
+		if err := saveWatchState(options.statePath, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOlderVersion indique que le cdn est revenu à une version plus ancienne
+func isOlderVersion(version string, oldVersion string) bool {
+	newParsed, errNew := cytrus.ParseVersion(version)
+	oldParsed, errOld := cytrus.ParseVersion(oldVersion)
+	return errNew == nil && errOld == nil && newParsed.Less(oldParsed)
+}
+
+// downloadWatchVersion télécharge la nouvelle version en réutilisant les fichiers de l'ancienne si elle est installée
+func downloadWatchVersion(downloadOptions cytrus.Options, oldVersion string, state watchState, cacheDir string) error {
+	if oldVersion != "" {
+		oldOptions := downloadOptions
+		oldOptions.Version = oldVersion
+		if _, err := os.Stat(oldOptions.ContentDestination()); err == nil && state.Installed[oldOptions.ContentDestination()] {
+			seedIndex, err := openSeed([]string{oldOptions.ContentDestination()}, cacheDir)
+			if err != nil {
+				return err
+			}
+			downloadOptions.Seed = seedIndex
+		}
+	}
+	return downloadVersion(downloadOptions)
+}
+
+// loadWatchState lis l'état de la surveillance, un fichier absent ou illisible correspond à une première vérification
+func loadWatchState(statePath string) watchState {
+	state := watchState{}
+	if data, err := os.ReadFile(statePath); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	if state.Versions == nil {
+		state.Versions = make(map[string]string)
+	}
+	if state.Installed == nil {
+		state.Installed = make(map[string]bool)
+	}
+	return state
+}
+
+func saveWatchState(statePath string, state watchState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), os.ModePerm); err != nil {
+		return errors.New("Impossible de crée le dossier " + filepath.Dir(statePath) + "\n[ERREUR]:" + err.Error())
+	}
+	return os.WriteFile(statePath, data, 0644)
+}
+
+func runWatchHook(hook string, event watchEvent) error {
+	commandLine := strings.Fields(hook)
+	if len(commandLine) == 0 {
+		return nil
+	}
+	cmd := exec.Command(commandLine[0], commandLine[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"CYTRUS_GAME="+event.Game,
+		"CYTRUS_PLATFORM="+event.Platform,
+		"CYTRUS_RELEASE="+event.Release,
+		"CYTRUS_OLD_VERSION="+event.OldVersion,
+		"CYTRUS_NEW_VERSION="+event.NewVersion,
+		"CYTRUS_DIRECTORY="+event.Directory,
+	)
+	return cmd.Run()
+}
+
+func postWatchWebhook(webhook string, event watchEvent) error {
+	if webhook == "" {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	res, err := webhookClient.Post(webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.New("Le webhook a répondu avec le code " + strconv.FormatInt(int64(res.StatusCode), 10))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cytrusdownloader/cytrus"
+	"cytrusdownloader/cytrus6"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeWatchServer sert un catalogue, les fichiers d'un cdn local et reçoit les appels du webhook
+type fakeWatchServer struct {
+	*httptest.Server
+	mutex         sync.Mutex
+	version       string
+	failDownloads bool
+	events        []watchEvent
+}
+
+func newFakeWatchServer(t *testing.T, cdnDir string) *fakeWatchServer {
+	fake := &fakeWatchServer{}
+	files := http.FileServer(http.Dir(cdnDir))
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		switch r.URL.Path {
+		case "/cytrus.json":
+			catalog := Cytrus{Version: 6, Name: "production", Games: map[string]Game{
+				"dofus": {Name: "Dofus", Platforms: Platform{Windows: map[string]string{"main": fake.version}}},
+			}}
+			json.NewEncoder(w).Encode(catalog)
+		case "/webhook":
+			event := watchEvent{}
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				t.Errorf("corps du webhook illisible: %v", err)
+			}
+			fake.events = append(fake.events, event)
+		default:
+			if fake.failDownloads {
+				http.Error(w, "indisponible", http.StatusInternalServerError)
+				return
+			}
+			files.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeWatchServer) set(version string, failDownloads bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.version = version
+	f.failDownloads = failDownloads
+}
+
+func (f *fakeWatchServer) receivedEvents() []watchEvent {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]watchEvent{}, f.events...)
+}
+
+// publishWatchVersion publie une version de dofus windows dans le cdn local
+func publishWatchVersion(t *testing.T, cdnDir string, version string, content string) {
+	inputDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(inputDir, "main"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "main", "game.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := cytrus6.PublishOptions{Game: "dofus", Release: "main", Platform: "windows", Version: version, OutputDir: cdnDir}
+	if _, err := cytrus6.Publish(inputDir, options); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newWatchTest(t *testing.T, download bool) (*fakeWatchServer, *catalogOptions, watchOptions) {
+	cdnDir := t.TempDir()
+	publishWatchVersion(t, cdnDir, "6.0_1.0", "version 1.0")
+	publishWatchVersion(t, cdnDir, "6.0_1.1", "version 1.1")
+	fake := newFakeWatchServer(t, cdnDir)
+
+	cacheDir := t.TempDir()
+	catalogOpts := &catalogOptions{url: fake.URL + "/cytrus.json", cacheDir: cacheDir}
+	options := watchOptions{
+		outDownload: t.TempDir() + "/",
+		download:    download,
+		webhook:     fake.URL + "/webhook",
+		statePath:   filepath.Join(cacheDir, "watch.json"),
+		cacheDir:    cacheDir,
+		cdnURL:      fake.URL,
+	}
+	return fake, catalogOpts, options
+}
+
+var watchTargets = []watchTarget{{game: "dofus", platform: "windows", release: "main"}}
+
+func TestWatchPollDetectsVersionChanges(t *testing.T) {
+	fake, catalogOpts, options := newWatchTest(t, false)
+
+	fake.set("6.0_1.0", false)
+	for i := 0; i < 2; i++ {
+		if err := watchPoll(catalogOpts, watchTargets, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.set("6.0_1.1", false)
+	if err := watchPoll(catalogOpts, watchTargets, options); err != nil {
+		t.Fatal(err)
+	}
+
+	events := fake.receivedEvents()
+	expected := []watchEvent{
+		{Game: "dofus", Platform: "windows", Release: "main", OldVersion: "", NewVersion: "6.0_1.0"},
+		{Game: "dofus", Platform: "windows", Release: "main", OldVersion: "6.0_1.0", NewVersion: "6.0_1.1"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("%d appels du webhook, %d attendus: %+v", len(events), len(expected), events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("appel %d du webhook: %+v, attendu %+v", i, events[i], expected[i])
+		}
+	}
+	if state := loadWatchState(options.statePath); state.Versions[watchTargets[0].key()] != "6.0_1.1" {
+		t.Errorf("état enregistré: %v", state.Versions)
+	}
+}
+
+func TestWatchPollRetriesFailedDownload(t *testing.T) {
+	fake, catalogOpts, options := newWatchTest(t, true)
+	directory := cytrus.Options{Game: "dofus", Release: "main", Platform: "windows", Version: "6.0_1.0", OutputDir: options.outDownload}.ContentDestination()
+
+	// un téléchargement interrompu laisse un dossier incomplet
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	fake.set("6.0_1.0", true)
+	for i := 0; i < 2; i++ {
+		if err := watchPoll(catalogOpts, watchTargets, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events := fake.receivedEvents(); len(events) != 0 {
+		t.Fatalf("le webhook ne doit pas être appelé pour un téléchargement en échec: %+v", events)
+	}
+	if state := loadWatchState(options.statePath); len(state.Versions) != 0 || len(state.Installed) != 0 {
+		t.Fatalf("l'état ne doit pas être mis à jour après un échec: %+v", state)
+	}
+
+	fake.set("6.0_1.0", false)
+	if err := watchPoll(catalogOpts, watchTargets, options); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(directory, "main", "game.txt"))
+	if err != nil || string(content) != "version 1.0" {
+		t.Fatalf("fichier téléchargé: %q, %v", content, err)
+	}
+	events := fake.receivedEvents()
+	if len(events) != 1 || events[0].NewVersion != "6.0_1.0" || events[0].Directory != directory {
+		t.Fatalf("appels du webhook: %+v", events)
+	}
+	if state := loadWatchState(options.statePath); !state.Installed[directory] {
+		t.Errorf("la version téléchargée n'est pas enregistrée comme installée: %+v", state)
+	}
+}